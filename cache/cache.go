@@ -2,6 +2,7 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"path/filepath"
 	"time"
 
@@ -34,10 +35,100 @@ type readOptions struct {
 	forceRefresh bool
 }
 
+// lockPollInterval is how often a cached function waiting on another process's lock re-reads the store
+const lockPollInterval = time.Millisecond * 50
+
+// unlockTimeout is how long a cached function waits to release its lock, the callers context may already be done so
+// it's not used
+const unlockTimeout = time.Second * 5
+
+// FuncOption changes the behavior of a cached function for every read
+type FuncOption func(*funcOptions)
+
+// WithLocking makes a cached function coordinate recomputing an expired value with other processes sharing the same
+// store. The store must implement persist.Locker, otherwise this option has no effect. When the value needs to be
+// recomputed, only the caller holding the lock runs the function, other callers wait and re-read the store until a
+// fresh value shows up. If no fresh value shows up before the timeout elapses, the waiting caller runs the function
+// itself. The timeout also bounds how long a lock can be held.
+func WithLocking(timeout time.Duration) FuncOption {
+	return func(opts *funcOptions) {
+		opts.lockTimeout = timeout
+	}
+}
+
+// WithClock sets the clock a cached function uses to decide when its value has expired. This is useful for testing
+// cached functions without having to wait for their TTL to elapse
+func WithClock(clock persist.Clock) FuncOption {
+	return func(opts *funcOptions) {
+		opts.clock = clock
+	}
+}
+
+// WithCodec sets the codec a cached function uses to serialize its value before writing it to the store. The codec's
+// type must match the return type of the cached function
+func WithCodec[T any](codec persist.Codec[T]) FuncOption {
+	return func(opts *funcOptions) {
+		opts.codec = persist.WithCodec(codec)
+	}
+}
+
+// WithSchema sets the schema version recorded with a cached function's value, replacing the automatically computed
+// persist.Fingerprint of its return type. Values stored with a different schema are recomputed, or migrated if
+// WithMigration is provided
+func WithSchema(version string) FuncOption {
+	return func(opts *funcOptions) {
+		opts.schema = version
+	}
+}
+
+// WithMigration sets a function that converts values stored with a different schema, so a cached function's value
+// survives a change to its return type. It's passed the stored schema and the raw bytes written by the old version.
+// If it fails the value is recomputed. The migration's type must match the return type of the cached function
+func WithMigration[T any](migrate func(schema string, raw []byte) (T, error)) FuncOption {
+	return func(opts *funcOptions) {
+		opts.migration = persist.WithMigration(migrate)
+	}
+}
+
+// funcOptions allow the caller to configure how a cached function behaves
+type funcOptions struct {
+	// lockTimeout is how long to wait on another process that's recomputing the value, locking is disabled if it's 0
+	lockTimeout time.Duration
+
+	// clock is used to timestamp and expire the cached value
+	clock persist.Clock
+
+	// codec is a persist.WithCodec option, it's nil if the default codec should be used
+	codec persist.Option
+
+	// schema is the schema version of the cached value, the return type's fingerprint is used if it's empty
+	schema string
+
+	// migration is a persist.WithMigration option, it's nil if values with a different schema should be recomputed
+	migration persist.Option
+}
+
+// dataOptions returns the options that should be passed to persist.NewData
+func (o funcOptions) dataOptions() []persist.Option {
+	dataOpts := []persist.Option{persist.WithClock(o.clock)}
+	if o.codec != nil {
+		dataOpts = append(dataOpts, o.codec)
+	}
+	if o.schema != "" {
+		dataOpts = append(dataOpts, persist.WithSchema(o.schema))
+	}
+	if o.migration != nil {
+		dataOpts = append(dataOpts, o.migration)
+	}
+
+	return dataOpts
+}
+
 // InMemory takes a function and wraps it in an in-memory cache. The function will not be run again if the timeout duration
 // has not fully elapsed since it's last run. Instead, the previously calculated return value will be returned instead
-func InMemory[T any](ttl time.Duration, fn func(context.Context) (T, error)) func(context.Context, ...Option) (T, error) {
-	data := persist.Data[T]{}
+func InMemory[T any](ttl time.Duration, fn func(context.Context) (T, error), funcOpts ...FuncOption) func(context.Context, ...Option) (T, error) {
+	opts := funcOptionsFrom(funcOpts)
+	data := persist.NewData[T](nil, "", opts.dataOptions()...)
 
 	return func(ctx context.Context, options ...Option) (T, error) {
 		read := readOptions{}
@@ -67,11 +158,12 @@ func InMemory[T any](ttl time.Duration, fn func(context.Context) (T, error)) fun
 // has not fully elapsed since it's last run. Instead, the previously calculated return value will be returned instead.
 // Additionally, since state is saved on disk, this timeout persists across multiple runs of a program. Because this
 // requires writing to a backing file, the cache can fail. If this happens OnDisk will fall back on an in-memory cache.
-func OnDisk[T any](file string, ttl time.Duration, fn func(context.Context) (T, error)) func(context.Context, ...Option) (T, error, error) {
-	store := persist.NewFsStore(filepath.Dir(file), false)
+func OnDisk[T any](file string, ttl time.Duration, fn func(context.Context) (T, error), funcOpts ...FuncOption) func(context.Context, ...Option) (T, error, error) {
+	opts := funcOptionsFrom(funcOpts)
+	store := persist.NewFsStore(filepath.Dir(file), false, persist.WithClock(opts.clock))
 	key := filepath.Base(file)
 
-	return Func(store, key, ttl, fn)
+	return Func(store, key, ttl, fn, funcOpts...)
 }
 
 // Func takes a function and wraps it in a cache. The returned function will use the provided store to cache the return
@@ -79,8 +171,10 @@ func OnDisk[T any](file string, ttl time.Duration, fn func(context.Context) (T,
 // last run. Instead, the previously calculated return value will be returned instead. The provided store allows this
 // timeout to be respected even across multiple runs. However, because the store may fail this behavior is not guaranteed
 // If the store cache does fail, Func will fall back on an in-memory cache.
-func Func[T any](store persist.Store, key string, ttl time.Duration, fn func(context.Context) (T, error)) func(context.Context, ...Option) (T, error, error) {
-	data := persist.NewData[T](store, key)
+func Func[T any](store persist.Store, key string, ttl time.Duration, fn func(context.Context) (T, error), funcOpts ...FuncOption) func(context.Context, ...Option) (T, error, error) {
+	opts := funcOptionsFrom(funcOpts)
+	data := persist.NewData[T](store, key, append(opts.dataOptions(), persist.WithTTL(ttl))...)
+	locker, canLock := store.(persist.Locker)
 
 	return func(ctx context.Context, options ...Option) (T, error, error) {
 		loadErr := data.Load(ctx)
@@ -95,6 +189,16 @@ func Func[T any](store persist.Store, key string, ttl time.Duration, fn func(con
 		}
 
 		if read.forceRefresh || data.IsUnset() || data.IsExpired(ttl) {
+			if canLock && opts.lockTimeout > 0 && !read.forceRefresh {
+				unlock, loaded := lockOrWait(ctx, locker, &data, key, ttl, opts.lockTimeout)
+				if loaded {
+					return data.Get(), nil, nil
+				}
+				if unlock != nil {
+					defer release(unlock)
+				}
+			}
+
 			got, err := fn(ctx)
 			if err != nil {
 				return data.Get(), loadErr, err
@@ -110,6 +214,72 @@ func Func[T any](store persist.Store, key string, ttl time.Duration, fn func(con
 	}
 }
 
+// funcOptionsFrom applies each option to a new funcOptions
+func funcOptionsFrom(options []FuncOption) funcOptions {
+	opts := funcOptions{
+		clock: persist.SystemClock{},
+	}
+	for _, opt := range options {
+		opt(&opts)
+	}
+
+	return opts
+}
+
+// lockOrWait tries to acquire the lock for key. If the lock is held by another process it waits for that process to
+// write a fresh value to the store. If a fresh value is loaded into data, loaded will be true. Otherwise, the caller
+// should recompute the value and release the lock with unlock, if it is non-nil.
+func lockOrWait[T any](ctx context.Context, locker persist.Locker, data *persist.Data[T], key string, ttl, timeout time.Duration) (unlock persist.Unlock, loaded bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		unlock, err := locker.TryLock(ctx, key, timeout)
+		if err == nil {
+			// the previous holder may have written a fresh value between the last read and releasing its lock
+			_ = data.Reload(ctx)
+			if !data.IsUnset() && !data.IsExpired(ttl) {
+				release(unlock)
+				return nil, true
+			}
+			return unlock, false
+		}
+		if !errors.Is(err, persist.ErrLockHeld) {
+			// locking failed and the value needs to be computed without it
+			return nil, false
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, false
+		}
+		if wait > lockPollInterval {
+			wait = lockPollInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false
+		case <-timer.C:
+		}
+
+		// the store may not have a value yet, so reload errors are expected while waiting
+		_ = data.Reload(ctx)
+		if !data.IsUnset() && !data.IsExpired(ttl) {
+			return nil, true
+		}
+	}
+}
+
+// release releases a lock with its own timeout, so a lock is not left held until it expires when the callers context
+// is canceled
+func release(unlock persist.Unlock) {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	_ = unlock(ctx)
+}
+
 // SkipErr ignores cache errors in a cached function. It can be used to simplify a functions signature if you don't
 // need to explicitly handle cache errors
 func SkipErr[T any](fn func(context.Context, ...Option) (T, error, error)) func(context.Context, ...Option) (T, error) {
@@ -2,15 +2,20 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/weave-lab/cachin/cache/cachetest"
 	"github.com/weave-lab/cachin/persist"
 )
 
+// testStart is the time fake clocks start at in tests
+var testStart = time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)
+
 func TestInMemory(t *testing.T) {
 	type args[T any] struct {
 		ttl     time.Duration
@@ -18,12 +23,12 @@ func TestInMemory(t *testing.T) {
 		options []Option
 	}
 	type testCase[T any] struct {
-		name    string
-		args    args[T]
-		minTime time.Duration
-		maxTime time.Duration
-		want    T
-		wantErr bool
+		name      string
+		args      args[T]
+		advance   time.Duration
+		wantCalls int
+		want      T
+		wantErr   bool
 	}
 	tests := []testCase[string]{
 		{
@@ -31,13 +36,12 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: time.Millisecond,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 200,
-			time.Second,
+			time.Millisecond * 10,
+			3,
 			"test",
 			false,
 		},
@@ -46,13 +50,12 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: time.Second,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 100,
-			time.Second * 150,
+			time.Millisecond * 10,
+			1,
 			"test",
 			false,
 		},
@@ -61,13 +64,12 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 100,
-			time.Millisecond * 150,
+			time.Hour * 24 * 365,
+			1,
 			"test",
 			false,
 		},
@@ -76,13 +78,12 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{WithForceRefresh()},
 			},
-			time.Millisecond * 300,
-			time.Millisecond * 350,
+			time.Millisecond * 10,
+			3,
 			"test",
 			false,
 		},
@@ -91,13 +92,26 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: time.Millisecond * 15,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{WithRefreshTTL()},
 			},
-			time.Millisecond * 100,
-			time.Millisecond * 120,
+			time.Millisecond * 10,
+			1,
+			"test",
+			false,
+		},
+		{
+			"without reset ttl",
+			args[string]{
+				ttl: time.Millisecond * 15,
+				fn: func(_ context.Context) (string, error) {
+					return "test", nil
+				},
+				options: []Option{},
+			},
+			time.Millisecond * 10,
+			2,
 			"test",
 			false,
 		},
@@ -106,26 +120,29 @@ func TestInMemory(t *testing.T) {
 			args[string]{
 				ttl: persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "", errors.New("failed")
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 300,
-			time.Millisecond * 350,
+			time.Millisecond * 10,
+			3,
 			"",
 			true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			start := time.Now()
-			fn := InMemory(tt.args.ttl, tt.args.fn)
+			clock := cachetest.NewFakeClock(testStart)
+			calls := 0
+			fn := InMemory(tt.args.ttl, func(ctx context.Context) (string, error) {
+				calls++
+				return tt.args.fn(ctx)
+			}, WithClock(clock))
 
 			ctx := context.Background()
 			// call it once to warm up the cache
 			_, _ = fn(ctx, tt.args.options...)
-			time.Sleep(time.Millisecond * 10)
+			clock.Advance(tt.advance)
 
 			// call it a second time to test the basic cache mechanisms
 			got, err := fn(ctx, tt.args.options...)
@@ -135,7 +152,7 @@ func TestInMemory(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("InMemory() err = %v, wantErr = %v", err, tt.wantErr)
 			}
-			time.Sleep(time.Microsecond * 10)
+			clock.Advance(tt.advance)
 
 			// call it a third time to test the ttl reset mechanism
 			got, err = fn(ctx, tt.args.options...)
@@ -146,13 +163,9 @@ func TestInMemory(t *testing.T) {
 				t.Errorf("InMemory() err = %v, wantErr = %v", err, tt.wantErr)
 			}
 
-			// check timing to make sure the cache mechanism works as expected
-			duration := time.Since(start)
-			if duration > tt.maxTime {
-				t.Errorf("InMemory() %v slower than max timeout %v", duration, tt.maxTime)
-			}
-			if duration < tt.minTime {
-				t.Errorf("InMemory() %v faster than min timeout %v", duration, tt.minTime)
+			// check the number of calls to make sure the cache mechanism works as expected
+			if calls != tt.wantCalls {
+				t.Errorf("InMemory() called fn %v times, want %v", calls, tt.wantCalls)
 			}
 		})
 	}
@@ -168,8 +181,8 @@ func TestOnDisk(t *testing.T) {
 	type testCase[T any] struct {
 		name          string
 		args          args[T]
-		minTime       time.Duration
-		maxTime       time.Duration
+		advance       time.Duration
+		wantCalls     int
 		want          string
 		wantErr       bool
 		wantCacheErr  bool
@@ -182,13 +195,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  time.Millisecond,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 200,
-			time.Second,
+			time.Millisecond * 10,
+			3,
 			"test",
 			false,
 			false,
@@ -200,13 +212,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  time.Second,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 100,
-			time.Second * 150,
+			time.Millisecond * 10,
+			1,
 			"test",
 			false,
 			false,
@@ -218,13 +229,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 100,
-			time.Millisecond * 150,
+			time.Hour * 24 * 365,
+			1,
 			"test",
 			false,
 			false,
@@ -236,13 +246,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{WithForceRefresh()},
 			},
-			time.Millisecond * 300,
-			time.Millisecond * 350,
+			time.Millisecond * 10,
+			3,
 			"test",
 			false,
 			false,
@@ -254,13 +263,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  time.Millisecond * 15,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "test", nil
 				},
 				options: []Option{WithRefreshTTL()},
 			},
-			time.Millisecond * 100,
-			time.Millisecond * 130,
+			time.Millisecond * 10,
+			1,
 			"test",
 			false,
 			false,
@@ -272,13 +280,12 @@ func TestOnDisk(t *testing.T) {
 				file: filepath.Join(t.TempDir(), "test"),
 				ttl:  persist.Forever,
 				fn: func(_ context.Context) (string, error) {
-					time.Sleep(time.Millisecond * 100)
 					return "", errors.New("failed")
 				},
 				options: []Option{},
 			},
-			time.Millisecond * 300,
-			time.Millisecond * 350,
+			time.Millisecond * 10,
+			3,
 			"",
 			true,
 			true,
@@ -287,12 +294,16 @@ func TestOnDisk(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			start := time.Now()
-			fn := OnDisk(tt.args.file, tt.args.ttl, tt.args.fn)
+			clock := cachetest.NewFakeClock(testStart)
+			calls := 0
+			fn := OnDisk(tt.args.file, tt.args.ttl, func(ctx context.Context) (string, error) {
+				calls++
+				return tt.args.fn(ctx)
+			}, WithClock(clock))
 
 			// call it once to warm up the cache
 			_, _, _ = fn(context.Background(), tt.args.options...)
-			time.Sleep(time.Millisecond * 10)
+			clock.Advance(tt.advance)
 
 			// call it a second time to test the basic cache mechanisms
 			got, cacheErr, err := fn(context.Background(), tt.args.options...)
@@ -305,7 +316,7 @@ func TestOnDisk(t *testing.T) {
 			if (cacheErr != nil) != tt.wantCacheErr {
 				t.Errorf("OnDisk() err = %v, wantErr = %v", cacheErr, tt.wantCacheErr)
 			}
-			time.Sleep(time.Millisecond * 10)
+			clock.Advance(tt.advance)
 
 			// call it a third time to test the ttl reset mechanism
 			got, cacheErr, err = fn(context.Background(), tt.args.options...)
@@ -319,30 +330,57 @@ func TestOnDisk(t *testing.T) {
 				t.Errorf("OnDisk() err = %v, wantErr = %v", cacheErr, tt.wantCacheErr)
 			}
 
-			// check timing to make sure the cache mechanism works as expected
-			duration := time.Since(start)
-			if duration > tt.maxTime {
-				t.Errorf("OnDisk() %v slower than max timeout %v", duration, tt.maxTime)
-			}
-			if duration < tt.minTime {
-				t.Errorf("OnDisk() %v faster than min timeout %v", duration, tt.minTime)
+			// check the number of calls to make sure the cache mechanism works as expected
+			if calls != tt.wantCalls {
+				t.Errorf("OnDisk() called fn %v times, want %v", calls, tt.wantCalls)
 			}
 
 			if tt.wantCacheErr || tt.wantErr {
 				return
 			}
 			// check to make sure the cache file exists
-			cacheFile, err := os.ReadFile(tt.args.file)
+			raw, err := os.ReadFile(tt.args.file)
 			if err != nil {
 				t.Errorf("OnDisk() failed to read cache file %s", err)
 			}
-			if string(cacheFile) != tt.wantCacheFile {
-				t.Errorf("OnDisk() cacheFile = %v, wantCacheFile = %v", string(cacheFile), tt.wantCacheFile)
+			cacheFile := persist.Envelope{}
+			if err := cacheFile.UnmarshalBinary(raw); err != nil {
+				t.Errorf("OnDisk() failed to unmarshal cache file %s", err)
+			}
+			if string(cacheFile.Value) != tt.wantCacheFile {
+				t.Errorf("OnDisk() cacheFile = %v, wantCacheFile = %v", string(cacheFile.Value), tt.wantCacheFile)
+			}
+			if cacheFile.TTL != tt.args.ttl {
+				t.Errorf("OnDisk() cacheFile TTL = %v, want %v", cacheFile.TTL, tt.args.ttl)
 			}
 		})
 	}
 }
 
+func TestOnDisk_restore(t *testing.T) {
+	clock := cachetest.NewFakeClock(testStart)
+	file := filepath.Join(t.TempDir(), "test")
+	calls := 0
+	fn := func(_ context.Context) (string, error) {
+		calls++
+		return "test", nil
+	}
+
+	// a second run of the program should restore the value from disk until the ttl elapses
+	_, _, _ = OnDisk(file, time.Hour, fn, WithClock(clock))(context.Background())
+	clock.Advance(time.Minute * 30)
+	_, _, _ = OnDisk(file, time.Hour, fn, WithClock(clock))(context.Background())
+	if calls != 1 {
+		t.Errorf("OnDisk() called fn %v times before expiration, want 1", calls)
+	}
+
+	clock.Advance(time.Hour)
+	_, _, _ = OnDisk(file, time.Hour, fn, WithClock(clock))(context.Background())
+	if calls != 2 {
+		t.Errorf("OnDisk() called fn %v times after expiration, want 2", calls)
+	}
+}
+
 func TestSkipErr(t *testing.T) {
 	type args struct {
 		fn func(context.Context, ...Option) (string, error, error)
@@ -443,3 +481,297 @@ func TestLogErr(t *testing.T) {
 		})
 	}
 }
+
+func TestFunc_WithLocking(t *testing.T) {
+	type testCase struct {
+		name      string
+		write     bool
+		timeout   time.Duration
+		want      string
+		wantCalls int
+	}
+	tests := []testCase{
+		{
+			"waits for lock holder",
+			true,
+			time.Second,
+			"from other process",
+			0,
+		},
+		{
+			"computes after timeout",
+			false,
+			time.Millisecond * 100,
+			"computed",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := persist.NewFsStore(t.TempDir(), false)
+
+			// simulate another process recomputing the value
+			unlock, err := store.TryLock(ctx, "test", time.Second)
+			if err != nil {
+				t.Fatal("Func() failed to lock key", err)
+			}
+			defer func() {
+				_ = unlock(ctx)
+			}()
+			if tt.write {
+				go func() {
+					time.Sleep(time.Millisecond * 100)
+					_ = store.Set(ctx, "test", []byte(`"from other process"`))
+				}()
+			}
+
+			calls := 0
+			fn := Func(store, "test", time.Hour, func(_ context.Context) (string, error) {
+				calls++
+				return "computed", nil
+			}, WithLocking(tt.timeout))
+
+			got, _, err := fn(ctx)
+			if err != nil {
+				t.Errorf("Func() err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Func() = %v, want = %v", got, tt.want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Func() calls = %v, want = %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// handoffStore is a Store whose lock is held by another process. If handoff is set the other process writes a fresh
+// value and releases the lock just before it's acquired
+type handoffStore struct {
+	*persist.MemoryStore
+	handoff  bool
+	tries    int
+	unlocked bool
+}
+
+func (s *handoffStore) TryLock(ctx context.Context, key string, _ time.Duration) (persist.Unlock, error) {
+	s.tries++
+	if s.handoff {
+		if s.tries == 1 {
+			return nil, persist.ErrLockHeld
+		}
+		if err := s.Set(ctx, key, []byte(`"from other process"`)); err != nil {
+			return nil, err
+		}
+	}
+	return func(ctx context.Context) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.unlocked = true
+		return nil
+	}, nil
+}
+
+func TestFunc_WithLocking_handoff(t *testing.T) {
+	ctx := context.Background()
+	store := &handoffStore{MemoryStore: persist.NewMemoryStore(persist.Forever, 0), handoff: true}
+
+	calls := 0
+	fn := Func(store, "test", time.Hour, func(_ context.Context) (string, error) {
+		calls++
+		return "computed", nil
+	}, WithLocking(time.Second))
+
+	got, _, err := fn(ctx)
+	if err != nil || got != "from other process" {
+		t.Errorf("Func() = %v, %v, want from other process", got, err)
+	}
+	if calls != 0 {
+		t.Errorf("Func() calls = %v, want 0", calls)
+	}
+	if !store.unlocked {
+		t.Error("Func() did not release the lock")
+	}
+}
+
+func TestFunc_WithLocking_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &handoffStore{MemoryStore: persist.NewMemoryStore(persist.Forever, 0)}
+
+	// the function's context is canceled before the lock is released
+	calls := 0
+	fn := Func(store, "test", time.Hour, func(_ context.Context) (string, error) {
+		calls++
+		cancel()
+		return "computed", nil
+	}, WithLocking(time.Second))
+	if _, _, err := fn(ctx); err != nil || calls != 1 {
+		t.Fatalf("Func() calls = %v, err = %v, want 1", calls, err)
+	}
+	if !store.unlocked {
+		t.Error("Func() did not release the lock with a canceled context")
+	}
+}
+
+func TestFunc(t *testing.T) {
+	type testCase struct {
+		name         string
+		faults       []cachetest.Fault
+		wantCalls    int
+		wantSets     int
+		wantCacheErr bool
+	}
+	tests := []testCase{
+		{
+			"healthy store",
+			nil,
+			1,
+			1,
+			false,
+		},
+		{
+			"store fails reads",
+			[]cachetest.Fault{{Ops: []cachetest.Op{cachetest.OpGet}, Fail: true}},
+			1,
+			1,
+			false,
+		},
+		{
+			"store fails writes",
+			[]cachetest.Fault{{Ops: []cachetest.Op{cachetest.OpSet}, Fail: true}},
+			1,
+			0,
+			true,
+		},
+		{
+			"store is corrupt",
+			[]cachetest.Fault{{Corrupt: true}},
+			1,
+			1,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := cachetest.NewFakeClock(testStart)
+			backing := cachetest.NewStore(clock)
+			recorder := cachetest.NewRecordingStore(backing)
+			store := cachetest.NewFaultStore(recorder, tt.faults...)
+			fn, counter := cachetest.Counted(func(_ context.Context) (string, error) {
+				return "test", nil
+			})
+
+			cached := Func[string](store, "test", time.Hour, fn, WithClock(clock))
+			got, cacheErr, err := cached(ctx)
+			if got != "test" || err != nil {
+				t.Errorf("Func() = %v, %v, want test", got, err)
+			}
+			if (cacheErr != nil) != tt.wantCacheErr {
+				t.Errorf("Func() cacheErr = %v, wantCacheErr = %v", cacheErr, tt.wantCacheErr)
+			}
+
+			// the value is cached in memory even if the store is unhealthy
+			clock.Advance(time.Minute)
+			got, _, _ = cached(ctx)
+			if got != "test" {
+				t.Errorf("Func() = %v, want test", got)
+			}
+
+			cachetest.AssertCalls(t, counter, tt.wantCalls)
+			cachetest.AssertStoreCalls(t, recorder, cachetest.OpSet, "test", tt.wantSets)
+		})
+	}
+}
+
+func TestFunc_WithCodec(t *testing.T) {
+	ctx := context.Background()
+	store := cachetest.NewStore(nil)
+	fn := Func[time.Time](store, "test", time.Hour, func(_ context.Context) (time.Time, error) {
+		return testStart, nil
+	}, WithCodec[time.Time](persist.MarshalerCodec[time.Time]{}))
+
+	if _, _, err := fn(ctx); err != nil {
+		t.Fatal("Func() error", err)
+	}
+
+	raw, _, _ := store.Get(ctx, "test")
+	want, _ := testStart.MarshalBinary()
+	if string(raw) != string(want) {
+		t.Errorf("Func() stored %v, want %v", raw, want)
+	}
+}
+
+func TestFunc_WithSchema(t *testing.T) {
+	type v1 struct {
+		Name string `json:"name"`
+	}
+	type v2 struct {
+		Name string `json:"full_name"`
+	}
+
+	tests := []struct {
+		name      string
+		opts      []FuncOption
+		want      v2
+		wantCalls int
+	}{
+		{
+			"fingerprint mismatch is recomputed",
+			nil,
+			v2{Name: "computed"},
+			1,
+		},
+		{
+			"same version is reused",
+			[]FuncOption{WithSchema("v1")},
+			v2{},
+			0,
+		},
+		{
+			"migrated",
+			[]FuncOption{WithSchema("v2"), WithMigration(func(_ string, raw []byte) (v2, error) {
+				old := v1{}
+				err := json.Unmarshal(raw, &old)
+				return v2{Name: old.Name}, err
+			})},
+			v2{Name: "cached"},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := persist.NewMemoryStore(persist.Forever, 0)
+
+			// an older deploy cached v1 before the return type changed
+			schema := []FuncOption{}
+			if len(tt.opts) > 0 {
+				schema = append(schema, WithSchema("v1"))
+			}
+			old := Func(store, "test", time.Hour, func(_ context.Context) (v1, error) {
+				return v1{Name: "cached"}, nil
+			}, schema...)
+			_, _, _ = old(ctx)
+
+			calls := 0
+			fn := Func(store, "test", time.Hour, func(_ context.Context) (v2, error) {
+				calls++
+				return v2{Name: "computed"}, nil
+			}, tt.opts...)
+
+			got, _, err := fn(ctx)
+			if err != nil {
+				t.Fatal("Func() error", err)
+			}
+			if got != tt.want {
+				t.Errorf("Func() = %v, want %v", got, tt.want)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Func() called fn %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package cachetest
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+// Counter counts how many times a function wrapped with Counted has been called
+type Counter struct {
+	calls atomic.Int64
+}
+
+// Count returns how many times the function has been called
+func (c *Counter) Count() int {
+	return int(c.calls.Load())
+}
+
+// Counted wraps fn so that every call to it is counted. This can be used to check how often a cached function
+// actually runs the function it wraps
+func Counted[T any](fn func(context.Context) (T, error)) (func(context.Context) (T, error), *Counter) {
+	c := &Counter{}
+	return func(ctx context.Context) (T, error) {
+		c.calls.Add(1)
+		return fn(ctx)
+	}, c
+}
+
+// AssertCalls fails the test if the counted function was not called exactly want times
+func AssertCalls(t testing.TB, c *Counter, want int) {
+	t.Helper()
+	if got := c.Count(); got != want {
+		t.Errorf("function called %d times, want %d", got, want)
+	}
+}
+
+// AssertStoreCalls fails the test if the store did not receive exactly want calls of op for key. An empty key counts
+// calls for every key
+func AssertStoreCalls(t testing.TB, s *RecordingStore, op Op, key string, want int) {
+	t.Helper()
+	if got := s.Count(op, key); got != want {
+		t.Errorf("store %s called %d times for key %q, want %d", op, got, key, want)
+	}
+}
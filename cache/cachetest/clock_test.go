@@ -0,0 +1,24 @@
+package cachetest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("FakeClock.Now() = %v, want %v", got, start)
+	}
+
+	c.Advance(time.Hour)
+	if got := c.Now(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("FakeClock.Now() after Advance() = %v, want %v", got, start.Add(time.Hour))
+	}
+
+	c.Set(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("FakeClock.Now() after Set() = %v, want %v", got, start)
+	}
+}
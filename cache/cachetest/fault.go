@@ -0,0 +1,268 @@
+package cachetest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// ErrInjected is the error returned by a FaultStore when a fault does not specify its own error
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes a failure a FaultStore should inject
+type Fault struct {
+	// Keys limits the fault to calls for these keys, if it's empty the fault applies to every key
+	Keys []string
+
+	// Ops limits the fault to these operations, if it's empty the fault applies to every operation. Calls to
+	// GetEnvelope and SetEnvelope are gets and sets
+	Ops []Op
+
+	// Rate is the probability (0.0 - 1.0) that the fault applies to a matching call, 0 means it always applies
+	Rate float64
+
+	// Delay is how long to wait before the call is made
+	Delay time.Duration
+
+	// Err makes matching calls fail with this error
+	Err error
+
+	// Fail makes matching calls fail with ErrInjected, it's ignored if Err is set
+	Fail bool
+
+	// Corrupt damages entries read by Get and GetEnvelope. The bits of the entry's value are flipped in its marshalled
+	// envelope before the envelope's checksum is verified, so the read fails with persist.ErrCorrupt the same way it
+	// does for an entry damaged in a real store
+	Corrupt bool
+}
+
+// matches reports whether the fault applies to a call
+func (f Fault) matches(op Op, key string) bool {
+	if len(f.Keys) > 0 && !contains(f.Keys, key) {
+		return false
+	}
+	if len(f.Ops) > 0 && !contains(f.Ops, op) {
+		return false
+	}
+
+	return f.Rate <= 0 || rand.Float64() < f.Rate
+}
+
+// err returns the error the fault should fail with, or nil if it should not fail
+func (f Fault) err() error {
+	switch {
+	case f.Err != nil:
+		return f.Err
+	case f.Fail:
+		return ErrInjected
+	default:
+		return nil
+	}
+}
+
+// FaultStore wraps a persist.Store and injects failures, delays and corruption into calls made to it. It can be used
+// to test how code using cachin behaves when its store is unhealthy. Every optional store interface is passed through,
+// calls the underlying store does not support return persist.ErrNotSupported. FaultStore is safe for concurrent use.
+type FaultStore struct {
+	store persist.Store
+
+	mu     sync.Mutex
+	faults []Fault
+}
+
+// NewFaultStore creates a new FaultStore that passes calls on to store, injecting the provided faults
+func NewFaultStore(store persist.Store, faults ...Fault) *FaultStore {
+	return &FaultStore{
+		store:  store,
+		faults: faults,
+	}
+}
+
+// Inject adds a fault to the store
+func (s *FaultStore) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, f)
+}
+
+// Reset removes every fault, so calls pass through to the underlying store untouched
+func (s *FaultStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Get calls Get on the underlying store, applying any matching faults
+func (s *FaultStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	faults, err := s.apply(ctx, OpGet, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	val, lastUpdate, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if corrupts(faults) && (val != nil || !lastUpdate.IsZero()) {
+		return nil, time.Time{}, corrupt(&persist.Envelope{Updated: lastUpdate, Value: val})
+	}
+
+	return val, lastUpdate, nil
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store, applying any matching faults
+func (s *FaultStore) GetEnvelope(ctx context.Context, key string) (*persist.Envelope, error) {
+	faults, err := s.apply(ctx, OpGet, key)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := persist.GetEnvelope(ctx, s.store, key)
+	if err != nil || env == nil {
+		return nil, err
+	}
+	if corrupts(faults) {
+		return nil, corrupt(env)
+	}
+
+	return env, nil
+}
+
+// Set calls Set on the underlying store, applying any matching faults
+func (s *FaultStore) Set(ctx context.Context, key string, val []byte) error {
+	_, err := s.apply(ctx, OpSet, key)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Set(ctx, key, val)
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store, applying any matching faults
+func (s *FaultStore) SetEnvelope(ctx context.Context, key string, env *persist.Envelope) error {
+	_, err := s.apply(ctx, OpSet, key)
+	if err != nil {
+		return err
+	}
+
+	return persist.SetEnvelope(ctx, s.store, key, env)
+}
+
+// Delete calls Delete on the underlying store, applying any matching faults
+func (s *FaultStore) Delete(ctx context.Context, key string) error {
+	_, err := s.apply(ctx, OpDelete, key)
+	if err != nil {
+		return err
+	}
+
+	return persist.DeleteKey(ctx, s.store, key)
+}
+
+// List calls List on the underlying store, applying any matching faults. Faults limited to keys match the prefix
+func (s *FaultStore) List(ctx context.Context, prefix string) ([]string, error) {
+	_, err := s.apply(ctx, OpList, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return persist.ListKeys(ctx, s.store, prefix)
+}
+
+// Touch calls Touch on the underlying store, applying any matching faults
+func (s *FaultStore) Touch(ctx context.Context, key string) error {
+	_, err := s.apply(ctx, OpTouch, key)
+	if err != nil {
+		return err
+	}
+
+	return persist.TouchKey(ctx, s.store, key)
+}
+
+// TryLock calls TryLock on the underlying store, applying any matching faults
+func (s *FaultStore) TryLock(ctx context.Context, key string, ttl time.Duration) (persist.Unlock, error) {
+	_, err := s.apply(ctx, OpLock, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return persist.TryLock(ctx, s.store, key, ttl)
+}
+
+// apply waits out the delays of every fault matching the call and returns the matching faults. If a matching fault
+// should fail the call its error is returned
+func (s *FaultStore) apply(ctx context.Context, op Op, key string) ([]Fault, error) {
+	s.mu.Lock()
+	var matched []Fault
+	for _, f := range s.faults {
+		if f.matches(op, key) {
+			matched = append(matched, f)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, f := range matched {
+		if f.Delay > 0 {
+			timer := time.NewTimer(f.Delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if err := f.err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return matched, nil
+}
+
+// corrupts reports whether any of the faults corrupt entries
+func corrupts(faults []Fault) bool {
+	for _, f := range faults {
+		if f.Corrupt {
+			return true
+		}
+	}
+
+	return false
+}
+
+// corrupt marshals env, flips the bits of its value and unmarshals it again, returning the error the damage causes.
+// The envelope's checksum is flipped instead if it has no value
+func corrupt(env *persist.Envelope) error {
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// the value is followed by the 4 byte checksum
+	start, end := len(raw)-4-len(env.Value), len(raw)-4
+	if start == end {
+		end = len(raw)
+	}
+	for i := start; i < end; i++ {
+		raw[i] = ^raw[i]
+	}
+
+	return new(persist.Envelope).UnmarshalBinary(raw)
+}
+
+// contains reports whether v is in s
+func contains[T comparable](s []T, v T) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+
+	return false
+}
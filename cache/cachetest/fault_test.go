@@ -0,0 +1,239 @@
+package cachetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+func TestFaultStore(t *testing.T) {
+	errCustom := errors.New("custom")
+	tests := []struct {
+		name      string
+		fault     Fault
+		op        Op
+		key       string
+		want      []byte
+		wantErr   error
+		wantDelay time.Duration
+	}{
+		{
+			"fail every call",
+			Fault{Fail: true},
+			OpGet,
+			"test",
+			nil,
+			ErrInjected,
+			0,
+		},
+		{
+			"custom error",
+			Fault{Err: errCustom},
+			OpSet,
+			"test",
+			nil,
+			errCustom,
+			0,
+		},
+		{
+			"other key",
+			Fault{Keys: []string{"other"}, Fail: true},
+			OpGet,
+			"test",
+			[]byte("value"),
+			nil,
+			0,
+		},
+		{
+			"other op",
+			Fault{Ops: []Op{OpSet}, Fail: true},
+			OpGet,
+			"test",
+			[]byte("value"),
+			nil,
+			0,
+		},
+		{
+			"corrupt",
+			Fault{Corrupt: true},
+			OpGet,
+			"test",
+			nil,
+			persist.ErrCorrupt,
+			0,
+		},
+		{
+			"delay",
+			Fault{Delay: time.Millisecond * 20},
+			OpGet,
+			"test",
+			[]byte("value"),
+			nil,
+			time.Millisecond * 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backing := NewStore(nil)
+			_ = backing.Set(ctx, "test", []byte("value"))
+			s := NewFaultStore(backing, tt.fault)
+
+			start := time.Now()
+			var (
+				got []byte
+				err error
+			)
+			switch tt.op {
+			case OpGet:
+				got, _, err = s.Get(ctx, tt.key)
+			case OpSet:
+				err = s.Set(ctx, tt.key, []byte("value"))
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("FaultStore error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.op == OpGet && !bytes.Equal(got, tt.want) {
+				t.Errorf("FaultStore.Get() = %v, want %v", got, tt.want)
+			}
+			if time.Since(start) < tt.wantDelay {
+				t.Errorf("FaultStore took %v, want at least %v", time.Since(start), tt.wantDelay)
+			}
+
+			// corruption must not leak into the underlying store
+			raw, _, _ := backing.Get(ctx, "test")
+			if string(raw) != "value" {
+				t.Errorf("FaultStore modified the underlying store = %s", raw)
+			}
+		})
+	}
+}
+
+func TestFaultStore_Rate(t *testing.T) {
+	s := NewFaultStore(NewStore(nil), Fault{Rate: 0.5, Fail: true})
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, _, err := s.Get(context.Background(), "test"); err != nil {
+			failed++
+		}
+	}
+
+	if failed < 350 || failed > 650 {
+		t.Errorf("FaultStore failed %d of 1000 calls, want about 500", failed)
+	}
+
+	s.Reset()
+	if _, _, err := s.Get(context.Background(), "test"); err != nil {
+		t.Errorf("FaultStore.Get() after Reset() error = %v", err)
+	}
+}
+
+func TestFaultStore_passThrough(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		op   Op
+		call func(s *FaultStore) error
+	}{
+		{
+			"GetEnvelope",
+			OpGet,
+			func(s *FaultStore) error {
+				env, err := s.GetEnvelope(ctx, "test")
+				if err == nil && (env == nil || string(env.Value) != "value") {
+					return errors.New("envelope was not passed through")
+				}
+				return err
+			},
+		},
+		{
+			"SetEnvelope",
+			OpSet,
+			func(s *FaultStore) error {
+				return s.SetEnvelope(ctx, "test", &persist.Envelope{Value: []byte("value")})
+			},
+		},
+		{
+			"Delete",
+			OpDelete,
+			func(s *FaultStore) error {
+				return s.Delete(ctx, "test")
+			},
+		},
+		{
+			"List",
+			OpList,
+			func(s *FaultStore) error {
+				keys, err := s.List(ctx, "test")
+				if err == nil && len(keys) != 1 {
+					return errors.New("keys were not passed through")
+				}
+				return err
+			},
+		},
+		{
+			"Touch",
+			OpTouch,
+			func(s *FaultStore) error {
+				return s.Touch(ctx, "test")
+			},
+		},
+		{
+			"TryLock",
+			OpLock,
+			func(s *FaultStore) error {
+				unlock, err := s.TryLock(ctx, "test", time.Second)
+				if err != nil {
+					return err
+				}
+				return unlock(ctx)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backing := &lockStore{MemoryStore: persist.NewMemoryStore(0, 0)}
+			_ = backing.Set(ctx, "test", []byte("value"))
+
+			// faults for other operations are ignored
+			s := NewFaultStore(backing, Fault{Ops: []Op{"other"}, Fail: true})
+			if err := tt.call(s); err != nil {
+				t.Errorf("FaultStore.%s() error = %v", tt.name, err)
+			}
+
+			s = NewFaultStore(backing, Fault{Ops: []Op{tt.op}, Fail: true})
+			if err := tt.call(s); !errors.Is(err, ErrInjected) {
+				t.Errorf("FaultStore.%s() error = %v, want %v", tt.name, err, ErrInjected)
+			}
+		})
+	}
+}
+
+func TestFaultStore_GetEnvelope_corrupt(t *testing.T) {
+	ctx := context.Background()
+	backing := persist.NewMemoryStore(0, 0)
+	_ = backing.Set(ctx, "test", []byte("value"))
+	_ = backing.Set(ctx, "empty", nil)
+	s := NewFaultStore(backing, Fault{Corrupt: true})
+
+	// the damage is caught by the envelope checksum, even when there's no value to damage
+	for _, key := range []string{"test", "empty"} {
+		if env, err := s.GetEnvelope(ctx, key); !errors.Is(err, persist.ErrCorrupt) || env != nil {
+			t.Errorf("FaultStore.GetEnvelope(%s) = %v, %v, want %v", key, env, err, persist.ErrCorrupt)
+		}
+	}
+	if env, err := s.GetEnvelope(ctx, "missing"); err != nil || env != nil {
+		t.Errorf("FaultStore.GetEnvelope(missing) = %v, %v, want a miss", env, err)
+	}
+
+	// corruption must not leak into the underlying store
+	raw, _, _ := backing.Get(ctx, "test")
+	if string(raw) != "value" {
+		t.Errorf("FaultStore modified the underlying store = %s", raw)
+	}
+}
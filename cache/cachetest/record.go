@@ -0,0 +1,162 @@
+package cachetest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// Op is a store operation captured by a RecordingStore
+type Op string
+
+const (
+	// OpGet is a call to Get
+	OpGet Op = "get"
+
+	// OpSet is a call to Set
+	OpSet Op = "set"
+
+	// OpDelete is a call to Delete
+	OpDelete Op = "delete"
+
+	// OpList is a call to List, the call's key is the prefix
+	OpList Op = "list"
+
+	// OpTouch is a call to Touch
+	OpTouch Op = "touch"
+
+	// OpLock is a call to TryLock
+	OpLock Op = "lock"
+)
+
+// Call is a single call captured by a RecordingStore. For gets, Value is the value that was returned, for sets, it's
+// the value that was written. Calls to GetEnvelope and SetEnvelope are recorded as gets and sets
+type Call struct {
+	Op    Op
+	Key   string
+	Value []byte
+	Err   error
+}
+
+// RecordingStore wraps a persist.Store and records every call made to it. Every optional store interface is passed
+// through, so wrapping a store does not change how it's used, calls the underlying store does not support return
+// persist.ErrNotSupported. RecordingStore is safe for concurrent use.
+type RecordingStore struct {
+	store persist.Store
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewRecordingStore creates a new RecordingStore that passes every call on to store
+func NewRecordingStore(store persist.Store) *RecordingStore {
+	return &RecordingStore{
+		store: store,
+	}
+}
+
+// Get calls Get on the underlying store and records the call
+func (s *RecordingStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	val, lastUpdate, err := s.store.Get(ctx, key)
+	s.record(Call{Op: OpGet, Key: key, Value: clone(val), Err: err})
+	return val, lastUpdate, err
+}
+
+// Set calls Set on the underlying store and records the call
+func (s *RecordingStore) Set(ctx context.Context, key string, val []byte) error {
+	err := s.store.Set(ctx, key, val)
+	s.record(Call{Op: OpSet, Key: key, Value: clone(val), Err: err})
+	return err
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store and records the call as a get
+func (s *RecordingStore) GetEnvelope(ctx context.Context, key string) (*persist.Envelope, error) {
+	env, err := persist.GetEnvelope(ctx, s.store, key)
+	s.record(Call{Op: OpGet, Key: key, Value: clone(envelopeValue(env)), Err: err})
+	return env, err
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store and records the call as a set
+func (s *RecordingStore) SetEnvelope(ctx context.Context, key string, env *persist.Envelope) error {
+	err := persist.SetEnvelope(ctx, s.store, key, env)
+	s.record(Call{Op: OpSet, Key: key, Value: clone(env.Value), Err: err})
+	return err
+}
+
+// Delete calls Delete on the underlying store and records the call
+func (s *RecordingStore) Delete(ctx context.Context, key string) error {
+	err := persist.DeleteKey(ctx, s.store, key)
+	s.record(Call{Op: OpDelete, Key: key, Err: err})
+	return err
+}
+
+// List calls List on the underlying store and records the call
+func (s *RecordingStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := persist.ListKeys(ctx, s.store, prefix)
+	s.record(Call{Op: OpList, Key: prefix, Err: err})
+	return keys, err
+}
+
+// Touch calls Touch on the underlying store and records the call
+func (s *RecordingStore) Touch(ctx context.Context, key string) error {
+	err := persist.TouchKey(ctx, s.store, key)
+	s.record(Call{Op: OpTouch, Key: key, Err: err})
+	return err
+}
+
+// TryLock calls TryLock on the underlying store and records the call
+func (s *RecordingStore) TryLock(ctx context.Context, key string, ttl time.Duration) (persist.Unlock, error) {
+	unlock, err := persist.TryLock(ctx, s.store, key, ttl)
+	s.record(Call{Op: OpLock, Key: key, Err: err})
+	return unlock, err
+}
+
+// Calls returns every recorded call, in the order they were made
+func (s *RecordingStore) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Call{}, s.calls...)
+}
+
+// Count returns how many times op was called for key. An empty key counts calls for every key
+func (s *RecordingStore) Count(op Op, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, c := range s.calls {
+		if c.Op == op && (key == "" || c.Key == key) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Reset clears all recorded calls
+func (s *RecordingStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = nil
+}
+
+// record adds a call to the recording
+func (s *RecordingStore) record(c Call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = append(s.calls, c)
+}
+
+// envelopeValue returns the envelope's value, or nil if the envelope is nil
+func envelopeValue(env *persist.Envelope) []byte {
+	if env == nil {
+		return nil
+	}
+
+	return env.Value
+}
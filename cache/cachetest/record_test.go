@@ -0,0 +1,180 @@
+package cachetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// lockStore is a MemoryStore that implements persist.Locker, it counts the locks that are held
+type lockStore struct {
+	*persist.MemoryStore
+	held int
+}
+
+func (s *lockStore) TryLock(_ context.Context, _ string, _ time.Duration) (persist.Unlock, error) {
+	s.held++
+	return func(context.Context) error {
+		s.held--
+		return nil
+	}, nil
+}
+
+func TestRecordingStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewRecordingStore(NewStore(nil))
+	_, _, _ = s.Get(ctx, "test")
+	_ = s.Set(ctx, "test", []byte("value"))
+	_, _, _ = s.Get(ctx, "test")
+	_ = s.Set(ctx, "other", []byte("other"))
+
+	want := []Call{
+		{Op: OpGet, Key: "test"},
+		{Op: OpSet, Key: "test", Value: []byte("value")},
+		{Op: OpGet, Key: "test", Value: []byte("value")},
+		{Op: OpSet, Key: "other", Value: []byte("other")},
+	}
+	if got := s.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RecordingStore.Calls() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		op   Op
+		key  string
+		want int
+	}{
+		{"gets for key", OpGet, "test", 2},
+		{"sets for key", OpSet, "test", 1},
+		{"sets for every key", OpSet, "", 2},
+		{"missing key", OpGet, "missing", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Count(tt.op, tt.key); got != tt.want {
+				t.Errorf("RecordingStore.Count() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	s.Reset()
+	if got := s.Calls(); len(got) != 0 {
+		t.Errorf("RecordingStore.Calls() after Reset() = %v, want none", got)
+	}
+}
+
+func TestRecordingStore_passThrough(t *testing.T) {
+	ctx := context.Background()
+	backing := &lockStore{MemoryStore: persist.NewMemoryStore(0, 0)}
+	s := NewRecordingStore(backing)
+
+	tests := []struct {
+		name string
+		call func() error
+		want Call
+	}{
+		{
+			"SetEnvelope",
+			func() error {
+				return s.SetEnvelope(ctx, "test", &persist.Envelope{Value: []byte("value"), TTL: time.Hour})
+			},
+			Call{Op: OpSet, Key: "test", Value: []byte("value")},
+		},
+		{
+			"GetEnvelope",
+			func() error {
+				env, err := s.GetEnvelope(ctx, "test")
+				if err == nil && (env == nil || env.TTL != time.Hour) {
+					return errors.New("envelope was not passed through")
+				}
+				return err
+			},
+			Call{Op: OpGet, Key: "test", Value: []byte("value")},
+		},
+		{
+			"Touch",
+			func() error {
+				return s.Touch(ctx, "test")
+			},
+			Call{Op: OpTouch, Key: "test"},
+		},
+		{
+			"List",
+			func() error {
+				keys, err := s.List(ctx, "te")
+				if err == nil && !reflect.DeepEqual(keys, []string{"test"}) {
+					return errors.New("keys were not passed through")
+				}
+				return err
+			},
+			Call{Op: OpList, Key: "te"},
+		},
+		{
+			"TryLock",
+			func() error {
+				unlock, err := s.TryLock(ctx, "test", time.Second)
+				if err != nil {
+					return err
+				}
+				if backing.held != 1 {
+					return errors.New("lock was not passed through")
+				}
+				return unlock(ctx)
+			},
+			Call{Op: OpLock, Key: "test"},
+		},
+		{
+			"Delete",
+			func() error {
+				err := s.Delete(ctx, "test")
+				if raw, _, _ := backing.Get(ctx, "test"); raw != nil {
+					return errors.New("delete was not passed through")
+				}
+				return err
+			},
+			Call{Op: OpDelete, Key: "test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Reset()
+			if err := tt.call(); err != nil {
+				t.Fatalf("RecordingStore.%s() error = %v", tt.name, err)
+			}
+			if got := s.Calls(); !reflect.DeepEqual(got, []Call{tt.want}) {
+				t.Errorf("RecordingStore.Calls() = %v, want %v", got, []Call{tt.want})
+			}
+		})
+	}
+}
+
+func TestRecordingStore_notSupported(t *testing.T) {
+	ctx := context.Background()
+	s := NewRecordingStore(NewStore(nil))
+	_, err := s.TryLock(ctx, "test", time.Second)
+	if !errors.Is(err, persist.ErrNotSupported) {
+		t.Errorf("RecordingStore.TryLock() error = %v, want %v", err, persist.ErrNotSupported)
+	}
+
+	// envelopes fall back to Get and Set
+	if err := s.SetEnvelope(ctx, "test", &persist.Envelope{Value: []byte("value")}); err != nil {
+		t.Fatal("RecordingStore.SetEnvelope() error", err)
+	}
+	env, err := s.GetEnvelope(ctx, "test")
+	if err != nil || env == nil || string(env.Value) != "value" {
+		t.Errorf("RecordingStore.GetEnvelope() = %v, %v, want value", env, err)
+	}
+
+	want := []Call{
+		{Op: OpLock, Key: "test", Err: persist.ErrNotSupported},
+		{Op: OpSet, Key: "test", Value: []byte("value")},
+		{Op: OpGet, Key: "test", Value: []byte("value")},
+	}
+	if got := s.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RecordingStore.Calls() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+package cachetest
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// Store is an in-memory persist.Store for tests. Timestamps come from its clock, or can be set directly with SetAt
+// to simulate entries written in the past. Store is safe for concurrent use.
+type Store struct {
+	clock persist.Clock
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// entry is a single value held by a Store
+type entry struct {
+	val     []byte
+	lastSet time.Time
+}
+
+// NewStore creates a new, empty Store. If clock is nil the persist.SystemClock is used
+func NewStore(clock persist.Clock) *Store {
+	if clock == nil {
+		clock = persist.SystemClock{}
+	}
+
+	return &Store{
+		clock:   clock,
+		entries: map[string]entry{},
+	}
+}
+
+// Get returns the value and last set time of the key. If the key does not exist no error will be returned
+func (s *Store) Get(_ context.Context, key string) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, time.Time{}, nil
+	}
+
+	return clone(e.val), e.lastSet, nil
+}
+
+// Set stores the value using the current time of the stores clock
+func (s *Store) Set(_ context.Context, key string, val []byte) error {
+	s.SetAt(key, val, s.clock.Now())
+	return nil
+}
+
+// SetAt stores the value as if it was set at the provided time
+func (s *Store) SetAt(key string, val []byte, lastSet time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = entry{val: clone(val), lastSet: lastSet}
+}
+
+// Delete removes the key from the store
+func (s *Store) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// Touch updates the last set time of the key without changing its value
+func (s *Store) Touch(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e.lastSet = s.clock.Now()
+	s.entries[key] = e
+	return nil
+}
+
+// List returns every key in the store that starts with prefix, sorted
+func (s *Store) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Len returns the number of keys in the store
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
+
+// clone copies b so callers can't modify the stores values
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,34 @@
+package cachetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+	"github.com/weave-lab/cachin/persist/persisttest"
+)
+
+func TestStore(t *testing.T) {
+	persisttest.RunStoreTests(t, func(t *testing.T) persist.Store {
+		return NewStore(nil)
+	})
+}
+
+func TestStore_SetAt(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC))
+	s := NewStore(clock)
+	past := clock.Now().Add(-time.Hour)
+	s.SetAt("test", []byte("value"), past)
+
+	_, lastUpdate, err := s.Get(context.Background(), "test")
+	if err != nil || !lastUpdate.Equal(past) {
+		t.Errorf("Store.Get() lastUpdate = %v, %v, want %v", lastUpdate, err, past)
+	}
+
+	_ = s.Touch(context.Background(), "test")
+	_, lastUpdate, _ = s.Get(context.Background(), "test")
+	if !lastUpdate.Equal(clock.Now()) {
+		t.Errorf("Store.Get() after Touch() lastUpdate = %v, want %v", lastUpdate, clock.Now())
+	}
+}
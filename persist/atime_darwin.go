@@ -0,0 +1,20 @@
+package persist
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime returns when the file was last accessed, if it's unavailable the modification time is returned
+func accessTime(info fs.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+
+	return time.Unix(stat.Atimespec.Unix())
+}
+
+// noAtimeFlag is 0 since files can't be opened without updating their access time on this platform
+const noAtimeFlag = 0
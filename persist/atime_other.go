@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package persist
+
+import (
+	"io/fs"
+	"time"
+)
+
+// accessTime returns the modification time, access times are not read on this platform
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// noAtimeFlag is 0 since files can't be opened without updating their access time on this platform
+const noAtimeFlag = 0
@@ -0,0 +1,290 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store that keeps cache data in a bbolt database, an embedded key value store that needs no external
+// service. Every write is a durable transaction, so unlike an FsStore a crash never leaves a partially written value
+// behind. Each BoltStore has its own bucket, which holds a values bucket with the store's values and a namespaces
+// bucket with the bucket of each namespace created with Namespace, so keys and namespaces never collide. Values whose
+// Envelope TTL has passed are treated as missing until they are removed with Sweep. BoltStore is safe for concurrent
+// use.
+type BoltStore struct {
+	db     *bolt.DB
+	bucket []string
+	clock  Clock
+}
+
+const (
+	// boltValuesBucket is the bucket, inside a BoltStore's bucket, that holds its values
+	boltValuesBucket = "values"
+
+	// boltNamespacesBucket is the bucket, inside a BoltStore's bucket, that holds the bucket of each of its namespaces
+	boltNamespacesBucket = "ns"
+)
+
+// NewBoltStore creates a new BoltStore that keeps its values in the named bucket of db. The bucket is created the
+// first time a value is written. The caller owns db and must close it once the store is no longer used
+func NewBoltStore(db *bolt.DB, bucket string, opts ...StoreOption) *BoltStore {
+	o := storeOptionsFrom(opts)
+	return &BoltStore{
+		db:     db,
+		bucket: []string{bucket},
+		clock:  o.clock,
+	}
+}
+
+// Namespace returns a BoltStore that shares the stores database but keeps its values in a bucket nested inside the
+// stores namespaces bucket. Keys in different namespaces never collide, a namespace never collides with a key of the
+// same name, and List on a store does not return the keys of its namespaces
+func (s *BoltStore) Namespace(name string) *BoltStore {
+	return &BoltStore{
+		db:     s.db,
+		bucket: append(append([]string{}, s.bucket...), name),
+		clock:  s.clock,
+	}
+}
+
+// Get returns the value of the key. If the key is missing or expired no error will be returned
+func (s *BoltStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope returns the envelope of the key. If the key is missing or expired no error will be returned
+func (s *BoltStore) GetEnvelope(_ context.Context, key string) (*Envelope, error) {
+	var env *Envelope
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.readBucket(tx)
+		if b == nil {
+			return nil
+		}
+
+		var err error
+		env, err = s.read(b, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// Set stores the value in a new transaction
+func (s *BoltStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and stores it in a new transaction
+func (s *BoltStore) SetEnvelope(_ context.Context, key string, env *Envelope) error {
+	env = env.clone()
+	env.stamp(s.clock.Now())
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.writeBucket(tx)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), raw)
+	})
+}
+
+// Delete removes the key from the store. If the key is missing no error will be returned
+func (s *BoltStore) Delete(_ context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.readBucket(tx)
+		if b == nil || b.Get([]byte(key)) == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// Touch sets the last update time of the key to now. If the key is missing or expired no error will be returned
+func (s *BoltStore) Touch(_ context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := s.readBucket(tx)
+		if b == nil {
+			return nil
+		}
+
+		env, err := s.read(b, key)
+		if err != nil || env == nil {
+			return err
+		}
+
+		env.Updated = s.clock.Now()
+		raw, err := env.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), raw)
+	})
+}
+
+// List returns the sorted keys of every value in the stores bucket that starts with the provided prefix and has not
+// expired
+func (s *BoltStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.readBucket(tx)
+		if b == nil {
+			return nil
+		}
+
+		now := s.clock.Now()
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			if v == nil {
+				// buckets are not values, the values bucket only holds them if another application created one
+				continue
+			}
+
+			env, _, err := unmarshalEnvelopeHeader(v)
+			if err == nil && env.expired(now) {
+				continue
+			}
+			keys = append(keys, string(k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Sweep removes every expired value from the stores bucket in a single transaction and returns how many were removed.
+// Values in nested namespaces are not swept. Expired values are never returned by the store, but they still take up
+// space in the database until they are swept
+func (s *BoltStore) Sweep(ctx context.Context) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.readBucket(tx)
+		if b == nil {
+			return nil
+		}
+
+		now := s.clock.Now()
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if v == nil {
+				// buckets are not values, the values bucket only holds them if another application created one
+				return nil
+			}
+
+			env, _, err := unmarshalEnvelopeHeader(v)
+			if err == nil && env.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// keys can't be deleted while iterating over the bucket
+		for _, k := range expired {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// read reads the key's envelope from the bucket. Values that are not envelopes are returned as is with no timestamps
+func (s *BoltStore) read(b *bolt.Bucket, key string) (*Envelope, error) {
+	raw := b.Get([]byte(key))
+	if raw == nil {
+		return nil, nil
+	}
+
+	env := &Envelope{}
+	err := env.UnmarshalBinary(raw)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotEnvelope):
+		return &Envelope{Value: append([]byte{}, raw...)}, nil
+	default:
+		return nil, fmt.Errorf("%w | key %q", err, key)
+	}
+	if env.expired(s.clock.Now()) {
+		return nil, nil
+	}
+
+	return env, nil
+}
+
+// path returns the names of the buckets leading to the stores values bucket
+func (s *BoltStore) path() [][]byte {
+	path := [][]byte{[]byte(s.bucket[0])}
+	for _, name := range s.bucket[1:] {
+		path = append(path, []byte(boltNamespacesBucket), []byte(name))
+	}
+
+	return append(path, []byte(boltValuesBucket))
+}
+
+// readBucket returns the stores values bucket, or nil if it has not been created yet
+func (s *BoltStore) readBucket(tx *bolt.Tx) *bolt.Bucket {
+	path := s.path()
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(name)
+	}
+
+	return b
+}
+
+// writeBucket returns the stores values bucket, creating it and its parents if they do not exist
+func (s *BoltStore) writeBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	path := s.path()
+	b, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w | bucket %s", err, strings.Join(s.bucket, "/"))
+	}
+
+	return b, nil
+}
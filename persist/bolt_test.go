@@ -0,0 +1,232 @@
+package persist
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestBoltDB opens a bbolt database that is closed when the test ends
+func openTestBoltDB(t *testing.T, path string) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal("failed to open bolt db", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db
+}
+
+func TestBoltStore_Namespace(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltStore(openTestBoltDB(t, filepath.Join(t.TempDir(), "cache.db")), "cache")
+	one := s.Namespace("one")
+	nested := one.Namespace("nested")
+
+	for _, store := range []*BoltStore{s, one, nested} {
+		if err := store.Set(ctx, "test_key", []byte(store.bucket[len(store.bucket)-1])); err != nil {
+			t.Fatalf("BoltStore.Set() %v error = %v", store.bucket, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		store *BoltStore
+		want  string
+	}{
+		{
+			"root",
+			s,
+			"cache",
+		},
+		{
+			"namespace",
+			one,
+			"one",
+		},
+		{
+			"nested namespace",
+			nested,
+			"nested",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := tt.store.Get(ctx, "test_key")
+			if err != nil || string(got) != tt.want {
+				t.Errorf("BoltStore.Get() = %s, %v, want %s", got, err, tt.want)
+			}
+
+			// the buckets of nested namespaces are not keys
+			keys, err := tt.store.List(ctx, "")
+			if err != nil || !reflect.DeepEqual(keys, []string{"test_key"}) {
+				t.Errorf("BoltStore.List() = %v, %v, want [test_key]", keys, err)
+			}
+		})
+	}
+
+	if got, _, err := s.Namespace("missing").Get(ctx, "test_key"); err != nil || got != nil {
+		t.Errorf("BoltStore.Get() missing namespace = %s, %v, want nil", got, err)
+	}
+	if err := s.Namespace("missing").Delete(ctx, "test_key"); err != nil {
+		t.Errorf("BoltStore.Delete() missing namespace error = %v", err)
+	}
+}
+
+func TestBoltStore_Namespace_collision(t *testing.T) {
+	ctx := context.Background()
+	s := NewBoltStore(openTestBoltDB(t, filepath.Join(t.TempDir(), "cache.db")), "cache")
+
+	// a key and a namespace with the same name can be used in either order
+	if err := s.Set(ctx, "x", []byte(`key`)); err != nil {
+		t.Fatal("BoltStore.Set() error", err)
+	}
+	if err := s.Namespace("x").Set(ctx, "x", []byte(`namespace`)); err != nil {
+		t.Fatal("BoltStore.Set() namespace error", err)
+	}
+	if err := s.Namespace("y").Set(ctx, "y", []byte(`namespace`)); err != nil {
+		t.Fatal("BoltStore.Set() namespace error", err)
+	}
+	if err := s.Set(ctx, "y", []byte(`key`)); err != nil {
+		t.Fatal("BoltStore.Set() error", err)
+	}
+
+	tests := []struct {
+		name  string
+		store *BoltStore
+		key   string
+		want  string
+	}{
+		{
+			"key set before the namespace",
+			s,
+			"x",
+			"key",
+		},
+		{
+			"namespace created after the key",
+			s.Namespace("x"),
+			"x",
+			"namespace",
+		},
+		{
+			"namespace created before the key",
+			s.Namespace("y"),
+			"y",
+			"namespace",
+		},
+		{
+			"key set after the namespace",
+			s,
+			"y",
+			"key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := tt.store.Get(ctx, tt.key)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("BoltStore.Get() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+
+	keys, err := s.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"x", "y"}) {
+		t.Errorf("BoltStore.List() = %v, %v, want [x y]", keys, err)
+	}
+}
+
+func TestBoltStore_Sweep(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := NewBoltStore(openTestBoltDB(t, filepath.Join(t.TempDir(), "cache.db")), "cache", WithClock(clock))
+
+	envs := map[string]*Envelope{
+		"forever": {Value: []byte(`forever`)},
+		"short":   {Value: []byte(`short`), TTL: time.Minute},
+		"long":    {Value: []byte(`long`), TTL: time.Hour},
+	}
+	for key, env := range envs {
+		if err := s.SetEnvelope(ctx, key, env); err != nil {
+			t.Fatal("BoltStore.SetEnvelope() error", err)
+		}
+	}
+	if err := s.Namespace("ns").SetEnvelope(ctx, "short", envs["short"]); err != nil {
+		t.Fatal("BoltStore.SetEnvelope() error", err)
+	}
+	clock.Advance(time.Minute * 2)
+
+	// expired values are hidden before they are swept
+	if got, _, err := s.Get(ctx, "short"); err != nil || got != nil {
+		t.Errorf("BoltStore.Get() expired = %s, %v, want nil", got, err)
+	}
+	if err := s.Touch(ctx, "short"); err != nil {
+		t.Errorf("BoltStore.Touch() expired error = %v", err)
+	}
+
+	removed, err := s.Sweep(ctx)
+	if err != nil || removed != 1 {
+		t.Errorf("BoltStore.Sweep() = %d, %v, want 1", removed, err)
+	}
+
+	keys, err := s.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"forever", "long"}) {
+		t.Errorf("BoltStore.List() after Sweep() = %v, %v, want [forever long]", keys, err)
+	}
+
+	// namespaces are swept separately
+	removed, err = s.Namespace("ns").Sweep(ctx)
+	if err != nil || removed != 1 {
+		t.Errorf("BoltStore.Sweep() namespace = %d, %v, want 1", removed, err)
+	}
+}
+
+func TestBoltStore_reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db := openTestBoltDB(t, path)
+	if err := NewBoltStore(db, "cache").Set(ctx, "test_key", []byte(`test`)); err != nil {
+		t.Fatal("BoltStore.Set() error", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("failed to close bolt db", err)
+	}
+
+	s := NewBoltStore(openTestBoltDB(t, path), "cache")
+	got, ts, err := s.Get(ctx, "test_key")
+	if err != nil || string(got) != "test" || ts.IsZero() {
+		t.Errorf("BoltStore.Get() after reopen = %s, %v, %v", got, ts, err)
+	}
+}
+
+func TestBoltStore_rawValue(t *testing.T) {
+	ctx := context.Background()
+	db := openTestBoltDB(t, filepath.Join(t.TempDir(), "cache.db"))
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("cache"))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(boltValuesBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("test_key"), []byte(`raw`))
+	})
+	if err != nil {
+		t.Fatal("failed to write raw value", err)
+	}
+
+	got, ts, err := NewBoltStore(db, "cache").Get(ctx, "test_key")
+	if err != nil || string(got) != "raw" || !ts.IsZero() {
+		t.Errorf("BoltStore.Get() raw value = %s, %v, %v, want raw", got, ts, err)
+	}
+}
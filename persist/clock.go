@@ -0,0 +1,109 @@
+package persist
+
+import "time"
+
+// Clock tells Data and the stores in this package what time it is. It can be replaced with a fake clock to make
+// code that depends on TTLs deterministic in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock that uses the system time
+type SystemClock struct{}
+
+// Now returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Option configures optional behavior of Data. Each store has its own option type, so an option can only be passed
+// to what it configures
+type Option interface {
+	applyData(*options)
+}
+
+// optionFunc is an Option that sets a field of options
+type optionFunc func(*options)
+
+func (f optionFunc) applyData(opts *options) {
+	f(opts)
+}
+
+// ClockOption sets the clock used to timestamp and expire data. Data and every store that keeps timestamps accept it
+type ClockOption struct {
+	clock Clock
+}
+
+// WithClock sets the clock used to timestamp and expire data, if it's not provided the SystemClock is used
+func WithClock(clock Clock) ClockOption {
+	return ClockOption{clock: clock}
+}
+
+func (o ClockOption) applyData(opts *options) {
+	opts.clock = o.clock
+}
+
+func (o ClockOption) applyStore(opts *storeOptions) {
+	opts.clock = o.clock
+}
+
+// WithCodec sets the codec Data uses to serialize its value, if it's not provided the DefaultCodec is used. The
+// codec's type must match the type of the Data it's passed to, otherwise NewData will panic
+func WithCodec[T any](codec Codec[T]) Option {
+	return optionFunc(func(opts *options) {
+		opts.codec = codec
+	})
+}
+
+// WithTTL sets how long Data's value is meant to be cached for. It's recorded in the Envelope of each value Data
+// stores so the store, or tools that clean it up, can tell when the value is no longer useful
+func WithTTL(ttl time.Duration) Option {
+	return optionFunc(func(opts *options) {
+		opts.ttl = ttl
+	})
+}
+
+// options holds the configuration of Data set by each Option
+type options struct {
+	clock Clock
+
+	// codec is a Codec[T], it's stored as any since options are not generic
+	codec any
+
+	ttl time.Duration
+
+	schema string
+
+	// migration is a func(string, []byte) (T, error), it's stored as any since options are not generic
+	migration any
+}
+
+// optionsFrom applies each option on top of the defaults
+func optionsFrom(opts []Option) options {
+	o := options{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt.applyData(&o)
+	}
+
+	return o
+}
+
+// StoreOption configures a store that has no options of its own other than its clock, such as a MemoryStore
+type StoreOption interface {
+	applyStore(*storeOptions)
+}
+
+// storeOptions holds the configuration set by each StoreOption
+type storeOptions struct {
+	clock Clock
+}
+
+// storeOptionsFrom applies each option on top of the defaults
+func storeOptionsFrom(opts []StoreOption) storeOptions {
+	o := storeOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt.applyStore(&o)
+	}
+
+	return o
+}
@@ -0,0 +1,368 @@
+package persist
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Codec converts values to and from the bytes kept in a Store. A Codec can be passed to NewData with WithCodec to
+// control how a Data value is serialized. Decode must leave v unchanged if it fails.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte, v *T) error
+}
+
+// IdentifiedCodec is an optional interface a Codec can implement to identify the format it writes. Data records the
+// ID in the Envelope of each value it stores, and values written by a codec with a different ID are treated as a miss
+// rather than being decoded
+type IdentifiedCodec interface {
+	CodecID() string
+}
+
+// codecID returns the ID of the codec if it implements IdentifiedCodec, otherwise an empty string is returned
+func codecID(codec any) string {
+	if c, ok := codec.(IdentifiedCodec); ok {
+		return c.CodecID()
+	}
+
+	return ""
+}
+
+// TypeCodec is a codec that is not tied to a single type. TypeCodecs can be registered with RegisterCodec so the
+// DefaultCodec uses them for every type they match. Decode is passed a pointer to the value being decoded.
+type TypeCodec interface {
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+// registeredCodec is a TypeCodec along with the types it should be used for
+type registeredCodec struct {
+	match func(reflect.Type) bool
+	codec TypeCodec
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []registeredCodec
+)
+
+// RegisterCodec makes the DefaultCodec use codec for any type that match reports true for. Codecs are usually
+// registered in the init function of the package that provides them, so importing the package is enough to enable
+// them. If multiple registered codecs match a type, the first one registered is used. If codec implements
+// IdentifiedCodec its ID is included in the DefaultCodec's ID for the types it matches, so values written before it
+// was registered are treated as a miss instead of being decoded with it.
+func RegisterCodec(match func(reflect.Type) bool, codec TypeCodec) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry = append(registry, registeredCodec{match: match, codec: codec})
+}
+
+// registeredCodecFor returns the first registered codec that matches t
+func registeredCodecFor(t reflect.Type) (TypeCodec, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, r := range registry {
+		if r.match(t) {
+			return r.codec, true
+		}
+	}
+
+	return nil, false
+}
+
+// DefaultCodec returns the codec Data uses if no codec is provided. If the value implements Serializable, with either
+// a value or pointer receiver, that will be used. Otherwise, if a codec registered with RegisterCodec matches the
+// type it will be used. If neither apply, the value is JSON marshalled
+func DefaultCodec[T any]() Codec[T] {
+	return defaultCodec[T]{}
+}
+
+// defaultCodec is the Codec returned by DefaultCodec
+type defaultCodec[T any] struct{}
+
+// CodecID identifies the default codec. When a registered codec is used for T, its ID is appended to the default
+// codec's ID, e.g. "default+proto"
+func (defaultCodec[T]) CodecID() string {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Implements(serializableInterface) || reflect.PointerTo(t).Implements(serializableInterface) {
+		return "default"
+	}
+	if c, ok := registeredCodecFor(t); ok {
+		if id := codecID(c); id != "" {
+			return "default+" + id
+		}
+	}
+
+	return "default"
+}
+
+// Encode serializes v using Serializable if it's implemented, otherwise v is JSON marshalled. Nil pointers are
+// always JSON marshalled, so they are stored as null rather than causing a panic
+func (defaultCodec[T]) Encode(v T) ([]byte, error) {
+	if !isNil(v) {
+		if s, ok := any(v).(Serializable); ok {
+			return s.Bytes()
+		}
+	}
+	if s, ok := any(&v).(Serializable); ok {
+		return s.Bytes()
+	}
+	if c, ok := registeredCodecFor(reflect.TypeOf(&v).Elem()); ok {
+		return c.Encode(v)
+	}
+
+	return json.Marshal(v)
+}
+
+// Decode deserializes data using Serializable if it's implemented, otherwise data is JSON unmarshalled. Serializable
+// values are decoded into a newly allocated value, so v is only updated if decoding succeeds
+func (defaultCodec[T]) Decode(data []byte, v *T) error {
+	if !isNil(*v) {
+		if s, ok := any(*v).(Serializable); ok {
+			rv := reflect.ValueOf(s)
+			if rv.Kind() != reflect.Pointer {
+				// a value receiver can't modify the value it was called on, so there's nothing to allocate
+				return s.FromBytes(data)
+			}
+
+			// v may hold an interface, so the value is allocated with the type it currently holds
+			ptr := reflect.New(rv.Type().Elem())
+			err := ptr.Interface().(Serializable).FromBytes(data)
+			if err != nil {
+				return err
+			}
+
+			*v = ptr.Interface().(T)
+			return nil
+		}
+	}
+	if _, ok := any(v).(Serializable); ok {
+		return decodeSerializable(data, v)
+	}
+
+	// T is a pointer to a Serializable type, but the pointer is nil so a value needs to be allocated
+	t := reflect.TypeOf(v).Elem()
+	if t.Kind() == reflect.Pointer && t.Implements(serializableInterface) {
+		// nil pointers are encoded as JSON null, so they need to be decoded the same way
+		if bytes.Equal(data, []byte("null")) {
+			*v = *new(T)
+			return nil
+		}
+
+		ptr := reflect.New(t.Elem())
+		err := ptr.Interface().(Serializable).FromBytes(data)
+		if err != nil {
+			return err
+		}
+
+		*v = ptr.Interface().(T)
+		return nil
+	}
+
+	if c, ok := registeredCodecFor(t); ok {
+		var tmp T
+		err := c.Decode(data, &tmp)
+		if err != nil {
+			return err
+		}
+
+		*v = tmp
+		return nil
+	}
+
+	return JSONCodec[T]{}.Decode(data, v)
+}
+
+// serializableInterface is the reflected type of the Serializable interface
+var serializableInterface = reflect.TypeOf((*Serializable)(nil)).Elem()
+
+// isNil reports whether v is a nil pointer, map, slice, func, chan or interface
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return false
+	}
+}
+
+// decodeSerializable decodes data into a copy of v using its pointer receiver FromBytes method, v is only updated if
+// decoding succeeds
+func decodeSerializable[T any](data []byte, v *T) error {
+	var tmp T
+	err := any(&tmp).(Serializable).FromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
+
+// JSONCodec is a Codec that JSON marshals values
+type JSONCodec[T any] struct{}
+
+// CodecID identifies the JSON codec
+func (JSONCodec[T]) CodecID() string {
+	return "json"
+}
+
+// Encode JSON marshals v
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode JSON unmarshals data into a new value and stores it in v
+func (JSONCodec[T]) Decode(data []byte, v *T) error {
+	var tmp T
+	err := json.Unmarshal(data, &tmp)
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
+
+// GobCodec is a Codec that uses encoding/gob. Gob is more compact than JSON and supports more of Go's type system,
+// but it can only be read by Go programs
+type GobCodec[T any] struct{}
+
+// CodecID identifies the gob codec
+func (GobCodec[T]) CodecID() string {
+	return "gob"
+}
+
+// Encode gob encodes v
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode gob decodes data into a new value and stores it in v
+func (GobCodec[T]) Decode(data []byte, v *T) error {
+	var tmp T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tmp)
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
+
+// MarshalerCodec is a Codec for types that implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, or
+// encoding.TextMarshaler and encoding.TextUnmarshaler. The binary interfaces are preferred if a type implements both.
+// Marshal methods may use value or pointer receivers, unmarshal methods must use pointer receivers.
+type MarshalerCodec[T any] struct{}
+
+// CodecID identifies the marshaler codec
+func (MarshalerCodec[T]) CodecID() string {
+	return "marshaler"
+}
+
+// Encode marshals v using its MarshalBinary or MarshalText method
+func (MarshalerCodec[T]) Encode(v T) ([]byte, error) {
+	switch m := any(&v).(type) {
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	case encoding.TextMarshaler:
+		return m.MarshalText()
+	}
+
+	if isNil(v) {
+		return nil, fmt.Errorf("can not marshal nil %T", v)
+	}
+
+	switch m := any(v).(type) {
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	case encoding.TextMarshaler:
+		return m.MarshalText()
+	}
+
+	return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler or encoding.TextMarshaler", v)
+}
+
+// Decode unmarshals data into a new value using its UnmarshalBinary or UnmarshalText method and stores it in v
+func (MarshalerCodec[T]) Decode(data []byte, v *T) error {
+	var tmp T
+
+	// if T is a pointer type the unmarshal methods are on T itself, and a value needs to be allocated for it
+	target := any(&tmp)
+	if t := reflect.TypeOf(tmp); t != nil && t.Kind() == reflect.Pointer {
+		ptr := reflect.New(t.Elem())
+		reflect.ValueOf(&tmp).Elem().Set(ptr)
+		target = ptr.Interface()
+	}
+
+	var err error
+	switch u := target.(type) {
+	case encoding.BinaryUnmarshaler:
+		err = u.UnmarshalBinary(data)
+	case encoding.TextUnmarshaler:
+		err = u.UnmarshalText(data)
+	default:
+		return fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler or encoding.TextUnmarshaler", tmp)
+	}
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
+
+// NewSerializableCodec creates a SerializableCodec, the pointer type is inferred so only T needs to be provided
+func NewSerializableCodec[T any, PT interface {
+	*T
+	Serializable
+}]() SerializableCodec[T, PT] {
+	return SerializableCodec[T, PT]{}
+}
+
+// SerializableCodec is a Codec for types whose Serializable methods use pointer receivers, PT must be *T. It allows
+// non-pointer types to be used with Data without JSON marshalling them
+type SerializableCodec[T any, PT interface {
+	*T
+	Serializable
+}] struct{}
+
+// CodecID identifies the Serializable codec
+func (SerializableCodec[T, PT]) CodecID() string {
+	return "serializable"
+}
+
+// Encode serializes v using its Bytes method
+func (SerializableCodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).Bytes()
+}
+
+// Decode deserializes data into a new value using its FromBytes method and stores it in v
+func (SerializableCodec[T, PT]) Decode(data []byte, v *T) error {
+	var tmp T
+	err := PT(&tmp).FromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
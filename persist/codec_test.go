@@ -0,0 +1,186 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecStruct struct {
+	Name  string
+	Count int
+}
+
+func testCodec[T any](t *testing.T, codec Codec[T], v T, wantBytes []byte) {
+	t.Helper()
+	got, err := codec.Encode(v)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if wantBytes != nil && !reflect.DeepEqual(got, wantBytes) {
+		t.Errorf("Encode() = %s, want %s", got, wantBytes)
+	}
+
+	var decoded T
+	if err := codec.Decode(got, &decoded); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Errorf("Decode() = %v, want %v", decoded, v)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	s := serializableType(255)
+	ts := time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)
+	t.Run("default json", func(t *testing.T) {
+		testCodec[codecStruct](t, DefaultCodec[codecStruct](), codecStruct{Name: "test", Count: 2}, []byte(`{"Name":"test","Count":2}`))
+	})
+	t.Run("default pointer receiver serializable", func(t *testing.T) {
+		testCodec[serializableType](t, DefaultCodec[serializableType](), s, []byte("FF"))
+	})
+	t.Run("default serializable pointer", func(t *testing.T) {
+		testCodec[*serializableType](t, DefaultCodec[*serializableType](), &s, []byte("FF"))
+	})
+	t.Run("default nil pointer", func(t *testing.T) {
+		testCodec[*serializableType](t, DefaultCodec[*serializableType](), nil, []byte("null"))
+	})
+	t.Run("json", func(t *testing.T) {
+		testCodec[codecStruct](t, JSONCodec[codecStruct]{}, codecStruct{Name: "test"}, []byte(`{"Name":"test","Count":0}`))
+	})
+	t.Run("gob", func(t *testing.T) {
+		testCodec[codecStruct](t, GobCodec[codecStruct]{}, codecStruct{Name: "test", Count: 2}, nil)
+	})
+	t.Run("binary marshaler", func(t *testing.T) {
+		testCodec[time.Time](t, MarshalerCodec[time.Time]{}, ts, nil)
+	})
+	t.Run("binary marshaler pointer", func(t *testing.T) {
+		testCodec[*time.Time](t, MarshalerCodec[*time.Time]{}, &ts, nil)
+	})
+	t.Run("serializable", func(t *testing.T) {
+		testCodec[serializableType](t, NewSerializableCodec[serializableType](), s, []byte("FF"))
+	})
+}
+
+func TestCodecs_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{
+			"json decode",
+			func() error {
+				var v codecStruct
+				return JSONCodec[codecStruct]{}.Decode([]byte("{"), &v)
+			},
+		},
+		{
+			"marshaler not implemented",
+			func() error {
+				_, err := MarshalerCodec[codecStruct]{}.Encode(codecStruct{})
+				return err
+			},
+		},
+		{
+			"marshaler nil",
+			func() error {
+				_, err := MarshalerCodec[*time.Time]{}.Encode(nil)
+				return err
+			},
+		},
+		{
+			"serializable decode",
+			func() error {
+				var v serializableType
+				return NewSerializableCodec[serializableType]().Decode([]byte("not hex"), &v)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// partialSerializable sets its fields one at a time as it decodes, so a failure leaves it half decoded
+type partialSerializable struct {
+	First  string
+	Second string
+}
+
+func (s *partialSerializable) Bytes() ([]byte, error) {
+	return []byte(s.First + "," + s.Second), nil
+}
+
+func (s *partialSerializable) FromBytes(b []byte) error {
+	first, second, _ := strings.Cut(string(b), ",")
+	s.First = first
+	if second == "" {
+		return errors.New("missing second field")
+	}
+	s.Second = second
+	return nil
+}
+
+func TestDefaultCodec_Decode_partial(t *testing.T) {
+	codec := DefaultCodec[*partialSerializable]()
+	old := &partialSerializable{First: "old", Second: "old"}
+
+	v := old
+	if err := codec.Decode([]byte("new"), &v); err == nil {
+		t.Fatal("Decode() expected an error")
+	}
+	if v != old || *old != (partialSerializable{First: "old", Second: "old"}) {
+		t.Errorf("Decode() failure modified the value = %+v, want it unchanged", *v)
+	}
+
+	if err := codec.Decode([]byte("new,new"), &v); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if *v != (partialSerializable{First: "new", Second: "new"}) || *old != (partialSerializable{First: "old", Second: "old"}) {
+		t.Errorf("Decode() = %+v, old = %+v, want a new value", *v, *old)
+	}
+}
+
+func TestNewData_WithCodec(t *testing.T) {
+	store := NewMemoryStore(Forever, 0)
+	d := NewData[codecStruct](store, "test", WithCodec[codecStruct](GobCodec[codecStruct]{}))
+	if err := d.Set(context.Background(), codecStruct{Name: "test"}); err != nil {
+		t.Fatal("Set() error", err)
+	}
+
+	loaded := NewData[codecStruct](store, "test", WithCodec[codecStruct](GobCodec[codecStruct]{}))
+	if err := loaded.Load(context.Background()); err != nil {
+		t.Fatal("Load() error", err)
+	}
+	if loaded.Get().Name != "test" {
+		t.Errorf("Load() = %v, want test", loaded.Get())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewData() with mismatched codec did not panic")
+		}
+	}()
+	_ = NewData[string](store, "test", WithCodec[codecStruct](GobCodec[codecStruct]{}))
+}
+
+func TestData_Load_nilPointer(t *testing.T) {
+	store := NewMemoryStore(Forever, 0)
+	_ = store.Set(context.Background(), "test", []byte("FF"))
+
+	// loading into a nil pointer used to panic, it should now allocate a new value
+	d := NewData[*serializableType](store, "test")
+	if err := d.Load(context.Background()); err != nil {
+		t.Fatal("Load() error", err)
+	}
+	if got := d.Get(); got == nil || *got != 255 {
+		t.Errorf("Load() = %v, want 255", got)
+	}
+}
@@ -0,0 +1,275 @@
+package persist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressThreshold is the size, in bytes, a value must reach before a CompressStore compresses it if
+// WithCompressThreshold is not provided
+const DefaultCompressThreshold = 1024
+
+// ErrDecompress indicates a value read by a CompressStore has a compression header but could not be decompressed
+var ErrDecompress = errors.New("failed to decompress value")
+
+// Compression is a compression algorithm that can be used by a CompressStore
+type Compression byte
+
+const (
+	// NoCompression stores values as is
+	NoCompression Compression = iota
+
+	// Gzip compresses values with gzip, it's widely supported but slower than the other algorithms
+	Gzip
+
+	// Zstd compresses values with zstd, it usually gives the best compression ratio for its speed
+	Zstd
+
+	// Snappy compresses values with snappy, it's the fastest algorithm but has the worst compression ratio
+	Snappy
+)
+
+// String returns the name of the compression algorithm
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Snappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// compressMagic starts the header of every value written by a CompressStore. 0xff can't start a valid UTF-8 or JSON
+// document, so values written before compression was enabled won't be mistaken for compressed ones
+var compressMagic = []byte{0xff, 'c', 'z'}
+
+// compressHeaderLen is the length of the header, the magic followed by a single byte for the algorithm
+var compressHeaderLen = len(compressMagic) + 1
+
+// WithCompressThreshold sets the size, in bytes, a value must reach before a CompressStore compresses it. Small values
+// often grow when compressed, so they are stored uncompressed. If it's not provided DefaultCompressThreshold is used
+func WithCompressThreshold(bytes int) CompressOption {
+	return compressOptionFunc(func(opts *compressOptions) {
+		opts.threshold = bytes
+	})
+}
+
+// CompressOption configures a CompressStore. WithCompressThreshold returns one
+type CompressOption interface {
+	applyCompress(*compressOptions)
+}
+
+// compressOptionFunc is a CompressOption that sets a field of compressOptions
+type compressOptionFunc func(*compressOptions)
+
+func (f compressOptionFunc) applyCompress(opts *compressOptions) {
+	f(opts)
+}
+
+// compressOptions holds the configuration set by each CompressOption
+type compressOptions struct {
+	threshold int
+}
+
+// CompressStore is a Store that compresses values before writing them to an underlying store. Every value is written
+// with a small header that records the algorithm used, so values can be read even if the store's algorithm is later
+// changed. Values without a header, such as ones written before the store was wrapped, are returned as is.
+type CompressStore struct {
+	store     Store
+	algo      Compression
+	threshold int
+}
+
+// Compress creates a new CompressStore that compresses values written to store with algo. Values smaller than the
+// compress threshold, or that don't get smaller when compressed, are written uncompressed
+func Compress(store Store, algo Compression, opts ...CompressOption) *CompressStore {
+	o := compressOptions{threshold: DefaultCompressThreshold}
+	for _, opt := range opts {
+		opt.applyCompress(&o)
+	}
+
+	return &CompressStore{
+		store:     store,
+		algo:      algo,
+		threshold: o.threshold,
+	}
+}
+
+// Get gets the key from the underlying store and decompresses it
+func (s *CompressStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope gets the envelope of the key from the underlying store and decompresses its value
+func (s *CompressStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	env, err := GetEnvelope(ctx, s.store, key)
+	if err != nil || env == nil {
+		return nil, err
+	}
+
+	env.Value, err = decompress(env.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w | %s", ErrDecompress, err)
+	}
+
+	env.Flags &^= FlagCompressed
+	return env, nil
+}
+
+// Set compresses the value and writes it to the underlying store
+func (s *CompressStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope compresses the envelope's value and writes it to the underlying store
+func (s *CompressStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	raw, err := s.compress(env.Value)
+	if err != nil {
+		return err
+	}
+
+	compressed := *env
+	compressed.Value = raw
+	compressed.Flags |= FlagCompressed
+	return SetEnvelope(ctx, s.store, key, &compressed)
+}
+
+// Delete removes the key from the underlying store. If the underlying store does not implement Deleter
+// ErrNotSupported will be returned
+func (s *CompressStore) Delete(ctx context.Context, key string) error {
+	return DeleteKey(ctx, s.store, key)
+}
+
+// Touch touches the key in the underlying store. If the underlying store does not implement Toucher ErrNotSupported
+// will be returned
+func (s *CompressStore) Touch(ctx context.Context, key string) error {
+	return TouchKey(ctx, s.store, key)
+}
+
+// List returns the keys in the underlying store that start with the provided prefix. If the underlying store does
+// not implement Lister ErrNotSupported will be returned
+func (s *CompressStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return ListKeys(ctx, s.store, prefix)
+}
+
+// TryLock acquires the lock for the key from the underlying store. If the underlying store does not implement Locker
+// ErrNotSupported will be returned
+func (s *CompressStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	return TryLock(ctx, s.store, key, ttl)
+}
+
+// compress compresses val and prepends the header
+func (s *CompressStore) compress(val []byte) ([]byte, error) {
+	algo := s.algo
+	if len(val) < s.threshold {
+		algo = NoCompression
+	}
+
+	header := append(append([]byte{}, compressMagic...), byte(algo))
+	buf := bytes.NewBuffer(header)
+
+	switch algo {
+	case NoCompression:
+		buf.Write(val)
+	case Gzip:
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(val)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+	case Zstd:
+		buf.Write(zstdEncoder().EncodeAll(val, nil))
+	case Snappy:
+		buf.Write(snappy.Encode(nil, val))
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %s", algo)
+	}
+
+	// compressing small or random values can make them larger, it's better to store those as is
+	if algo != NoCompression && buf.Len() >= compressHeaderLen+len(val) {
+		header[len(header)-1] = byte(NoCompression)
+		return append(header, val...), nil
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress reads the header of raw and decompresses it with the algorithm it was written with. Values without a
+// header are returned as is
+func decompress(raw []byte) ([]byte, error) {
+	if len(raw) < compressHeaderLen || !bytes.HasPrefix(raw, compressMagic) {
+		return raw, nil
+	}
+
+	algo := Compression(raw[len(compressMagic)])
+	data := raw[compressHeaderLen:]
+	switch algo {
+	case NoCompression:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return io.ReadAll(r)
+	case Zstd:
+		return zstdDecoder().DecodeAll(data, nil)
+	case Snappy:
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %s", algo)
+	}
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// initZstd creates the shared zstd encoder and decoder, both are safe for concurrent use with EncodeAll and DecodeAll
+func initZstd() {
+	zstdOnce.Do(func() {
+		// these only fail if they are given invalid options
+		zstdEnc, _ = zstd.NewWriter(nil)
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+}
+
+// zstdEncoder returns the shared zstd encoder
+func zstdEncoder() *zstd.Encoder {
+	initZstd()
+	return zstdEnc
+}
+
+// zstdDecoder returns the shared zstd decoder
+func zstdDecoder() *zstd.Decoder {
+	initZstd()
+	return zstdDec
+}
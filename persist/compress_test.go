@@ -0,0 +1,146 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestCompressStore(t *testing.T) {
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	large := bytes.Repeat([]byte(`{"name":"cachin","tags":["a","b","c"]}`), 100)
+
+	tests := []struct {
+		name     string
+		algo     Compression
+		val      []byte
+		wantAlgo Compression
+	}{
+		{
+			"gzip",
+			Gzip,
+			large,
+			Gzip,
+		},
+		{
+			"zstd",
+			Zstd,
+			large,
+			Zstd,
+		},
+		{
+			"snappy",
+			Snappy,
+			large,
+			Snappy,
+		},
+		{
+			"below threshold",
+			Zstd,
+			[]byte(`{"name":"cachin"}`),
+			NoCompression,
+		},
+		{
+			"incompressible",
+			Gzip,
+			random,
+			NoCompression,
+		},
+		{
+			"empty",
+			Snappy,
+			[]byte{},
+			NoCompression,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			underlying := NewMemoryStore(Forever, 0)
+			s := Compress(underlying, tt.algo)
+
+			if err := s.Set(ctx, "test", tt.val); err != nil {
+				t.Fatalf("CompressStore.Set() error = %v", err)
+			}
+
+			raw, _, _ := underlying.Get(ctx, "test")
+			if !bytes.HasPrefix(raw, compressMagic) || Compression(raw[len(compressMagic)]) != tt.wantAlgo {
+				t.Errorf("CompressStore.Set() stored header %v, want %s", raw[:compressHeaderLen], tt.wantAlgo)
+			}
+			if tt.wantAlgo != NoCompression && len(raw) >= len(tt.val) {
+				t.Errorf("CompressStore.Set() stored %d bytes, want less than %d", len(raw), len(tt.val))
+			}
+
+			got, _, err := s.Get(ctx, "test")
+			if err != nil {
+				t.Fatalf("CompressStore.Get() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.val) {
+				t.Errorf("CompressStore.Get() = %d bytes, want %d bytes matching what was set", len(got), len(tt.val))
+			}
+		})
+	}
+}
+
+func TestCompressStore_Get(t *testing.T) {
+	large := bytes.Repeat([]byte("cachin"), 1000)
+	gzipped, _ := Compress(nil, Gzip).compress(large)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			"legacy uncompressed",
+			[]byte(`{"name":"cachin"}`),
+			[]byte(`{"name":"cachin"}`),
+			nil,
+		},
+		{
+			"other algorithm",
+			gzipped,
+			large,
+			nil,
+		},
+		{
+			"corrupt",
+			append(append([]byte{}, compressMagic...), byte(Zstd), 1, 2, 3),
+			nil,
+			ErrDecompress,
+		},
+		{
+			"unknown algorithm",
+			append(append([]byte{}, compressMagic...), 100, 1, 2, 3),
+			nil,
+			ErrDecompress,
+		},
+		{
+			"missing",
+			nil,
+			nil,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			underlying := NewMemoryStore(Forever, 0)
+			if tt.raw != nil {
+				_ = underlying.Set(ctx, "test", tt.raw)
+			}
+
+			got, _, err := Compress(underlying, Snappy, WithCompressThreshold(0)).Get(ctx, "test")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CompressStore.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("CompressStore.Get() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package persist_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/spf13/afero"
+	bolt "go.etcd.io/bbolt"
+	_ "modernc.org/sqlite"
+
+	"github.com/weave-lab/cachin/persist"
+	"github.com/weave-lab/cachin/persist/persisttest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory func(t *testing.T) persist.Store
+	}{
+		{
+			"filesystem",
+			func(t *testing.T) persist.Store {
+				return persist.NewFsStore(t.TempDir(), false)
+			},
+		},
+		{
+			"filesystem safe key",
+			func(t *testing.T) persist.Store {
+				return persist.NewFsStore(t.TempDir(), true)
+			},
+		},
+		{
+			"filesystem locking",
+			func(t *testing.T) persist.Store {
+				return persist.NewFsStore(t.TempDir(), true, persist.WithFileLocking())
+			},
+		},
+		{
+			"filesystem memory",
+			func(t *testing.T) persist.Store {
+				return persist.NewFsStoreFS(afero.NewMemMapFs(), "/cache", true)
+			},
+		},
+		{
+			"log",
+			func(t *testing.T) persist.Store {
+				s, err := persist.OpenLogStore(t.TempDir())
+				if err != nil {
+					t.Fatal("OpenLogStore() error", err)
+				}
+				t.Cleanup(func() { _ = s.Close() })
+				return s
+			},
+		},
+		{
+			"bolt",
+			func(t *testing.T) persist.Store {
+				db, err := bolt.Open(filepath.Join(t.TempDir(), "cache.db"), 0600, nil)
+				if err != nil {
+					t.Fatal("failed to open bolt db", err)
+				}
+				t.Cleanup(func() { _ = db.Close() })
+				return persist.NewBoltStore(db, "cache")
+			},
+		},
+		{
+			"sqlite",
+			func(t *testing.T) persist.Store {
+				db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db")+"?_pragma=busy_timeout(5000)")
+				if err != nil {
+					t.Fatal("failed to open sqlite db", err)
+				}
+				db.SetMaxOpenConns(1)
+				t.Cleanup(func() { _ = db.Close() })
+
+				s := persist.NewSQLStore(db, persist.SQLite, "cache")
+				if err := s.Migrate(context.Background()); err != nil {
+					t.Fatal("SQLStore.Migrate() error", err)
+				}
+				return s
+			},
+		},
+		{
+			"redis",
+			func(t *testing.T) persist.Store {
+				server := miniredis.RunT(t)
+				return persist.NewRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+			},
+		},
+		{
+			"memory",
+			func(t *testing.T) persist.Store {
+				return persist.NewMemoryStore(time.Hour, 1<<20)
+			},
+		},
+		{
+			"multi",
+			func(t *testing.T) persist.Store {
+				return persist.NewMultiStore(time.Hour, []persist.Store{persist.NewMemoryStore(time.Hour, 0), persist.NewFsStore(t.TempDir(), true)})
+			},
+		},
+		{
+			"namespace",
+			func(t *testing.T) persist.Store {
+				return persist.Namespace(persist.NewFsStore(t.TempDir(), false), "svc-a")
+			},
+		},
+		{
+			"generation",
+			func(t *testing.T) persist.Store {
+				return persist.Generational(persist.NewFsStore(t.TempDir(), true), "svc-a", time.Minute)
+			},
+		},
+		{
+			"compress",
+			func(t *testing.T) persist.Store {
+				return persist.Compress(persist.NewFsStore(t.TempDir(), true), persist.Zstd, persist.WithCompressThreshold(64))
+			},
+		},
+		{
+			"encrypt",
+			func(t *testing.T) persist.Store {
+				keyring, err := persist.NewKeyring("v1", map[string][]byte{"v1": make([]byte, 32)})
+				if err != nil {
+					t.Fatal("failed to create keyring", err)
+				}
+				return persist.Encrypt(persist.NewFsStore(t.TempDir(), true), keyring)
+			},
+		},
+		{
+			"checksum",
+			func(t *testing.T) persist.Store {
+				return persist.Checksum(persist.NewFsStore(t.TempDir(), true), persist.CRC32C)
+			},
+		},
+		{
+			"hmac",
+			func(t *testing.T) persist.Store {
+				return persist.Authenticate(persist.NewFsStore(t.TempDir(), true), []byte("secret"))
+			},
+		},
+		{
+			"middleware",
+			func(t *testing.T) persist.Store {
+				store := persist.NewFsStore(t.TempDir(), true)
+				store2 := persist.WithRetry(store, persist.RetryPolicy{Attempts: 2})
+				store2 = persist.WithTimeout(store2, time.Second)
+				store2 = persist.WithLogging(store2, func(context.Context, error) {})
+				return persist.WithCircuitBreaker(store2, 5, time.Second)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			persisttest.RunStoreTests(t, tt.factory)
+		})
+	}
+}
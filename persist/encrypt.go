@@ -0,0 +1,275 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDecrypt indicates a value read by an EncryptStore could not be decrypted, either because it was encrypted
+	// with a key that is not in the keyring or because it was modified
+	ErrDecrypt = errors.New("failed to decrypt value")
+
+	// ErrInvalidKeyring indicates a keyring could not be created from the provided keys
+	ErrInvalidKeyring = errors.New("invalid keyring")
+)
+
+// encryptMagic starts the header of every value written by an EncryptStore
+var encryptMagic = []byte{0xff, 'e', 'n'}
+
+// maxKeyIDLen is the longest key id that fits in the header's single length byte
+const maxKeyIDLen = 255
+
+// Keyring holds the keys used by an EncryptStore. New values are always encrypted with the active key, values
+// encrypted with any key in the keyring can be decrypted. Keys can be rotated by creating a new keyring with a new
+// active key while keeping the old key until every value encrypted with it has expired or been re-encrypted.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// NewKeyring creates a Keyring from keys, which maps key ids to AES keys. Each key must be 16, 24 or 32 bytes to
+// select AES-128, AES-192 or AES-256, and each key id must be 1 to 255 bytes long. The active id must be in keys
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("%w | active key %q is missing", ErrInvalidKeyring, active)
+	}
+
+	k := &Keyring{
+		active: active,
+		keys:   map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > maxKeyIDLen {
+			return nil, fmt.Errorf("%w | key id %q must be 1 to %d bytes", ErrInvalidKeyring, id, maxKeyIDLen)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w | key %q: %s", ErrInvalidKeyring, id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w | key %q: %s", ErrInvalidKeyring, id, err)
+		}
+
+		k.keys[id] = aead
+	}
+
+	return k, nil
+}
+
+// Active returns the id of the key new values are encrypted with
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+// EncryptStore is a Store that encrypts values with AES-GCM before writing them to an underlying store. Each value is
+// written with a header that holds the id of the key it was encrypted with, and the store key is authenticated along
+// with the value so encrypted values can't be swapped between keys. Values that were not written by an EncryptStore
+// are treated as missing. If values should also be compressed, the EncryptStore must be wrapped by the CompressStore,
+// since encrypted data does not compress.
+type EncryptStore struct {
+	store   Store
+	keyring *Keyring
+}
+
+// Encrypt creates a new EncryptStore that encrypts values written to store with the keyring's active key
+func Encrypt(store Store, keyring *Keyring) *EncryptStore {
+	return &EncryptStore{
+		store:   store,
+		keyring: keyring,
+	}
+}
+
+// Get gets the key from the underlying store and decrypts it. If the value is not encrypted it's treated as missing
+func (s *EncryptStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope gets the envelope of the key from the underlying store and decrypts its value. If the value is not
+// encrypted it's treated as missing
+func (s *EncryptStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	env, err := GetEnvelope(ctx, s.store, key)
+	if err != nil || env == nil {
+		return nil, err
+	}
+
+	keyID, ok := encryptKeyID(env.Value)
+	if !ok {
+		return nil, nil
+	}
+
+	env.Value, err = s.decrypt(key, keyID, env.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	env.Flags &^= FlagEncrypted
+	return env, nil
+}
+
+// Set encrypts the value with the active key and writes it to the underlying store
+func (s *EncryptStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope encrypts the envelope's value with the active key and writes it to the underlying store. Only the
+// value is encrypted, the rest of the envelope is stored in plaintext
+func (s *EncryptStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	raw, err := s.encrypt(key, env.Value)
+	if err != nil {
+		return err
+	}
+
+	encrypted := *env
+	encrypted.Value = raw
+	encrypted.Flags |= FlagEncrypted
+	return SetEnvelope(ctx, s.store, key, &encrypted)
+}
+
+// Delete removes the key from the underlying store. If the underlying store does not implement Deleter
+// ErrNotSupported will be returned
+func (s *EncryptStore) Delete(ctx context.Context, key string) error {
+	return DeleteKey(ctx, s.store, key)
+}
+
+// Touch touches the key in the underlying store. If the underlying store does not implement Toucher ErrNotSupported
+// will be returned
+func (s *EncryptStore) Touch(ctx context.Context, key string) error {
+	return TouchKey(ctx, s.store, key)
+}
+
+// List returns the keys in the underlying store that start with the provided prefix. If the underlying store does
+// not implement Lister ErrNotSupported will be returned
+func (s *EncryptStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return ListKeys(ctx, s.store, prefix)
+}
+
+// TryLock acquires the lock for the key from the underlying store. If the underlying store does not implement Locker
+// ErrNotSupported will be returned
+func (s *EncryptStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	return TryLock(ctx, s.store, key, ttl)
+}
+
+// ReEncrypt re-encrypts every value whose key starts with prefix and was not encrypted with the active key, so old
+// keys can be removed from the keyring. Unencrypted values are encrypted as well. It returns how many values were
+// rewritten. The rest of the envelope, like the TTL and created time, is kept but rewriting a value resets its last
+// update time in the underlying store. The underlying store must
+// implement Lister, otherwise ErrNotSupported will be returned. ReEncrypt attempts to rewrite every value even if
+// some fail
+func (s *EncryptStore) ReEncrypt(ctx context.Context, prefix string) (int, error) {
+	keys, err := ListKeys(ctx, s.store, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		errs      []string
+		rewritten int
+	)
+	for _, key := range keys {
+		ok, err := s.reEncrypt(ctx, key)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", key, err))
+			continue
+		}
+		if ok {
+			rewritten++
+		}
+	}
+
+	if len(errs) > 0 {
+		return rewritten, fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return rewritten, nil
+}
+
+// reEncrypt rewrites the key with the active key if needed and reports whether it was rewritten
+func (s *EncryptStore) reEncrypt(ctx context.Context, key string) (bool, error) {
+	env, err := GetEnvelope(ctx, s.store, key)
+	if err != nil || env == nil {
+		return false, err
+	}
+
+	keyID, ok := encryptKeyID(env.Value)
+	if ok {
+		if keyID == s.keyring.active {
+			return false, nil
+		}
+
+		env.Value, err = s.decrypt(key, keyID, env.Value)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, s.SetEnvelope(ctx, key, env)
+}
+
+// encrypt seals val with the active key and prepends the header
+func (s *EncryptStore) encrypt(key string, val []byte) ([]byte, error) {
+	id := s.keyring.active
+	aead := s.keyring.keys[id]
+
+	header := append(append([]byte{}, encryptMagic...), byte(len(id)))
+	header = append(header, id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append(header, nonce...), nonce, val, []byte(key)), nil
+}
+
+// decrypt opens raw, which was encrypted with the key with the provided id
+func (s *EncryptStore) decrypt(key, keyID string, raw []byte) ([]byte, error) {
+	aead, ok := s.keyring.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w | unknown key %q", ErrDecrypt, keyID)
+	}
+
+	data := raw[len(encryptMagic)+1+len(keyID):]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w | value is too short", ErrDecrypt)
+	}
+
+	val, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w | %s", ErrDecrypt, err)
+	}
+
+	return val, nil
+}
+
+// encryptKeyID returns the id of the key raw was encrypted with, if raw does not have a valid header false is
+// returned
+func encryptKeyID(raw []byte) (string, bool) {
+	if !bytes.HasPrefix(raw, encryptMagic) || len(raw) <= len(encryptMagic) {
+		return "", false
+	}
+
+	idLen := int(raw[len(encryptMagic)])
+	start := len(encryptMagic) + 1
+	if idLen == 0 || len(raw) < start+idLen {
+		return "", false
+	}
+
+	return string(raw[start : start+idLen]), true
+}
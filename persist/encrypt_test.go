@@ -0,0 +1,245 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testKeyring creates a keyring holding the provided key ids, each key is the id repeated to 32 bytes
+func testKeyring(t *testing.T, active string, ids ...string) *Keyring {
+	keys := map[string][]byte{}
+	for _, id := range append(ids, active) {
+		keys[id] = bytes.Repeat([]byte(id), 32)[:32]
+	}
+
+	k, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatal("failed to create keyring", err)
+	}
+
+	return k
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		active  string
+		keys    map[string][]byte
+		wantErr error
+	}{
+		{
+			"valid",
+			"v2",
+			map[string][]byte{"v1": make([]byte, 16), "v2": make([]byte, 32)},
+			nil,
+		},
+		{
+			"missing active key",
+			"v3",
+			map[string][]byte{"v1": make([]byte, 16)},
+			ErrInvalidKeyring,
+		},
+		{
+			"invalid key size",
+			"v1",
+			map[string][]byte{"v1": make([]byte, 10)},
+			ErrInvalidKeyring,
+		},
+		{
+			"empty key id",
+			"",
+			map[string][]byte{"": make([]byte, 16)},
+			ErrInvalidKeyring,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyring(tt.active, tt.keys)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptStore(t *testing.T) {
+	ctx := context.Background()
+	underlying := NewMemoryStore(Forever, 0)
+	v1 := Encrypt(underlying, testKeyring(t, "v1"))
+	_ = v1.Set(ctx, "old", []byte("secret-old"))
+	_ = underlying.Set(ctx, "plain", []byte("secret-plain"))
+
+	// rotate to a new key, keeping the old one for reads
+	v2 := Encrypt(underlying, testKeyring(t, "v2", "v1"))
+	_ = v2.Set(ctx, "new", []byte("secret-new"))
+
+	raw, _, _ := underlying.Get(ctx, "new")
+	if bytes.Contains(raw, []byte("secret-new")) {
+		t.Errorf("EncryptStore.Set() stored plaintext %s", raw)
+	}
+	if id, _ := encryptKeyID(raw); id != "v2" {
+		t.Errorf("EncryptStore.Set() key id = %s, want v2", id)
+	}
+
+	tests := []struct {
+		name    string
+		store   *EncryptStore
+		key     string
+		want    []byte
+		wantErr error
+	}{
+		{
+			"active key",
+			v2,
+			"new",
+			[]byte("secret-new"),
+			nil,
+		},
+		{
+			"old key",
+			v2,
+			"old",
+			[]byte("secret-old"),
+			nil,
+		},
+		{
+			"unknown key",
+			v1,
+			"new",
+			nil,
+			ErrDecrypt,
+		},
+		{
+			"unencrypted",
+			v2,
+			"plain",
+			nil,
+			nil,
+		},
+		{
+			"missing",
+			v2,
+			"missing",
+			nil,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := tt.store.Get(ctx, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncryptStore.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("EncryptStore.Get() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptStore_tampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(s *MemoryStore)
+	}{
+		{
+			"modified ciphertext",
+			func(s *MemoryStore) {
+				raw, _, _ := s.Get(context.Background(), "test")
+				raw[len(raw)-1] ^= 0xff
+				_ = s.Set(context.Background(), "test", raw)
+			},
+		},
+		{
+			"moved to another key",
+			func(s *MemoryStore) {
+				raw, _, _ := s.Get(context.Background(), "other")
+				_ = s.Set(context.Background(), "test", raw)
+			},
+		},
+		{
+			"truncated",
+			func(s *MemoryStore) {
+				raw, _, _ := s.Get(context.Background(), "test")
+				_ = s.Set(context.Background(), "test", raw[:len(encryptMagic)+4])
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			underlying := NewMemoryStore(Forever, 0)
+			s := Encrypt(underlying, testKeyring(t, "v1"))
+			_ = s.Set(ctx, "test", []byte("secret"))
+			_ = s.Set(ctx, "other", []byte("other"))
+			tt.modify(underlying)
+
+			got, _, err := s.Get(ctx, "test")
+			if !errors.Is(err, ErrDecrypt) {
+				t.Errorf("EncryptStore.Get() = %s, %v, want %v", got, err, ErrDecrypt)
+			}
+		})
+	}
+}
+
+func TestEncryptStore_ReEncrypt(t *testing.T) {
+	ctx := context.Background()
+	underlying := NewMemoryStore(Forever, 0)
+	_ = Encrypt(underlying, testKeyring(t, "v1")).Set(ctx, "a/old", []byte("old"))
+	_ = underlying.Set(ctx, "a/plain", []byte("plain"))
+	_ = underlying.Set(ctx, "b/plain", []byte("plain"))
+
+	s := Encrypt(underlying, testKeyring(t, "v2", "v1"))
+	_ = s.Set(ctx, "a/new", []byte("new"))
+
+	n, err := s.ReEncrypt(ctx, "a/")
+	if err != nil {
+		t.Fatalf("EncryptStore.ReEncrypt() error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("EncryptStore.ReEncrypt() = %d, want 2", n)
+	}
+
+	// the old key is no longer needed for anything under the prefix
+	rotated := Encrypt(underlying, testKeyring(t, "v2"))
+	for key, want := range map[string]string{"a/old": "old", "a/plain": "plain", "a/new": "new"} {
+		got, _, err := rotated.Get(ctx, key)
+		if err != nil || string(got) != want {
+			t.Errorf("EncryptStore.Get(%s) after ReEncrypt() = %s, %v, want %s", key, got, err, want)
+		}
+	}
+
+	raw, _, _ := underlying.Get(ctx, "b/plain")
+	if string(raw) != "plain" {
+		t.Errorf("EncryptStore.ReEncrypt() rewrote a key outside the prefix")
+	}
+}
+
+func TestEncryptStore_ReEncrypt_envelope(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Now()}
+	underlying := NewMemoryStore(Forever, 0, WithClock(clock))
+	want := &Envelope{TTL: time.Hour, Codec: "json", Schema: "v3", Value: []byte("old")}
+	_ = Encrypt(underlying, testKeyring(t, "v1")).SetEnvelope(ctx, "a/old", want)
+	created := clock.Now()
+
+	clock.Advance(time.Minute)
+	s := Encrypt(underlying, testKeyring(t, "v2", "v1"))
+	if _, err := s.ReEncrypt(ctx, "a/"); err != nil {
+		t.Fatalf("EncryptStore.ReEncrypt() error = %v", err)
+	}
+
+	got, err := Encrypt(underlying, testKeyring(t, "v2")).GetEnvelope(ctx, "a/old")
+	if err != nil || got == nil {
+		t.Fatalf("EncryptStore.GetEnvelope() after ReEncrypt() = %v, %v", got, err)
+	}
+	if string(got.Value) != "old" || got.TTL != want.TTL || got.Codec != want.Codec || got.Schema != want.Schema {
+		t.Errorf("EncryptStore.GetEnvelope() after ReEncrypt() = %+v, want %+v", got, want)
+	}
+	if !got.Created.Equal(created) {
+		t.Errorf("EncryptStore.ReEncrypt() Created = %v, want %v", got.Created, created)
+	}
+}
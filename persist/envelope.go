@@ -0,0 +1,279 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// EnvelopeVersion is the version of the envelope format written by this package
+const EnvelopeVersion = 1
+
+// ErrNotEnvelope indicates the bytes being unmarshalled into an Envelope were not written by Envelope.MarshalBinary.
+// Stores use this to detect values written in their legacy formats
+var ErrNotEnvelope = errors.New("value is not an envelope")
+
+// EnvelopeFlags records how the value in an envelope was transformed before it was stored
+type EnvelopeFlags uint16
+
+const (
+	// FlagCompressed is set on values written through a CompressStore
+	FlagCompressed EnvelopeFlags = 1 << iota
+
+	// FlagEncrypted is set on values written through an EncryptStore
+	FlagEncrypted
+
+	// FlagChecksummed is set on values written through an IntegrityStore
+	FlagChecksummed
+)
+
+// envelopeMagic starts every marshalled envelope, 0xff can't start a valid UTF-8 or JSON document so envelopes can't
+// be confused with values stored in a legacy format
+var envelopeMagic = []byte{0xff, 'e', 'v'}
+
+// envelopeFixedLen is the length of everything before the checksum in an envelope that does not vary in size. That's
+// the magic, version, flags, the created and updated timestamps, the TTL, the codec and schema lengths and the key
+// length
+const envelopeFixedLen = 3 + 1 + 2 + 8 + 8 + 8 + 1 + 1 + 2
+
+// envelopeChecksumLen is the length of the CRC-32C checksum that ends every envelope
+const envelopeChecksumLen = 4
+
+// maxEnvelopeKeyLen is the longest key that fits in an envelope
+const maxEnvelopeKeyLen = 1<<16 - 1
+
+// maxEnvelopeStringLen is the longest codec or schema that fits in an envelope
+const maxEnvelopeStringLen = 255
+
+// Envelope is the versioned binary format the stores in this package use to keep metadata alongside each value
+type Envelope struct {
+	// Created is when the value was written
+	Created time.Time
+
+	// Updated is when the value was last written or touched, it's the last update time returned by Store.Get
+	Updated time.Time
+
+	// TTL is how long the writer intended the value to be cached for, Forever if it never expires
+	TTL time.Duration
+
+	// Codec identifies the Codec the value was encoded with, it's empty if the codec is unknown
+	Codec string
+
+	// Schema identifies the schema of the value, it's empty if the value is not versioned
+	Schema string
+
+	// Flags records how the value was transformed before it was stored
+	Flags EnvelopeFlags
+
+	// Key is the key the value was stored under. Stores only record it when the key can't be recovered from where the
+	// value is stored, such as an FsStore file named after the key's hash
+	Key string
+
+	// Value is the stored value
+	Value []byte
+}
+
+// EnvelopeStore is an optional interface a Store can implement to read and write values along with their full
+// envelope. GetEnvelope returns nil if the key is missing. SetEnvelope stamps the envelope's Updated time, and its
+// Created time if it's not already set, before writing it
+type EnvelopeStore interface {
+	GetEnvelope(context.Context, string) (*Envelope, error)
+	SetEnvelope(context.Context, string, *Envelope) error
+}
+
+// GetEnvelope reads the key's envelope if the store implements EnvelopeStore, otherwise the value is read with Get
+// and wrapped in an envelope. If the key is missing nil is returned
+func GetEnvelope(ctx context.Context, store Store, key string) (*Envelope, error) {
+	if s, ok := store.(EnvelopeStore); ok {
+		return s.GetEnvelope(ctx, key)
+	}
+
+	raw, lastUpdate, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil && lastUpdate.IsZero() {
+		return nil, nil
+	}
+
+	return &Envelope{Created: lastUpdate, Updated: lastUpdate, Value: raw}, nil
+}
+
+// SetEnvelope writes the envelope if the store implements EnvelopeStore, otherwise only the value is written with Set
+func SetEnvelope(ctx context.Context, store Store, key string, env *Envelope) error {
+	if s, ok := store.(EnvelopeStore); ok {
+		return s.SetEnvelope(ctx, key, env)
+	}
+
+	return store.Set(ctx, key, env.Value)
+}
+
+// stamp sets the envelope's Updated time, and its Created time if it's not already set
+func (e *Envelope) stamp(now time.Time) {
+	if e.Created.IsZero() {
+		e.Created = now
+	}
+	e.Updated = now
+}
+
+// expired reports whether the envelope's TTL has passed
+func (e *Envelope) expired(now time.Time) bool {
+	return e.TTL != Forever && now.Sub(e.Updated) > e.TTL
+}
+
+// clone returns a copy of the envelope that does not share its value
+func (e *Envelope) clone() *Envelope {
+	c := *e
+	if e.Value != nil {
+		c.Value = append([]byte{}, e.Value...)
+	}
+
+	return &c
+}
+
+// MarshalBinary encodes the envelope. Every integer is big endian and timestamps are stored as unix nanoseconds, with
+// 0 used for the zero time. The layout is:
+//
+//	magic (3) | version (1) | flags (2) | created (8) | updated (8) | ttl (8) |
+//	codec length (1) | codec | schema length (1) | schema | key length (2) | key | value | checksum (4)
+//
+// The checksum is the CRC-32C of everything before it, so truncated or corrupted envelopes are detected
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	if len(e.Codec) > maxEnvelopeStringLen {
+		return nil, fmt.Errorf("codec %q is longer than %d bytes", e.Codec, maxEnvelopeStringLen)
+	}
+	if len(e.Schema) > maxEnvelopeStringLen {
+		return nil, fmt.Errorf("schema %q is longer than %d bytes", e.Schema, maxEnvelopeStringLen)
+	}
+	if len(e.Key) > maxEnvelopeKeyLen {
+		return nil, fmt.Errorf("key is longer than %d bytes", maxEnvelopeKeyLen)
+	}
+
+	raw := make([]byte, 0, envelopeFixedLen+len(e.Codec)+len(e.Schema)+len(e.Key)+len(e.Value)+envelopeChecksumLen)
+	raw = append(raw, envelopeMagic...)
+	raw = append(raw, EnvelopeVersion)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(e.Flags))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(unixNano(e.Created)))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(unixNano(e.Updated)))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(e.TTL))
+	raw = append(raw, byte(len(e.Codec)))
+	raw = append(raw, e.Codec...)
+	raw = append(raw, byte(len(e.Schema)))
+	raw = append(raw, e.Schema...)
+	raw = binary.BigEndian.AppendUint16(raw, uint16(len(e.Key)))
+	raw = append(raw, e.Key...)
+	raw = append(raw, e.Value...)
+	raw = binary.BigEndian.AppendUint32(raw, crc32.Checksum(raw, crc32cTable))
+
+	return raw, nil
+}
+
+// UnmarshalBinary decodes an envelope written by MarshalBinary. If raw is not an envelope ErrNotEnvelope is returned,
+// if it's an envelope that has been truncated or fails its checksum ErrCorrupt is returned
+func (e *Envelope) UnmarshalBinary(raw []byte) error {
+	err := checkEnvelopeVersion(raw)
+	if err != nil {
+		return err
+	}
+	if len(raw) < envelopeFixedLen+envelopeChecksumLen {
+		return fmt.Errorf("%w | envelope is truncated", ErrCorrupt)
+	}
+
+	body, sum := raw[:len(raw)-envelopeChecksumLen], raw[len(raw)-envelopeChecksumLen:]
+	if crc32.Checksum(body, crc32cTable) != binary.BigEndian.Uint32(sum) {
+		return fmt.Errorf("%w | envelope checksum mismatch", ErrCorrupt)
+	}
+
+	tmp, r, err := unmarshalEnvelopeHeader(body)
+	if err != nil {
+		return err
+	}
+	tmp.Value = append([]byte{}, r...)
+
+	*e = tmp
+	return nil
+}
+
+// checkEnvelopeVersion checks that raw starts with an envelope of the version written by this package
+func checkEnvelopeVersion(raw []byte) error {
+	if !bytes.HasPrefix(raw, envelopeMagic) {
+		return ErrNotEnvelope
+	}
+	if len(raw) < envelopeFixedLen {
+		return fmt.Errorf("%w | envelope is truncated", ErrCorrupt)
+	}
+
+	version := raw[len(envelopeMagic)]
+	if version != EnvelopeVersion {
+		return fmt.Errorf("%w | unsupported envelope version %d", ErrNotSerializable, version)
+	}
+
+	return nil
+}
+
+// unmarshalEnvelopeHeader decodes everything in raw before the value and returns the rest of raw. The checksum is not
+// verified, so it can decode an envelope's metadata from the start of the envelope without reading its whole value
+func unmarshalEnvelopeHeader(raw []byte) (Envelope, []byte, error) {
+	err := checkEnvelopeVersion(raw)
+	if err != nil {
+		return Envelope{}, nil, err
+	}
+
+	r := raw[len(envelopeMagic):]
+	tmp := Envelope{}
+	tmp.Flags = EnvelopeFlags(binary.BigEndian.Uint16(r[1:]))
+	tmp.Created = fromUnixNano(int64(binary.BigEndian.Uint64(r[3:])))
+	tmp.Updated = fromUnixNano(int64(binary.BigEndian.Uint64(r[11:])))
+	tmp.TTL = time.Duration(binary.BigEndian.Uint64(r[19:]))
+	r = r[27:]
+
+	var ok bool
+	tmp.Codec, r, ok = readEnvelopeString(r)
+	if !ok {
+		return Envelope{}, nil, fmt.Errorf("%w | envelope is truncated", ErrCorrupt)
+	}
+	tmp.Schema, r, ok = readEnvelopeString(r)
+	if !ok {
+		return Envelope{}, nil, fmt.Errorf("%w | envelope is truncated", ErrCorrupt)
+	}
+	if len(r) < 2 || len(r) < 2+int(binary.BigEndian.Uint16(r)) {
+		return Envelope{}, nil, fmt.Errorf("%w | envelope is truncated", ErrCorrupt)
+	}
+
+	n := int(binary.BigEndian.Uint16(r))
+	tmp.Key, r = string(r[2:2+n]), r[2+n:]
+
+	return tmp, r, nil
+}
+
+// readEnvelopeString reads a length prefixed string from the start of r and returns the rest of r
+func readEnvelopeString(r []byte) (string, []byte, bool) {
+	if len(r) < 1 || len(r) < 1+int(r[0]) {
+		return "", nil, false
+	}
+
+	n := int(r[0])
+	return string(r[1 : 1+n]), r[1+n:], true
+}
+
+// unixNano converts t to unix nanoseconds, the zero time is converted to 0
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// fromUnixNano reverses unixNano
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
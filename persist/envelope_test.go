@@ -0,0 +1,206 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnvelope_MarshalBinary(t *testing.T) {
+	now := time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		env  Envelope
+	}{
+		{
+			"all fields",
+			Envelope{
+				Created: now,
+				Updated: now.Add(time.Minute),
+				TTL:     time.Hour,
+				Codec:   "json",
+				Schema:  "v2",
+				Flags:   FlagCompressed | FlagChecksummed,
+				Key:     "a/key",
+				Value:   []byte(`{"name":"cachin"}`),
+			},
+		},
+		{
+			"zero values",
+			Envelope{
+				Value: []byte{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.env.MarshalBinary()
+			if err != nil {
+				t.Fatalf("Envelope.MarshalBinary() error = %v", err)
+			}
+
+			got := Envelope{}
+			if err := got.UnmarshalBinary(raw); err != nil {
+				t.Fatalf("Envelope.UnmarshalBinary() error = %v", err)
+			}
+			if !got.Created.Equal(tt.env.Created) || !got.Updated.Equal(tt.env.Updated) {
+				t.Errorf("Envelope.UnmarshalBinary() times = %v, %v, want %v, %v", got.Created, got.Updated, tt.env.Created, tt.env.Updated)
+			}
+			got.Created, got.Updated = tt.env.Created, tt.env.Updated
+			if !reflect.DeepEqual(got, tt.env) {
+				t.Errorf("Envelope.UnmarshalBinary() = %+v, want %+v", got, tt.env)
+			}
+		})
+	}
+}
+
+func TestEnvelope_UnmarshalBinary(t *testing.T) {
+	valid, _ := (&Envelope{Codec: "json", Value: []byte("value")}).MarshalBinary()
+	future := append([]byte{}, valid...)
+	future[len(envelopeMagic)] = EnvelopeVersion + 1
+	corrupted := append([]byte{}, valid...)
+	corrupted[len(corrupted)-envelopeChecksumLen-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		wantErr error
+	}{
+		{
+			"legacy value",
+			[]byte(`{"name":"cachin"}`),
+			ErrNotEnvelope,
+		},
+		{
+			"empty",
+			[]byte{},
+			ErrNotEnvelope,
+		},
+		{
+			"truncated header",
+			valid[:envelopeFixedLen-1],
+			ErrCorrupt,
+		},
+		{
+			"truncated codec",
+			valid[:envelopeFixedLen+1],
+			ErrCorrupt,
+		},
+		{
+			"truncated key",
+			append(append([]byte{}, valid[:envelopeFixedLen-2+len("json")]...), 0, 10),
+			ErrCorrupt,
+		},
+		{
+			"truncated value",
+			valid[:len(valid)-1],
+			ErrCorrupt,
+		},
+		{
+			"corrupted value",
+			corrupted,
+			ErrCorrupt,
+		},
+		{
+			"unsupported version",
+			future,
+			ErrNotSerializable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := Envelope{Value: []byte("unchanged")}
+			err := env.UnmarshalBinary(tt.raw)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Envelope.UnmarshalBinary() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(env.Value) != "unchanged" {
+				t.Errorf("Envelope.UnmarshalBinary() modified the envelope on error")
+			}
+		})
+	}
+}
+
+func TestRedisStore_legacy(t *testing.T) {
+	ctx := context.Background()
+	s := newTestRedisStore(t)
+	lastSet := time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)
+	legacy, _ := json.Marshal(rawData{LastSet: lastSet, Raw: []byte("legacy")})
+	s.client.Set(ctx, SafeKey("test"), legacy, 0)
+
+	got, lastUpdate, err := s.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("RedisStore.Get() error = %v", err)
+	}
+	if string(got) != "legacy" || !lastUpdate.Equal(lastSet) {
+		t.Errorf("RedisStore.Get() = %s, %v, want legacy, %v", got, lastUpdate, lastSet)
+	}
+
+	// touching a legacy value rewrites it as an envelope without losing when it was created
+	if err := s.Touch(ctx, "test"); err != nil {
+		t.Fatalf("RedisStore.Touch() error = %v", err)
+	}
+	env, err := s.GetEnvelope(ctx, "test")
+	if err != nil {
+		t.Fatalf("RedisStore.GetEnvelope() error = %v", err)
+	}
+	if string(env.Value) != "legacy" || !env.Created.Equal(lastSet) || !env.Updated.After(lastSet) {
+		t.Errorf("RedisStore.GetEnvelope() after Touch() = %+v", env)
+	}
+}
+
+func TestEnvelope_wrappers(t *testing.T) {
+	ctx := context.Background()
+	underlying := NewMemoryStore(Forever, 0)
+	keyring, _ := NewKeyring("v1", map[string][]byte{"v1": make([]byte, 32)})
+	store := Namespace(Compress(Encrypt(Checksum(underlying, XXHash), keyring), Zstd), "svc-a")
+
+	want := &Envelope{TTL: time.Hour, Codec: "json", Schema: "v2", Value: []byte("value")}
+	if err := store.SetEnvelope(ctx, "test", want); err != nil {
+		t.Fatalf("SetEnvelope() error = %v", err)
+	}
+
+	// the backing store sees every transformation that was applied to the value
+	raw, err := underlying.GetEnvelope(ctx, "svc-a/test")
+	if err != nil {
+		t.Fatalf("GetEnvelope() error = %v", err)
+	}
+	if raw.Flags != FlagCompressed|FlagEncrypted|FlagChecksummed {
+		t.Errorf("GetEnvelope() backing flags = %b, want every flag", raw.Flags)
+	}
+
+	got, err := store.GetEnvelope(ctx, "test")
+	if err != nil {
+		t.Fatalf("GetEnvelope() error = %v", err)
+	}
+	if got.Flags != 0 || got.TTL != want.TTL || got.Codec != want.Codec || got.Schema != want.Schema || string(got.Value) != "value" {
+		t.Errorf("GetEnvelope() = %+v, want %+v", got, want)
+	}
+	if got.Created.IsZero() || got.Updated.IsZero() {
+		t.Errorf("GetEnvelope() = %+v, want the times to be stamped", got)
+	}
+}
+
+func TestData_codecMismatch(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(Forever, 0)
+	gob := NewData[string](store, "test", WithCodec[string](GobCodec[string]{}))
+	_ = gob.Set(ctx, "cached")
+
+	d := NewData[string](store, "test", WithCodec[string](JSONCodec[string]{}))
+	err := d.Load(ctx)
+	if !errors.Is(err, ErrNotSerializable) {
+		t.Errorf("Data.Load() error = %v, want %v", err, ErrNotSerializable)
+	}
+	if !d.IsUnset() {
+		t.Errorf("Data.Load() = %s, want a miss", d.Get())
+	}
+
+	same := NewData[string](store, "test", WithCodec[string](GobCodec[string]{}), WithTTL(time.Minute))
+	if err := same.Load(ctx); err != nil || same.Get() != "cached" {
+		t.Errorf("Data.Load() = %s, %v, want cached", same.Get(), err)
+	}
+}
@@ -2,66 +2,515 @@ package persist
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/spf13/afero"
+)
+
+// lockDir is the directory inside an FsStore's root directory where lock files are kept
+const lockDir = ".locks"
+
+// tempPrefix starts the name of every temporary file an FsStore writes before renaming it into place
+const tempPrefix = ".tmp-"
+
+// envelopeHeaderLen is how much of a file is read to decode the metadata of the envelope it holds. It fits the
+// metadata of every envelope that does not have a very long key
+const envelopeHeaderLen = 4096
+
+// writeLockSuffix is appended to a key's lock file name to get the lock file used by WithFileLocking. It's kept
+// separate from the lock used by TryLock, so a process holding a key's TryLock lock can still write the key
+const writeLockSuffix = ".write"
+
+const (
+	// minLockPoll is how long lockWrite first waits before retrying a write lock held by another process
+	minLockPoll = time.Millisecond
+
+	// maxLockPoll is the longest lockWrite waits between retries of a write lock held by another process
+	maxLockPoll = time.Millisecond * 50
 )
 
-// FsStore is a Store that uses the filesystem to store cache data
+// FsStore is a Store that uses the filesystem to store cache data. Values are written to a temporary file which is
+// synced and renamed into place, so readers never see a partially written value, even if the writer crashes. Each
+// file holds an Envelope with the time the value was set, its TTL, codec and a checksum, so tools like touch, rsync or
+// a backup restore that change file timestamps don't change how fresh the value is
 type FsStore struct {
-	dir        string
-	useSafeKey bool
+	fs          afero.Fs
+	dir         string
+	useSafeKey  bool
+	clock       Clock
+	fileLocking bool
+	shardLevels int
+	gc          GCPolicy
+}
+
+// FsOption configures an FsStore. WithClock, WithFileLocking, WithShardedLayout and WithGC return one
+type FsOption interface {
+	applyFs(*fsOptions)
+}
+
+// fsOptionFunc is an FsOption that sets a field of fsOptions
+type fsOptionFunc func(*fsOptions)
+
+func (f fsOptionFunc) applyFs(opts *fsOptions) {
+	f(opts)
+}
+
+func (o ClockOption) applyFs(opts *fsOptions) {
+	opts.clock = o.clock
+}
+
+// fsOptions holds the configuration set by each FsOption
+type fsOptions struct {
+	clock       Clock
+	fileLocking bool
+	shardLevels int
+	gc          GCPolicy
+}
+
+// WithFileLocking makes an FsStore take an advisory file lock on a key while writing or touching it. Writes are
+// atomic without it, but when several processes share a directory the lock also keeps a Touch from racing a Set and
+// restoring the value it replaced. Platforms that don't support file locking write without the lock
+func WithFileLocking() FsOption {
+	return fsOptionFunc(func(opts *fsOptions) {
+		opts.fileLocking = true
+	})
 }
 
 // NewFsStore creates a new FsStore, dir is the rood directory where all cached files will be stored
-func NewFsStore(dir string, useSafeKey bool) *FsStore {
+func NewFsStore(dir string, useSafeKey bool, opts ...FsOption) *FsStore {
+	return NewFsStoreFS(afero.NewOsFs(), dir, useSafeKey, opts...)
+}
+
+// NewFsStoreFS creates a new FsStore that stores cached files in dir on the provided filesystem. This allows caches
+// to use an in-memory filesystem in tests, a copy-on-write overlay on top of a read-only base, or any other afero
+// backend. TryLock and WithFileLocking need real files to lock, so they are only supported on the OS filesystem
+func NewFsStoreFS(fs afero.Fs, dir string, useSafeKey bool, opts ...FsOption) *FsStore {
+	o := fsOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt.applyFs(&o)
+	}
+
 	return &FsStore{
-		dir:        dir,
-		useSafeKey: useSafeKey,
+		fs:          fs,
+		dir:         dir,
+		useSafeKey:  useSafeKey,
+		clock:       o.clock,
+		fileLocking: o.fileLocking,
+		shardLevels: o.shardLevels,
+		gc:          o.gc,
 	}
 }
 
 // Get searches for a file that matches the provided key in the stores root directory. If the file is missing
 // no error will be returned
-func (c *FsStore) Get(_ context.Context, key string) ([]byte, time.Time, error) {
-	if c.useSafeKey {
-		key = SafeKey(key)
+func (c *FsStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := c.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
 	}
-	file := filepath.Join(c.dir, key)
-	stat, err := os.Stat(file)
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope reads the envelope from the file that matches the provided key. Files written before envelopes were
+// used hold only the raw value, so the file's modification time is used for its timestamps. If the file is missing,
+// or holds a different key, no error will be returned
+func (c *FsStore) GetEnvelope(_ context.Context, key string) (*Envelope, error) {
+	file := c.file(key)
+	stat, err := c.filesystem().Stat(file)
 	switch {
 	case os.IsNotExist(err):
-		return nil, time.Time{}, nil
+		return nil, nil
 	case err != nil:
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
-	raw, err := os.ReadFile(file)
+	raw, err := afero.ReadFile(c.filesystem(), file)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
-	return raw, stat.ModTime(), nil
+	env := &Envelope{}
+	err = env.UnmarshalBinary(raw)
+	if errors.Is(err, ErrNotEnvelope) {
+		return &Envelope{Created: stat.ModTime(), Updated: stat.ModTime(), Value: raw}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if env.Key != "" && env.Key != key {
+		return nil, nil
+	}
+
+	return env, nil
 }
 
 // Set writes or updates a file that matches the provided key in the stores root directory. The file will contain
-// the raw bytes passed in by val
-func (c *FsStore) Set(_ context.Context, key string, val []byte) error {
-	if _, err := os.Stat(c.dir); os.IsNotExist(err) {
-		err := os.MkdirAll(c.dir, 0750)
+// the raw bytes passed in by val wrapped in an Envelope
+func (c *FsStore) Set(ctx context.Context, key string, val []byte) error {
+	return c.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and writes it to the file that matches the provided key
+func (c *FsStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	unlock, err := c.lockWrite(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	env = env.clone()
+	env.stamp(c.now())
+	env.Key = key
+	return c.write(c.file(key), env)
+}
+
+// Delete removes the file that matches the provided key from the stores root directory. If the file is missing
+// no error will be returned
+func (c *FsStore) Delete(_ context.Context, key string) error {
+	err := c.filesystem().Remove(c.file(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Touch updates the last update time of the file that matches the provided key without changing its value. If the
+// file is missing no error will be returned
+func (c *FsStore) Touch(ctx context.Context, key string) error {
+	unlock, err := c.lockWrite(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	env, err := c.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return err
+	}
+
+	env.Updated = c.now()
+	env.Key = key
+	return c.write(c.file(key), env)
+}
+
+// List walks the stores root directory and returns the keys of all files that start with the provided prefix.
+// Keys are always returned with forward slashes, regardless of the operating system. Files named after a hashed key
+// are read to find their key. If the root directory does not exist no error will be returned
+func (c *FsStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	l := c.layout()
+	err := afero.Walk(c.filesystem(), c.dir, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() {
+			if path != c.dir && info.Name() == lockDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			// this is a value that is still being written, or was left behind by a writer that crashed
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		key, hashed, ok := l.key(rel)
+		if !ok {
+			// this file was not written by the store, so it can't be a cache entry
+			return nil
+		}
+		if hashed {
+			env, err := c.readEnvelope(path)
+			if err != nil || env.Key == "" || l.path(env.Key) != rel {
+				return nil
+			}
+			key = env.Key
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// TryLock attempts to acquire an advisory file lock for the provided key. Lock files are kept in a hidden directory
+// inside the stores root directory. The lock is released by the operating system if the holding process exits, so
+// the ttl is ignored. If the lock is already held ErrLockHeld will be returned. Platforms that don't support file
+// locking, and stores that don't use the OS filesystem, will return ErrNotSupported
+func (c *FsStore) TryLock(_ context.Context, key string, _ time.Duration) (Unlock, error) {
+	f, err := c.openLockFile(lockName(key))
+	if err != nil {
+		return nil, err
 	}
 
-	if c.useSafeKey {
-		key = SafeKey(key)
+	err = tryLockFile(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func(context.Context) error {
+		err := unlockFile(f)
+		closeErr := f.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}, nil
+}
+
+// now returns the current time according to the stores clock. An FsStore created without NewFsStore uses the
+// system time
+func (c *FsStore) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
 	}
-	file := filepath.Join(c.dir, key)
-	err := os.WriteFile(file, val, 0666)
+
+	return c.clock.Now()
+}
+
+// layout returns the layout the stores files use
+func (c *FsStore) layout() layout {
+	return newLayout(c.useSafeKey, c.shardLevels)
+}
+
+// file returns the path of the file that holds the provided key
+func (c *FsStore) file(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(c.layout().path(key)))
+}
+
+// readEnvelopeHeader reads the metadata of the envelope in file without reading its whole value, the returned
+// envelope does not have a value. Files that don't hold an envelope return ErrNotEnvelope
+func (c *FsStore) readEnvelopeHeader(file string) (*Envelope, error) {
+	f, err := c.openNoAtime(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, envelopeHeaderLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	env, _, err := unmarshalEnvelopeHeader(buf[:n])
+	if errors.Is(err, ErrCorrupt) && n == envelopeHeaderLen {
+		// the header is longer than what was read, which only happens with very long keys
+		rest, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+
+		full := &Envelope{}
+		err = full.UnmarshalBinary(append(buf, rest...))
+		if err != nil {
+			return nil, err
+		}
+
+		full.Value = nil
+		return full, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &env, nil
+}
+
+// openNoAtime opens the file for reading without updating its access time where the platform supports it. Linux
+// only allows this for the file's owner, other callers fall back to a normal read
+func (c *FsStore) openNoAtime(file string) (afero.File, error) {
+	if _, ok := c.filesystem().(*afero.OsFs); ok && noAtimeFlag != 0 {
+		f, err := c.filesystem().OpenFile(file, os.O_RDONLY|noAtimeFlag, 0)
+		if !errors.Is(err, fs.ErrPermission) {
+			return f, err
+		}
+	}
+
+	return c.filesystem().Open(file)
+}
+
+// readEnvelope reads the envelope from file, files that don't hold an envelope return ErrNotEnvelope
+func (c *FsStore) readEnvelope(file string) (*Envelope, error) {
+	raw, err := afero.ReadFile(c.filesystem(), file)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{}
+	err = env.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// write atomically writes the envelope to file as is. The envelope is written to a temporary file in the same
+// directory, synced and then renamed over file. The file's modification time is set to the envelope's Updated time
+// so tools that only look at the filesystem still see when the value was last set
+func (c *FsStore) write(file string, env *Envelope) error {
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// keys that are not converted to safe keys may contain path separators, so make sure the files parent exists
+	fsys := c.filesystem()
+	dir := filepath.Dir(file)
+	if _, err := fsys.Stat(dir); os.IsNotExist(err) {
+		err := fsys.MkdirAll(dir, 0750)
+		if err != nil {
+			return err
+		}
+	}
+
+	// afero.TempFile always uses 0600, so the temp file is created by hand to get the same permissions as before
+	suffix, err := lockToken()
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(dir, tempName(filepath.Base(file), suffix))
+	tmp, err := fsys.OpenFile(tmpFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	// the temp file is removed if anything fails, once it's renamed this is a no-op
+	defer func() {
+		_ = fsys.Remove(tmpFile)
+	}()
+
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = fsys.Chtimes(tmpFile, env.Updated, env.Updated)
+	if err != nil {
+		return err
+	}
+
+	err = fsys.Rename(tmpFile, file)
 	if err != nil {
 		return err
 	}
 
+	// sync the directory so the rename itself survives a crash, not every platform supports this so errors are ignored
+	if d, err := fsys.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
 	return nil
 }
+
+// lockWrite takes the write lock for the provided key if the store was created WithFileLocking, the returned
+// function releases it. If file locking is disabled or not supported the returned function is a no-op. While another
+// process holds the lock it's retried with a backoff, if ctx is done first ctx.Err() is returned
+func (c *FsStore) lockWrite(ctx context.Context, key string) (func(), error) {
+	if !c.fileLocking {
+		return func() {}, nil
+	}
+
+	f, err := c.openLockFile(lockName(key) + writeLockSuffix)
+	if errors.Is(err, ErrNotSupported) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = pollLockFile(ctx, f)
+	if errors.Is(err, ErrNotSupported) {
+		_ = f.Close()
+		return func() {}, nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
+
+// pollLockFile takes an exclusive advisory lock on the file, retrying with a backoff while it's held until ctx is done
+func pollLockFile(ctx context.Context, f *os.File) error {
+	wait := minLockPoll
+	for {
+		err := tryLockFile(f)
+		if !errors.Is(err, ErrLockHeld) {
+			return err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		wait *= 2
+		if wait > maxLockPoll {
+			wait = maxLockPoll
+		}
+	}
+}
+
+// openLockFile opens the named file in the stores lock directory, creating it if needed. Advisory locks need a real
+// file, so if the store does not use the OS filesystem ErrNotSupported is returned
+func (c *FsStore) openLockFile(name string) (*os.File, error) {
+	if _, ok := c.filesystem().(*afero.OsFs); !ok {
+		return nil, ErrNotSupported
+	}
+
+	dir := filepath.Join(c.dir, lockDir)
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDWR, 0666)
+}
+
+// filesystem returns the stores filesystem. An FsStore created without NewFsStore uses the OS filesystem
+func (c *FsStore) filesystem() afero.Fs {
+	if c.fs == nil {
+		return afero.NewOsFs()
+	}
+
+	return c.fs
+}
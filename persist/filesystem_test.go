@@ -1,15 +1,70 @@
 package persist
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/spf13/afero"
 )
 
+// testFilesystem is a filesystem the FsStore tests are run against
+type testFilesystem struct {
+	name string
+	fs   afero.Fs
+}
+
+// testFilesystems returns the filesystems the FsStore tests are run against, a new memory filesystem is created each
+// time so tests don't share files
+func testFilesystems() []testFilesystem {
+	return []testFilesystem{
+		{"os", afero.NewOsFs()},
+		{"memory", afero.NewMemMapFs()},
+	}
+}
+
+// isOS reports whether the filesystem is the OS filesystem, some behavior like permissions and locking is only
+// supported there
+func (f testFilesystem) isOS() bool {
+	_, ok := f.fs.(*afero.OsFs)
+	return ok
+}
+
+// tempDir returns a new empty directory on the filesystem that is removed when the test finishes
+func (f testFilesystem) tempDir(t *testing.T) string {
+	if f.isOS() {
+		return t.TempDir()
+	}
+
+	dir, err := afero.TempDir(f.fs, "", "cachin")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	t.Cleanup(func() {
+		_ = f.fs.RemoveAll(dir)
+	})
+
+	return dir
+}
+
 func TestFsStore_Get(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			testFsStoreGet(t, fsys)
+		})
+	}
+}
+
+func testFsStoreGet(t *testing.T, fsys testFilesystem) {
 	type fields struct {
 		dir        string
 		useSafeKey bool
@@ -25,13 +80,14 @@ func TestFsStore_Get(t *testing.T) {
 		wantBytes []byte
 		wantTS    time.Time
 		wantErr   bool
+		osOnly    bool
 	}{
 		{
 			"use safe key",
 			fields{
 				dir: func() string {
-					dir := t.TempDir()
-					err := os.WriteFile(filepath.Join(dir, SafeKey("safe_key")), []byte(`test`), 0o0644)
+					dir := fsys.tempDir(t)
+					err := afero.WriteFile(fsys.fs, filepath.Join(dir, SafeKey("safe_key")), []byte(`test`), 0o0644)
 					if err != nil {
 						t.Error("failed to write test file", err)
 					}
@@ -47,11 +103,12 @@ func TestFsStore_Get(t *testing.T) {
 			[]byte(`test`),
 			time.Now(),
 			false,
+			false,
 		},
 		{
 			"file does not exist",
 			fields{
-				dir:        t.TempDir(),
+				dir:        fsys.tempDir(t),
 				useSafeKey: false,
 			},
 			args{
@@ -61,13 +118,14 @@ func TestFsStore_Get(t *testing.T) {
 			nil,
 			time.Time{},
 			false,
+			false,
 		},
 		{
 			"permission error",
 			fields{
 				dir: func() string {
-					dir := t.TempDir()
-					err := os.WriteFile(filepath.Join(dir, "test_key"), []byte(`test`), 0o0222)
+					dir := fsys.tempDir(t)
+					err := afero.WriteFile(fsys.fs, filepath.Join(dir, "test_key"), []byte(`test`), 0o0222)
 					if err != nil {
 						t.Error("failed to write test file", err)
 					}
@@ -81,11 +139,17 @@ func TestFsStore_Get(t *testing.T) {
 			nil,
 			time.Time{},
 			true,
+			true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.osOnly && !fsys.isOS() {
+				t.Skip("permissions are only enforced by the OS filesystem")
+			}
+
 			c := &FsStore{
+				fs:         fsys.fs,
 				dir:        tt.fields.dir,
 				useSafeKey: tt.fields.useSafeKey,
 			}
@@ -108,6 +172,14 @@ func TestFsStore_Get(t *testing.T) {
 }
 
 func TestFsStore_Set(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			testFsStoreSet(t, fsys)
+		})
+	}
+}
+
+func testFsStoreSet(t *testing.T, fsys testFilesystem) {
 	type fields struct {
 		dir        string
 		useSafeKey bool
@@ -123,11 +195,12 @@ func TestFsStore_Set(t *testing.T) {
 		args     args
 		wantFile []byte
 		wantErr  bool
+		osOnly   bool
 	}{
 		{
 			"dir does not exist",
 			fields{
-				dir:        filepath.Join(t.TempDir(), "nested"),
+				dir:        filepath.Join(fsys.tempDir(t), "nested"),
 				useSafeKey: false,
 			},
 			args{
@@ -137,11 +210,12 @@ func TestFsStore_Set(t *testing.T) {
 			},
 			[]byte(`test`),
 			false,
+			false,
 		},
 		{
 			"use safe key",
 			fields{
-				dir:        t.TempDir(),
+				dir:        fsys.tempDir(t),
 				useSafeKey: true,
 			},
 			args{
@@ -151,13 +225,14 @@ func TestFsStore_Set(t *testing.T) {
 			},
 			[]byte(`test`),
 			false,
+			false,
 		},
 		{
 			"permission denyed",
 			fields{
 				dir: func() string {
-					dir := t.TempDir()
-					err := os.Chmod(dir, 0o0666)
+					dir := fsys.tempDir(t)
+					err := fsys.fs.Chmod(dir, 0o0666)
 					if err != nil {
 						t.Error("FsStore.Set() failed to set up dir", err)
 					}
@@ -173,11 +248,17 @@ func TestFsStore_Set(t *testing.T) {
 			},
 			nil,
 			true,
+			true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.osOnly && !fsys.isOS() {
+				t.Skip("permissions are only enforced by the OS filesystem")
+			}
+
 			c := &FsStore{
+				fs:         fsys.fs,
 				dir:        tt.fields.dir,
 				useSafeKey: tt.fields.useSafeKey,
 			}
@@ -194,12 +275,393 @@ func TestFsStore_Set(t *testing.T) {
 				key = SafeKey(key)
 			}
 
-			got, err := os.ReadFile(filepath.Join(c.dir, key))
+			raw, err := afero.ReadFile(fsys.fs, filepath.Join(c.dir, key))
 			if err != nil {
 				t.Error("FsStore.Set() failed to read cache file", err)
 			}
-			if !reflect.DeepEqual(got, tt.wantFile) {
-				t.Errorf("FsStore.Set() cache file = %s, wanted = %s", string(got), string(tt.wantFile))
+			got := Envelope{}
+			if err := got.UnmarshalBinary(raw); err != nil {
+				t.Error("FsStore.Set() failed to unmarshal cache file", err)
+			}
+			if !reflect.DeepEqual(got.Value, tt.wantFile) {
+				t.Errorf("FsStore.Set() cache file = %s, wanted = %s", string(got.Value), string(tt.wantFile))
+			}
+		})
+	}
+}
+
+func TestFsStore_List(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			testFsStoreList(t, fsys)
+		})
+	}
+}
+
+func testFsStoreList(t *testing.T, fsys testFilesystem) {
+	type fields struct {
+		dir        string
+		useSafeKey bool
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		keys   []string
+		prefix string
+		want   []string
+	}{
+		{
+			"nested keys",
+			fields{
+				dir:        fsys.tempDir(t),
+				useSafeKey: false,
+			},
+			[]string{"a/one", "a/two", "b/one"},
+			"a/",
+			[]string{"a/one", "a/two"},
+		},
+		{
+			"use safe key",
+			fields{
+				dir:        fsys.tempDir(t),
+				useSafeKey: true,
+			},
+			[]string{"a/one", "a/two", "b/one"},
+			"",
+			[]string{"a/one", "a/two", "b/one"},
+		},
+		{
+			"dir does not exist",
+			fields{
+				dir:        filepath.Join(fsys.tempDir(t), "missing"),
+				useSafeKey: false,
+			},
+			nil,
+			"",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &FsStore{
+				fs:         fsys.fs,
+				dir:        tt.fields.dir,
+				useSafeKey: tt.fields.useSafeKey,
+			}
+			for _, key := range tt.keys {
+				if err := c.Set(context.Background(), key, []byte(`test`)); err != nil {
+					t.Fatal("FsStore.List() failed to set key", err)
+				}
+			}
+
+			got, err := c.List(context.Background(), tt.prefix)
+			if err != nil {
+				t.Errorf("FsStore.List() error = %v", err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FsStore.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFsStore_Delete(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), true)
+			if err := c.Set(context.Background(), "test_key", []byte(`test`)); err != nil {
+				t.Fatal("FsStore.Delete() failed to set key", err)
+			}
+
+			if err := c.Delete(context.Background(), "test_key"); err != nil {
+				t.Errorf("FsStore.Delete() error = %v", err)
+			}
+			if err := c.Delete(context.Background(), "missing_key"); err != nil {
+				t.Errorf("FsStore.Delete() missing key error = %v", err)
+			}
+			if _, err := fsys.fs.Stat(filepath.Join(c.dir, SafeKey("test_key"))); !os.IsNotExist(err) {
+				t.Errorf("FsStore.Delete() file still exists, err = %v", err)
+			}
+		})
+	}
+}
+
+func TestFsStore_List_ignoresLocks(t *testing.T) {
+	ctx := context.Background()
+	c := NewFsStore(t.TempDir(), false)
+	if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+		t.Fatal("FsStore.List() failed to set key", err)
+	}
+	unlock, err := c.TryLock(ctx, "test_key", time.Second)
+	if err != nil {
+		t.Fatal("FsStore.List() failed to lock key", err)
+	}
+	defer func() {
+		_ = unlock(ctx)
+	}()
+
+	got, err := c.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(got, []string{"test_key"}) {
+		t.Errorf("FsStore.List() = %v, %v, want [test_key]", got, err)
+	}
+}
+
+func TestFsStore_atomicWrites(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			testFsStoreAtomicWrites(t, fsys)
+		})
+	}
+}
+
+func testFsStoreAtomicWrites(t *testing.T, fsys testFilesystem) {
+	tests := []struct {
+		name string
+		opts []FsOption
+	}{
+		{
+			"without locking",
+			nil,
+		},
+		{
+			"with locking",
+			[]FsOption{WithFileLocking()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), true, tt.opts...)
+
+			// every value is a single repeated byte, so a reader seeing a partial write or a mix of two writes
+			// would get a value that's too short or contains more than one byte
+			const size = 1 << 18
+			var wg sync.WaitGroup
+			errs := make(chan error, 100)
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func(b byte) {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						if err := c.Set(ctx, "test", bytes.Repeat([]byte{b}, size)); err != nil {
+							errs <- err
+						}
+						if err := c.Touch(ctx, "test"); err != nil {
+							errs <- err
+						}
+					}
+				}(byte('a' + i))
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						got, _, err := c.Get(ctx, "test")
+						switch {
+						case err != nil:
+							errs <- err
+						case got != nil && (len(got) != size || bytes.Count(got, got[:1]) != size):
+							errs <- fmt.Errorf("FsStore.Get() read a partial value of %d bytes", len(got))
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			// no temp files should be left behind
+			entries, _ := afero.ReadDir(fsys.fs, c.dir)
+			for _, e := range entries {
+				if strings.HasPrefix(e.Name(), tempPrefix) {
+					t.Errorf("FsStore.Set() left temp file %s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFsStore_List_ignoresTempFiles(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), false)
+			if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+				t.Fatal("FsStore.List() failed to set key", err)
+			}
+
+			// a writer that crashed before renaming its temp file into place leaves it behind
+			err := afero.WriteFile(fsys.fs, filepath.Join(c.dir, tempPrefix+"test_key-1234"), []byte(`partial`), 0666)
+			if err != nil {
+				t.Fatal("FsStore.List() failed to write temp file", err)
+			}
+
+			got, err := c.List(ctx, "")
+			if err != nil || !reflect.DeepEqual(got, []string{"test_key"}) {
+				t.Errorf("FsStore.List() = %v, %v, want [test_key]", got, err)
+			}
+		})
+	}
+}
+
+func TestFsStore_WithFileLocking(t *testing.T) {
+	ctx := context.Background()
+	c := NewFsStore(t.TempDir(), false, WithFileLocking())
+
+	// the write lock is separate from TryLock, so the holder of a key's lock can still write it
+	unlock, err := c.TryLock(ctx, "test_key", time.Second)
+	if err != nil {
+		t.Fatal("FsStore.TryLock() error", err)
+	}
+	defer func() {
+		_ = unlock(ctx)
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- c.Set(ctx, "test_key", []byte(`test`))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("FsStore.Set() error = %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("FsStore.Set() blocked on the TryLock lock")
+	}
+
+	got, err := c.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(got, []string{"test_key"}) {
+		t.Errorf("FsStore.List() = %v, %v, want [test_key]", got, err)
+	}
+}
+
+func TestFsStore_WithFileLocking_canceled(t *testing.T) {
+	ctx := context.Background()
+	c := NewFsStore(t.TempDir(), false, WithFileLocking())
+	if _, err := c.TryLock(ctx, "other_key", time.Second); errors.Is(err, ErrNotSupported) {
+		t.Skip("file locking is not supported on this platform")
+	}
+
+	// hold the write lock as another writer would
+	release, err := c.lockWrite(ctx, "test_key")
+	if err != nil {
+		t.Fatal("FsStore.lockWrite() error", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	if err := c.Set(timeout, "test_key", []byte(`test`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FsStore.Set() while locked error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// once the lock is released a waiting writer takes it
+	done := make(chan error)
+	go func() {
+		done <- c.Set(ctx, "test_key", []byte(`test`))
+	}()
+	time.Sleep(time.Millisecond * 20)
+	release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("FsStore.Set() after release error = %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("FsStore.Set() did not take the released lock")
+	}
+}
+
+func TestFsStore_TryLock_memory(t *testing.T) {
+	c := NewFsStoreFS(afero.NewMemMapFs(), "/cache", false)
+	if _, err := c.TryLock(context.Background(), "test_key", time.Second); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("FsStore.TryLock() error = %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func TestFsStore_copyOnWrite(t *testing.T) {
+	ctx := context.Background()
+	base := afero.NewMemMapFs()
+	if err := NewFsStoreFS(base, "/cache", false).Set(ctx, "base_key", []byte(`base`)); err != nil {
+		t.Fatal("FsStore.Set() failed to set base key", err)
+	}
+
+	// writes go to the overlay, the base is only ever read
+	c := NewFsStoreFS(afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(base), afero.NewMemMapFs()), "/cache", false)
+	if err := c.Set(ctx, "base_key", []byte(`overlay`)); err != nil {
+		t.Fatal("FsStore.Set() error", err)
+	}
+
+	got, _, err := c.Get(ctx, "base_key")
+	if err != nil || string(got) != "overlay" {
+		t.Errorf("FsStore.Get() = %s, %v, want overlay", got, err)
+	}
+	got, _, err = NewFsStoreFS(base, "/cache", false).Get(ctx, "base_key")
+	if err != nil || string(got) != "base" {
+		t.Errorf("FsStore.Get() base = %s, %v, want base", got, err)
+	}
+}
+
+func TestFsStore_ignoresFileTimes(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+			c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), true, WithClock(clock), WithGC(GCPolicy{MaxAge: time.Hour}))
+			if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+				t.Fatal("FsStore.Set() error", err)
+			}
+
+			// a tool like rsync or a backup restore changes the file's modification time
+			old := clock.Now().Add(-time.Hour * 24)
+			if err := fsys.fs.Chtimes(c.file("test_key"), old, old); err != nil {
+				t.Fatal("failed to set file times", err)
+			}
+
+			_, lastSet, err := c.Get(ctx, "test_key")
+			if err != nil || !lastSet.Equal(clock.Now()) {
+				t.Errorf("FsStore.Get() lastSet = %v, %v, want %v", lastSet, err, clock.Now())
+			}
+
+			report, err := c.GC(ctx)
+			if err != nil || len(report.Removed) != 0 {
+				t.Errorf("FsStore.GC() removed = %v, %v, want none", report.Removed, err)
+			}
+		})
+	}
+}
+
+func TestFsStore_corrupt(t *testing.T) {
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), true)
+			if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+				t.Fatal("FsStore.Set() error", err)
+			}
+
+			// flip a bit in the value
+			raw, err := afero.ReadFile(fsys.fs, c.file("test_key"))
+			if err != nil {
+				t.Fatal("failed to read cache file", err)
+			}
+			raw[len(raw)-envelopeChecksumLen-1] ^= 1
+			if err := afero.WriteFile(fsys.fs, c.file("test_key"), raw, 0666); err != nil {
+				t.Fatal("failed to write cache file", err)
+			}
+
+			if _, _, err := c.Get(ctx, "test_key"); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("FsStore.Get() error = %v, want %v", err, ErrCorrupt)
+			}
+
+			// GC only reads the metadata at the start of each file, files where it's corrupt are always removed
+			if err := afero.WriteFile(fsys.fs, c.file("test_key"), raw[:envelopeFixedLen-1], 0666); err != nil {
+				t.Fatal("failed to write cache file", err)
+			}
+			report, err := c.GC(ctx)
+			if err != nil || !reflect.DeepEqual(report.Removed, []string{"test_key"}) {
+				t.Errorf("FsStore.GC() removed = %v, %v, want [test_key]", report.Removed, err)
 			}
 		})
 	}
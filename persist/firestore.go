@@ -10,40 +10,99 @@ import (
 // FireStore is a Store that uses a firestore collection to store cache data
 type FireStore struct {
 	client *firestore.Client
+	clock  Clock
+}
+
+// fireDoc is the document a FireStore writes for each key
+type fireDoc struct {
+	// Envelope is the marshalled Envelope holding the value
+	Envelope []byte `firestore:"envelope"`
 }
 
 // NewFireStore creates a new FireStore, the client is used to interact with the store.
-func NewFireStore(client *firestore.Client) *FireStore {
+func NewFireStore(client *firestore.Client, opts ...StoreOption) *FireStore {
+	o := storeOptionsFrom(opts)
 	return &FireStore{
 		client: client,
+		clock:  o.clock,
 	}
 }
 
 // Get attempts to get the firestore document that matches the provided key. If the document does not
 // exist no error will be returned. If the document does exist, it's value and last updated time will be returned
 func (s *FireStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope attempts to get the envelope from the firestore document that matches the provided key. Documents
+// written before envelopes were used hold only the raw value, so the document's create and update times are used
+// for its timestamps
+func (s *FireStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
 	doc := s.client.Doc(SafeKey(key))
 
 	snap, err := doc.Get(ctx)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
+	}
+
+	var d fireDoc
+	err = snap.DataTo(&d)
+	if err == nil && d.Envelope != nil {
+		env := &Envelope{}
+		err = env.UnmarshalBinary(d.Envelope)
+		if err != nil {
+			return nil, err
+		}
+
+		return env, nil
 	}
 
 	var raw []byte
 	err = snap.DataTo(&raw)
 	if err != nil {
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
-	return raw, snap.UpdateTime, nil
+	return &Envelope{Created: snap.CreateTime, Updated: snap.UpdateTime, Value: raw}, nil
 }
 
 // Set attempts to update or creates a firestore document that matches the provided key. In order to ensure the key does
 // not contain illegal characters, the key will be converted to a 'safe' key.
 func (s *FireStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and writes it to the firestore document that matches the
+// provided key
+func (s *FireStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	env = env.clone()
+	env.stamp(s.clock.Now())
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	doc := s.client.Doc(SafeKey(key))
+
+	_, err = doc.Set(ctx, fireDoc{Envelope: raw})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete attempts to delete the firestore document that matches the provided key. If the document does not exist
+// no error will be returned
+func (s *FireStore) Delete(ctx context.Context, key string) error {
 	doc := s.client.Doc(SafeKey(key))
 
-	_, err := doc.Set(ctx, val)
+	_, err := doc.Delete(ctx)
 	if err != nil {
 		return err
 	}
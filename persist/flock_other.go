@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package persist
+
+import (
+	"os"
+)
+
+// tryLockFile is not supported on this platform
+func tryLockFile(_ *os.File) error {
+	return ErrNotSupported
+}
+
+// unlockFile is not supported on this platform
+func unlockFile(_ *os.File) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,280 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// staleTempAge is how old a temporary file must be before GC assumes its writer crashed and removes it
+const staleTempAge = time.Hour
+
+// GCPolicy limits how much an FsStore keeps on disk. Limits that are 0 are not enforced
+type GCPolicy struct {
+	// MaxBytes is the most bytes the store's files can take up. The least recently used files are removed until the
+	// store fits
+	MaxBytes int64
+
+	// MaxAge removes files that have not been used for longer than this
+	MaxAge time.Duration
+
+	// RemoveExpired removes values whose Envelope TTL has passed
+	RemoveExpired bool
+
+	// UseAccessTime uses each file's access time to decide when it was last used, instead of when its value was last
+	// set or touched. Not every platform or filesystem records access times, and many are mounted with relatime or
+	// noatime, so the modification time is used when it's unavailable. Unless RemoveExpired is set GC does not read
+	// the files, so corrupt metadata is not detected. Otherwise GC reads each file's metadata without updating its
+	// access time on Linux, if the process owns the file, other platforms update the access time on every read
+	UseAccessTime bool
+}
+
+// GCReport describes what a GC run removed
+type GCReport struct {
+	// Removed is the keys that were removed
+	Removed []string
+
+	// RemovedBytes is the total size of every file that was removed, including temporary files left behind by
+	// writers that crashed
+	RemovedBytes int64
+
+	// Remaining is how many keys are left in the store
+	Remaining int
+
+	// RemainingBytes is the total size of the files left in the store
+	RemainingBytes int64
+}
+
+// WithGC sets the policy an FsStore enforces when GC is called
+func WithGC(policy GCPolicy) FsOption {
+	return fsOptionFunc(func(opts *fsOptions) {
+		opts.gc = policy
+	})
+}
+
+// gcEntry is a file GC may remove
+type gcEntry struct {
+	key      string
+	path     string
+	size     int64
+	lastUsed time.Time
+	updated  time.Time
+	ttl      time.Duration
+	corrupt  bool
+}
+
+// GC removes files from the store until it meets its GCPolicy, and reports what was removed. Files that have passed
+// the policy's MaxAge, have an expired TTL if RemoveExpired is set, or have corrupt metadata are removed first, then
+// the least recently used files are removed until the store is under MaxBytes. Only the metadata at the start of each
+// file is read, so corrupt values are not detected until they are read with Get. Temporary files left behind by
+// writers that crashed are removed as well, files that were not written by the store are left alone. GC attempts to
+// remove every file even if some fail
+func (c *FsStore) GC(ctx context.Context) (GCReport, error) {
+	report := GCReport{}
+	entries, err := c.gcEntries(ctx, &report)
+	if err != nil {
+		return report, err
+	}
+
+	now := c.now()
+	var (
+		errs []string
+		kept []gcEntry
+	)
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		if !c.gcExpired(e, now) {
+			kept = append(kept, e)
+			continue
+		}
+
+		err := c.gcRemove(ctx, e, &report)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", e.key, err))
+			kept = append(kept, e)
+		}
+	}
+
+	var total int64
+	for _, e := range kept {
+		total += e.size
+	}
+
+	// evict the least recently used files until the store fits
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].lastUsed.Before(kept[j].lastUsed)
+	})
+	for len(kept) > 0 && c.gc.MaxBytes > 0 && total > c.gc.MaxBytes {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+
+		e := kept[0]
+		err := c.gcRemove(ctx, e, &report)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", e.key, err))
+		} else {
+			total -= e.size
+		}
+		kept = kept[1:]
+	}
+
+	report.Remaining = len(kept)
+	report.RemainingBytes = total
+	if len(errs) > 0 {
+		return report, fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return report, nil
+}
+
+// StartGC calls GC every interval until ctx is done. If report is not nil it's called with the result of each run
+func (c *FsStore) StartGC(ctx context.Context, interval time.Duration, report func(GCReport, error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r, err := c.GC(ctx)
+				if report != nil && ctx.Err() == nil {
+					report(r, err)
+				}
+			}
+		}
+	}()
+}
+
+// gcEntries walks the stores root directory and returns every file that holds a key. Stale temporary files are
+// removed as they are found
+func (c *FsStore) gcEntries(ctx context.Context, report *GCReport) ([]gcEntry, error) {
+	l := c.layout()
+	now := c.now()
+	var entries []gcEntry
+	err := afero.Walk(c.filesystem(), c.dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.IsDir() {
+			if path != c.dir && info.Name() == lockDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			if now.Sub(info.ModTime()) > staleTempAge && c.filesystem().Remove(path) == nil {
+				report.RemovedBytes += info.Size()
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		key, hashed, ok := l.key(rel)
+		if !ok {
+			return nil
+		}
+
+		e := gcEntry{
+			key:  key,
+			path: path,
+			size: info.Size(),
+		}
+
+		// when only the access time is used the header isn't needed, and not reading it keeps GC from making every file
+		// look recently used on platforms that update the access time on every read
+		if c.gc.UseAccessTime && !c.gc.RemoveExpired && !hashed {
+			e.lastUsed = accessTime(info)
+			entries = append(entries, e)
+			return nil
+		}
+
+		// values written before envelopes were used only have the file's modification time
+		env, err := c.readEnvelopeHeader(path)
+		switch {
+		case err == nil:
+			e.updated, e.ttl = env.Updated, env.TTL
+		case errors.Is(err, ErrNotEnvelope):
+			e.updated, e.ttl = info.ModTime(), Forever
+		case errors.Is(err, ErrCorrupt):
+			e.corrupt = true
+		default:
+			return nil
+		}
+		if hashed {
+			if env == nil || env.Key == "" || l.path(env.Key) != rel {
+				return nil
+			}
+			e.key = env.Key
+		}
+
+		e.lastUsed = e.updated
+		if c.gc.UseAccessTime {
+			e.lastUsed = accessTime(info)
+		}
+
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// gcExpired reports whether the entry has corrupt metadata or has passed the MaxAge or TTL of the stores policy
+func (c *FsStore) gcExpired(e gcEntry, now time.Time) bool {
+	switch {
+	case e.corrupt:
+		return true
+	case c.gc.MaxAge > 0 && now.Sub(e.lastUsed) > c.gc.MaxAge:
+		return true
+	case c.gc.RemoveExpired && e.ttl != Forever && now.Sub(e.updated) > e.ttl:
+		return true
+	default:
+		return false
+	}
+}
+
+// gcRemove removes the entry's file and records it in the report. If the file is already gone it's not recorded
+func (c *FsStore) gcRemove(ctx context.Context, e gcEntry, report *GCReport) error {
+	unlock, err := c.lockWrite(ctx, e.key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = c.filesystem().Remove(e.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	report.Removed = append(report.Removed, e.key)
+	report.RemovedBytes += e.size
+	return nil
+}
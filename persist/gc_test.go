@@ -0,0 +1,205 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestFsStore_GC(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      GCPolicy
+		wantRemoved []string
+		wantKept    []string
+	}{
+		{
+			"no limits",
+			GCPolicy{},
+			nil,
+			[]string{"mid", "new", "old"},
+		},
+		{
+			"max age",
+			GCPolicy{MaxAge: time.Minute * 150},
+			[]string{"old"},
+			[]string{"mid", "new"},
+		},
+		{
+			"max bytes",
+			GCPolicy{MaxBytes: 2500},
+			[]string{"old"},
+			[]string{"mid", "new"},
+		},
+		{
+			"max bytes evicts least recently used",
+			GCPolicy{MaxBytes: 1500},
+			[]string{"mid", "old"},
+			[]string{"new"},
+		},
+		{
+			"remove expired",
+			GCPolicy{RemoveExpired: true},
+			[]string{"mid"},
+			[]string{"new", "old"},
+		},
+		{
+			"all limits",
+			GCPolicy{MaxAge: time.Minute * 150, MaxBytes: 1500, RemoveExpired: true},
+			[]string{"mid", "old"},
+			[]string{"new"},
+		},
+	}
+	for _, fsys := range testFilesystems() {
+		for _, tt := range tests {
+			t.Run(fsys.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+				c := NewFsStoreFS(fsys.fs, fsys.tempDir(t), true, WithClock(clock), WithGC(tt.policy))
+
+				// old is the oldest value but never expires, mid expires after 30 minutes
+				val := bytes.Repeat([]byte{'a'}, 1000)
+				for _, env := range []*Envelope{{Key: "old"}, {Key: "mid", TTL: time.Minute * 30}, {Key: "new"}} {
+					env.Value = val
+					if err := c.SetEnvelope(ctx, env.Key, env); err != nil {
+						t.Fatal("FsStore.SetEnvelope() error", err)
+					}
+					clock.Advance(time.Hour)
+				}
+
+				// a temp file left behind by a crashed writer is removed, files that aren't cache entries are kept
+				temp := filepath.Join(c.dir, tempPrefix+"crashed-1234")
+				if err := afero.WriteFile(fsys.fs, temp, []byte(`partial`), 0666); err != nil {
+					t.Fatal("failed to write temp file", err)
+				}
+				if err := fsys.fs.Chtimes(temp, clock.Now().Add(-time.Hour*2), clock.Now().Add(-time.Hour*2)); err != nil {
+					t.Fatal("failed to set temp file times", err)
+				}
+				other := filepath.Join(c.dir, "notes.txt")
+				if err := afero.WriteFile(fsys.fs, other, []byte(`notes`), 0666); err != nil {
+					t.Fatal("failed to write other file", err)
+				}
+
+				report, err := c.GC(ctx)
+				if err != nil {
+					t.Fatalf("FsStore.GC() error = %v", err)
+				}
+				sort.Strings(report.Removed)
+				if !reflect.DeepEqual(report.Removed, tt.wantRemoved) {
+					t.Errorf("FsStore.GC() removed = %v, want %v", report.Removed, tt.wantRemoved)
+				}
+				if report.Remaining != len(tt.wantKept) {
+					t.Errorf("FsStore.GC() remaining = %d, want %d", report.Remaining, len(tt.wantKept))
+				}
+				if report.RemovedBytes <= int64(len(val)*len(tt.wantRemoved)) || report.RemainingBytes < int64(len(val)*len(tt.wantKept)) {
+					t.Errorf("FsStore.GC() bytes = %d removed, %d remaining", report.RemovedBytes, report.RemainingBytes)
+				}
+
+				got, err := c.List(ctx, "")
+				sort.Strings(got)
+				if err != nil || !reflect.DeepEqual(got, tt.wantKept) {
+					t.Errorf("FsStore.List() after GC() = %v, %v, want %v", got, err, tt.wantKept)
+				}
+				if ok, _ := afero.Exists(fsys.fs, temp); ok {
+					t.Error("FsStore.GC() did not remove the stale temp file")
+				}
+				if ok, _ := afero.Exists(fsys.fs, other); !ok {
+					t.Error("FsStore.GC() removed a file that was not a cache entry")
+				}
+			})
+		}
+	}
+}
+
+func TestFsStore_StartGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewFsStoreFS(afero.NewMemMapFs(), "/cache", false, WithGC(GCPolicy{MaxBytes: 1}))
+	if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+		t.Fatal("FsStore.Set() error", err)
+	}
+
+	type run struct {
+		report GCReport
+		err    error
+	}
+	runs := make(chan run, 1)
+	c.StartGC(ctx, time.Millisecond*10, func(report GCReport, err error) {
+		select {
+		case runs <- run{report, err}:
+		default:
+		}
+	})
+
+	select {
+	case r := <-runs:
+		if r.err != nil {
+			t.Errorf("FsStore.GC() error = %v", r.err)
+		}
+		if !reflect.DeepEqual(r.report.Removed, []string{"test_key"}) {
+			t.Errorf("FsStore.StartGC() removed = %v, want [test_key]", r.report.Removed)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("FsStore.StartGC() never ran")
+	}
+}
+
+func TestFsStore_GC_accessTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy GCPolicy
+	}{
+		{
+			"access time only",
+			GCPolicy{UseAccessTime: true, MaxAge: time.Hour * 48},
+		},
+		{
+			"reads metadata",
+			GCPolicy{UseAccessTime: true, MaxAge: time.Hour * 48, RemoveExpired: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := &testClock{now: time.Now()}
+			c := NewFsStore(t.TempDir(), false, WithClock(clock), WithGC(tt.policy))
+			if err := c.Set(ctx, "test_key", []byte(`test`)); err != nil {
+				t.Fatal("FsStore.Set() error", err)
+			}
+
+			// the file was last used a day ago, which relatime updates on the next read
+			used := clock.Now().Add(-time.Hour * 24).Truncate(time.Second)
+			path := filepath.Join(c.dir, "test_key")
+			if err := os.Chtimes(path, used, used); err != nil {
+				t.Fatal("failed to set file times", err)
+			}
+
+			report, err := c.GC(ctx)
+			if err != nil || len(report.Removed) != 0 {
+				t.Fatalf("FsStore.GC() = %v, %v, want nothing removed", report.Removed, err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal("failed to stat file", err)
+			}
+			if got := accessTime(info); !got.Equal(used) {
+				t.Errorf("FsStore.GC() changed the access time to %v, want %v", got, used)
+			}
+
+			// the second run still sees when the file was really used
+			clock.Advance(time.Hour * 25)
+			report, err = c.GC(ctx)
+			if err != nil || !reflect.DeepEqual(report.Removed, []string{"test_key"}) {
+				t.Errorf("FsStore.GC() second run = %v, %v, want [test_key]", report.Removed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package persist
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generationKey is the key, relative to a GenerationStore's name, where its generation counter is stored
+const generationKey = "generation"
+
+// GenerationStore is a Store that folds a generation counter into every key. The counter is kept in the backing store
+// so every process sharing the store sees the same generation. Calling Invalidate bumps the generation, which orphans
+// every entry written under the previous generation in O(1) without scanning keys. Orphaned entries are never read
+// again and are left for the backing store's TTL or garbage collection to reclaim. The counter is an ordinary key, so
+// the backing store may evict it. A GenerationStore never moves back to an earlier generation than one it has seen, if
+// the counter is missing or behind it keeps using the last generation it saw and writes it back. Processes that have
+// not seen a later generation still start over at generation 0, so the counter is best kept in a store that does not
+// evict keys.
+type GenerationStore struct {
+	store   Store
+	name    string
+	refresh time.Duration
+	clock   Clock
+
+	mu         sync.Mutex
+	generation uint64
+	fetchedAt  time.Time
+}
+
+// Generational creates a new GenerationStore. All keys are scoped under the provided name, and the generation
+// counter is re-read from the backing store at most once per refresh interval. A refresh of zero re-reads the
+// counter on every call, this keeps every process perfectly in sync at the cost of an extra read per call. The refresh
+// interval is measured with the clock set by WithClock.
+func Generational(store Store, name string, refresh time.Duration, opts ...StoreOption) *GenerationStore {
+	o := storeOptionsFrom(opts)
+	return &GenerationStore{
+		store:   store,
+		name:    name,
+		refresh: refresh,
+		clock:   o.clock,
+	}
+}
+
+// Get gets the key for the current generation from the underlying store
+func (s *GenerationStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return s.store.Get(ctx, prefix+key)
+}
+
+// Set sets the key for the current generation in the underlying store
+func (s *GenerationStore) Set(ctx context.Context, key string, val []byte) error {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.store.Set(ctx, prefix+key, val)
+}
+
+// GetEnvelope gets the envelope of the key for the current generation from the underlying store
+func (s *GenerationStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetEnvelope(ctx, s.store, prefix+key)
+}
+
+// SetEnvelope sets the envelope of the key for the current generation in the underlying store
+func (s *GenerationStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	return SetEnvelope(ctx, s.store, prefix+key, env)
+}
+
+// Delete removes the key for the current generation from the underlying store. If the underlying store does not
+// implement Deleter ErrNotSupported will be returned
+func (s *GenerationStore) Delete(ctx context.Context, key string) error {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	return DeleteKey(ctx, s.store, prefix+key)
+}
+
+// Touch touches the key for the current generation in the underlying store. If the underlying store does not
+// implement Toucher ErrNotSupported will be returned
+func (s *GenerationStore) Touch(ctx context.Context, key string) error {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	return TouchKey(ctx, s.store, prefix+key)
+}
+
+// List returns every key in the current generation that starts with the provided prefix. The returned keys do not
+// include the name or generation. If the underlying store does not implement Lister ErrNotSupported will be returned
+func (s *GenerationStore) List(ctx context.Context, prefix string) ([]string, error) {
+	genPrefix, err := s.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ListKeys(ctx, s.store, genPrefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], genPrefix)
+	}
+
+	return keys, nil
+}
+
+// TryLock acquires the lock for the key in the current generation from the underlying store. If the underlying store
+// does not implement Locker ErrNotSupported will be returned
+func (s *GenerationStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	prefix, err := s.prefix(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return TryLock(ctx, s.store, prefix+key, ttl)
+}
+
+// Generation returns the current generation, re-reading it from the backing store if the refresh interval has passed
+func (s *GenerationStore) Generation(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fetchedAt.IsZero() && s.clock.Now().Sub(s.fetchedAt) < s.refresh {
+		return s.generation, nil
+	}
+
+	generation, err := s.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	s.generation = generation
+	s.fetchedAt = s.clock.Now()
+	return generation, nil
+}
+
+// Invalidate bumps the generation in the backing store, orphaning every entry written under the previous generation.
+// Other processes will see the new generation once their refresh interval has passed. If multiple processes
+// invalidate at the same time they may bump to the same generation, the old entries are still orphaned either way.
+func (s *GenerationStore) Invalidate(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	generation, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	generation++
+	err = s.store.Set(ctx, s.counterKey(), []byte(strconv.FormatUint(generation, 10)))
+	if err != nil {
+		return err
+	}
+
+	s.generation = generation
+	s.fetchedAt = s.clock.Now()
+	return nil
+}
+
+// load reads the generation counter from the backing store, a missing counter is generation 0. If the counter is
+// behind the last generation seen, because it was evicted or rewritten by a process that had not seen the later
+// generations, the last generation seen is used and written back so the store never goes back to entries it already
+// orphaned. s.mu must be held
+func (s *GenerationStore) load(ctx context.Context) (uint64, error) {
+	raw, _, err := s.store.Get(ctx, s.counterKey())
+	if err != nil {
+		return 0, err
+	}
+
+	var generation uint64
+	if raw != nil {
+		generation, err = strconv.ParseUint(string(raw), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w | invalid generation %q", ErrCorrupt, raw)
+		}
+	}
+	if generation < s.generation {
+		// restoring the counter is best effort, it's tried again on the next load if it fails
+		_ = s.store.Set(ctx, s.counterKey(), []byte(strconv.FormatUint(s.generation, 10)))
+		return s.generation, nil
+	}
+
+	return generation, nil
+}
+
+// counterKey returns the key of the generation counter in the backing store
+func (s *GenerationStore) counterKey() string {
+	return s.name + NamespaceSeparator + generationKey
+}
+
+// prefix returns the prefix for all keys in the current generation
+func (s *GenerationStore) prefix(ctx context.Context) (string, error) {
+	generation, err := s.Generation(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return s.name + NamespaceSeparator + strconv.FormatUint(generation, 10) + NamespaceSeparator, nil
+}
@@ -0,0 +1,142 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGenerationStore_Invalidate(t *testing.T) {
+	ctx := context.Background()
+	backing := NewFsStore(t.TempDir(), true)
+	s := Generational(backing, "svc-a", 0)
+
+	if err := s.Set(ctx, "test", []byte("value")); err != nil {
+		t.Fatal("GenerationStore.Set() error", err)
+	}
+	got, _, err := s.Get(ctx, "test")
+	if err != nil || string(got) != "value" {
+		t.Errorf("GenerationStore.Get() = %s, %v, want value", got, err)
+	}
+
+	if err := s.Invalidate(ctx); err != nil {
+		t.Fatal("GenerationStore.Invalidate() error", err)
+	}
+	got, lastUpdate, err := s.Get(ctx, "test")
+	if err != nil || got != nil || !lastUpdate.IsZero() {
+		t.Errorf("GenerationStore.Get() after Invalidate() = %s, %v, %v, want miss", got, lastUpdate, err)
+	}
+
+	// another process sharing the backing store should see the new generation
+	other := Generational(backing, "svc-a", time.Hour)
+	generation, err := other.Generation(ctx)
+	if err != nil || generation != 1 {
+		t.Errorf("GenerationStore.Generation() = %d, %v, want 1", generation, err)
+	}
+
+	// the old entry is orphaned, not deleted
+	raw, _, _ := backing.Get(ctx, "svc-a/0/test")
+	if string(raw) != "value" {
+		t.Errorf("GenerationStore.Invalidate() old entry = %s, want value", raw)
+	}
+}
+
+func TestGenerationStore_Generation(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   *testStore
+		want    uint64
+		wantErr error
+	}{
+		{
+			"missing generation",
+			&testStore{data: map[string]rawData{}},
+			0,
+			nil,
+		},
+		{
+			"stored generation",
+			&testStore{data: map[string]rawData{"svc-a/generation": {Raw: []byte("12")}}},
+			12,
+			nil,
+		},
+		{
+			"invalid generation",
+			&testStore{data: map[string]rawData{"svc-a/generation": {Raw: []byte("twelve")}}},
+			0,
+			ErrCorrupt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Generational(tt.store, "svc-a", time.Hour).Generation(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("GenerationStore.Generation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GenerationStore.Generation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerationStore_refresh(t *testing.T) {
+	ctx := context.Background()
+	backing := &testStore{data: map[string]rawData{}}
+	clock := &testClock{now: time.Now()}
+	s := Generational(backing, "svc-a", time.Hour, WithClock(clock))
+
+	if _, err := s.Generation(ctx); err != nil {
+		t.Fatal("GenerationStore.Generation() error", err)
+	}
+
+	// a bump by another process is not seen until the refresh interval has passed
+	_ = Generational(backing, "svc-a", 0).Invalidate(ctx)
+	if got, _ := s.Generation(ctx); got != 0 {
+		t.Errorf("GenerationStore.Generation() = %d, want cached 0", got)
+	}
+
+	clock.Advance(time.Hour)
+	if got, _ := s.Generation(ctx); got != 1 {
+		t.Errorf("GenerationStore.Generation() after refresh = %d, want 1", got)
+	}
+}
+
+func TestGenerationStore_evicted(t *testing.T) {
+	ctx := context.Background()
+	backing := &testStore{data: map[string]rawData{}}
+	s := Generational(backing, "svc-a", 0)
+	_ = s.Invalidate(ctx)
+	_ = s.Invalidate(ctx)
+
+	// the counter is evicted, the store keeps using the last generation it saw and writes it back
+	delete(backing.data, "svc-a/generation")
+	if err := s.Set(ctx, "test", []byte("value")); err != nil {
+		t.Errorf("GenerationStore.Set() after eviction error = %v", err)
+	}
+	if _, ok := backing.data["svc-a/2/test"]; !ok {
+		t.Errorf("GenerationStore.Set() after eviction keys = %v, want svc-a/2/test", backing.data)
+	}
+	if got := string(backing.data["svc-a/generation"].Raw); got != "2" {
+		t.Errorf("GenerationStore counter after eviction = %q, want 2", got)
+	}
+
+	// an older counter written by a process that did not see the later generations is ignored and rewritten
+	backing.data["svc-a/generation"] = rawData{Raw: []byte("1")}
+	if got, err := s.Generation(ctx); err != nil || got != 2 {
+		t.Errorf("GenerationStore.Generation() = %d, %v, want 2", got, err)
+	}
+	if got := string(backing.data["svc-a/generation"].Raw); got != "2" {
+		t.Errorf("GenerationStore counter after an older write = %q, want 2", got)
+	}
+
+	// invalidating bumps past the last generation seen
+	delete(backing.data, "svc-a/generation")
+	if err := s.Invalidate(ctx); err != nil {
+		t.Fatal("GenerationStore.Invalidate() error", err)
+	}
+	if got, err := s.Generation(ctx); err != nil || got != 3 {
+		t.Errorf("GenerationStore.Generation() after Invalidate() = %d, %v, want 3", got, err)
+	}
+}
@@ -0,0 +1,326 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Integrity is an algorithm an IntegrityStore uses to verify values
+type Integrity byte
+
+const (
+	// CRC32C checksums values with CRC-32 using the Castagnoli polynomial, it catches truncated and corrupted values
+	CRC32C Integrity = iota + 1
+
+	// XXHash checksums values with 64-bit xxHash, it's faster than CRC32C on large values
+	XXHash
+
+	// HMACSHA256 authenticates values with HMAC-SHA256, unlike the checksums it also detects values that were
+	// deliberately modified by someone without the key
+	HMACSHA256
+)
+
+// String returns the name of the integrity algorithm
+func (i Integrity) String() string {
+	switch i {
+	case CRC32C:
+		return "crc32c"
+	case XXHash:
+		return "xxhash"
+	case HMACSHA256:
+		return "hmac-sha256"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(i))
+	}
+}
+
+// integrityMagic starts the header of every value written by an IntegrityStore
+var integrityMagic = []byte{0xff, 'c', 'k'}
+
+// crc32cTable is the CRC-32 table for the Castagnoli polynomial
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// IntegrityStore is a Store that writes a checksum or HMAC with each value and verifies it when the value is read.
+// Values that fail verification cause Get to return ErrCorrupt, which Data treats as a cache miss.
+type IntegrityStore struct {
+	store  Store
+	algo   Integrity
+	key    []byte
+	clock  Clock
+	legacy bool
+}
+
+// ChecksumOption configures an IntegrityStore created with Checksum. WithLegacyValues returns one
+type ChecksumOption interface {
+	applyChecksum(*checksumOptions)
+}
+
+// checksumOptionFunc is a ChecksumOption that sets a field of checksumOptions
+type checksumOptionFunc func(*checksumOptions)
+
+func (f checksumOptionFunc) applyChecksum(opts *checksumOptions) {
+	f(opts)
+}
+
+// checksumOptions holds the configuration set by each ChecksumOption
+type checksumOptions struct {
+	legacyValues bool
+}
+
+// WithLegacyValues makes a checksumming IntegrityStore return values written before the store was wrapped, which
+// have no checksum, without verifying them. It can be used while an existing cache is migrated to checksums. Stores
+// created with Authenticate never return values without an HMAC
+func WithLegacyValues() ChecksumOption {
+	return checksumOptionFunc(func(opts *checksumOptions) {
+		opts.legacyValues = true
+	})
+}
+
+// Checksum creates a new IntegrityStore that checksums values written to store with algo, which must be CRC32C or
+// XXHash. Values without a checksum, like those written before the store was wrapped, are reported as corrupt unless
+// WithLegacyValues is passed
+func Checksum(store Store, algo Integrity, opts ...ChecksumOption) *IntegrityStore {
+	var o checksumOptions
+	for _, opt := range opts {
+		opt.applyChecksum(&o)
+	}
+
+	return &IntegrityStore{
+		store:  store,
+		algo:   algo,
+		clock:  SystemClock{},
+		legacy: o.legacyValues,
+	}
+}
+
+// Authenticate creates a new IntegrityStore that authenticates values written to store with an HMAC-SHA256 of the
+// store key, the value and its envelope metadata. Since anyone with access to the store could write a value without
+// an HMAC, values without one are reported as corrupt. The store's clock is used to timestamp the authenticated
+// metadata, so it should match the clock of the underlying store
+func Authenticate(store Store, key []byte, opts ...StoreOption) *IntegrityStore {
+	o := storeOptionsFrom(opts)
+	return &IntegrityStore{
+		store: store,
+		algo:  HMACSHA256,
+		key:   key,
+		clock: o.clock,
+	}
+}
+
+// Get gets the key from the underlying store and verifies it. If the value fails verification ErrCorrupt is returned
+func (s *IntegrityStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope gets the envelope of the key from the underlying store and verifies its value. If the value fails
+// verification ErrCorrupt is returned
+func (s *IntegrityStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	env, err := GetEnvelope(ctx, s.store, key)
+	if err != nil || env == nil {
+		return nil, err
+	}
+
+	meta, val, err := s.verify(key, env.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w | %s", ErrCorrupt, err)
+	}
+
+	if meta != nil {
+		// the underlying store's metadata is not authenticated, so it's replaced with the metadata covered by the HMAC
+		env.Created, env.Updated, env.TTL = meta.Created, meta.Updated, meta.TTL
+		env.Codec, env.Schema = meta.Codec, meta.Schema
+	}
+	env.Value = val
+	env.Flags &^= FlagChecksummed
+	return env, nil
+}
+
+// Set writes the value to the underlying store along with its checksum or HMAC
+func (s *IntegrityStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope writes the envelope to the underlying store with a checksum or HMAC prepended to its value. A checksum
+// only covers the value. An HMAC also covers the envelope's times, TTL, codec and schema, which are written alongside
+// it and returned in place of the underlying store's metadata when the value is read
+func (s *IntegrityStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	checked := *env
+	var meta []byte
+	if s.algo == HMACSHA256 {
+		checked.stamp(s.clock.Now())
+
+		var err error
+		meta, err = (&Envelope{
+			Created: checked.Created,
+			Updated: checked.Updated,
+			TTL:     checked.TTL,
+			Codec:   checked.Codec,
+			Schema:  checked.Schema,
+		}).MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+
+	sum, err := s.sum(s.algo, key, meta, env.Value)
+	if err != nil {
+		return err
+	}
+
+	raw := append(append([]byte{}, integrityMagic...), byte(s.algo))
+	raw = append(raw, sum...)
+	if meta != nil {
+		raw = binary.BigEndian.AppendUint32(raw, uint32(len(meta)))
+		raw = append(raw, meta...)
+	}
+
+	checked.Value = append(raw, env.Value...)
+	checked.Flags |= FlagChecksummed
+	return SetEnvelope(ctx, s.store, key, &checked)
+}
+
+// Delete removes the key from the underlying store. If the underlying store does not implement Deleter
+// ErrNotSupported will be returned
+func (s *IntegrityStore) Delete(ctx context.Context, key string) error {
+	return DeleteKey(ctx, s.store, key)
+}
+
+// Touch touches the key in the underlying store. If the underlying store does not implement Toucher ErrNotSupported
+// will be returned. Since an HMAC covers the last update time, a store created with Authenticate touches a value by
+// verifying it and writing it again. If the key is missing no error will be returned
+func (s *IntegrityStore) Touch(ctx context.Context, key string) error {
+	if s.algo != HMACSHA256 {
+		return TouchKey(ctx, s.store, key)
+	}
+	if _, ok := s.store.(Toucher); !ok {
+		return ErrNotSupported
+	}
+
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return err
+	}
+
+	return s.SetEnvelope(ctx, key, env)
+}
+
+// List returns the keys in the underlying store that start with the provided prefix. If the underlying store does
+// not implement Lister ErrNotSupported will be returned
+func (s *IntegrityStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return ListKeys(ctx, s.store, prefix)
+}
+
+// TryLock acquires the lock for the key from the underlying store. If the underlying store does not implement Locker
+// ErrNotSupported will be returned
+func (s *IntegrityStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	return TryLock(ctx, s.store, key, ttl)
+}
+
+// verify checks the header of raw and returns the value it holds. Values written with an HMAC also return the
+// metadata the HMAC covers, checksummed values return nil metadata. Raw is laid out as
+//
+//	magic (3) | algorithm (1) | checksum or HMAC | HMAC only: metadata length (4) | metadata | value
+func (s *IntegrityStore) verify(key string, raw []byte) (*Envelope, []byte, error) {
+	if !bytes.HasPrefix(raw, integrityMagic) || len(raw) == len(integrityMagic) {
+		if s.algo == HMACSHA256 {
+			return nil, nil, fmt.Errorf("value is not authenticated")
+		}
+		if !s.legacy {
+			return nil, nil, fmt.Errorf("value has no checksum")
+		}
+
+		return nil, raw, nil
+	}
+
+	algo := Integrity(raw[len(integrityMagic)])
+	if (algo == HMACSHA256) != (s.algo == HMACSHA256) {
+		return nil, nil, fmt.Errorf("value was written with %s, want %s", algo, s.algo)
+	}
+
+	size := sumSize(algo)
+	start := len(integrityMagic) + 1
+	if size == 0 {
+		return nil, nil, fmt.Errorf("unknown integrity algorithm %s", algo)
+	}
+	if len(raw) < start+size {
+		return nil, nil, fmt.Errorf("value is truncated")
+	}
+
+	sum, val := raw[start:start+size], raw[start+size:]
+	var meta []byte
+	if algo == HMACSHA256 {
+		if len(val) < 4 || uint64(len(val)-4) < uint64(binary.BigEndian.Uint32(val)) {
+			return nil, nil, fmt.Errorf("value is truncated")
+		}
+		metaLen := binary.BigEndian.Uint32(val)
+		meta, val = val[4:4+metaLen], val[4+metaLen:]
+	}
+
+	want, err := s.sum(algo, key, meta, val)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(sum, want) {
+		return nil, nil, fmt.Errorf("%s mismatch", algo)
+	}
+	if meta == nil {
+		return nil, val, nil
+	}
+
+	env := &Envelope{}
+	err = env.UnmarshalBinary(meta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata: %s", err)
+	}
+
+	return env, val, nil
+}
+
+// sum returns the checksum or HMAC of the value using the provided algorithm. Only an HMAC covers the key and
+// metadata
+func (s *IntegrityStore) sum(algo Integrity, key string, meta, val []byte) ([]byte, error) {
+	switch algo {
+	case CRC32C:
+		return binary.BigEndian.AppendUint32(nil, crc32.Checksum(val, crc32cTable)), nil
+	case XXHash:
+		return binary.BigEndian.AppendUint64(nil, xxhash.Sum64(val)), nil
+	case HMACSHA256:
+		// the key and metadata are length prefixed so the boundaries between them and the value can't be shifted
+		mac := hmac.New(sha256.New, s.key)
+		_, _ = mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(key))))
+		_, _ = mac.Write([]byte(key))
+		_, _ = mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(meta))))
+		_, _ = mac.Write(meta)
+		_, _ = mac.Write(val)
+		return mac.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("unknown integrity algorithm %s", algo)
+	}
+}
+
+// sumSize returns the length of the checksum or HMAC written by algo, unknown algorithms have a size of 0
+func sumSize(algo Integrity) int {
+	switch algo {
+	case CRC32C:
+		return crc32.Size
+	case XXHash:
+		return 8
+	case HMACSHA256:
+		return sha256.Size
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,223 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIntegrityStore(t *testing.T) {
+	value := []byte(`{"name":"cachin"}`)
+	hmacStore := func(s Store) *IntegrityStore { return Authenticate(s, []byte("secret")) }
+
+	tests := []struct {
+		name    string
+		store   func(Store) *IntegrityStore
+		modify  func(raw []byte) []byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			"crc32c",
+			func(s Store) *IntegrityStore { return Checksum(s, CRC32C) },
+			nil,
+			value,
+			nil,
+		},
+		{
+			"xxhash",
+			func(s Store) *IntegrityStore { return Checksum(s, XXHash) },
+			nil,
+			value,
+			nil,
+		},
+		{
+			"hmac",
+			hmacStore,
+			nil,
+			value,
+			nil,
+		},
+		{
+			"truncated value",
+			func(s Store) *IntegrityStore { return Checksum(s, CRC32C) },
+			func(raw []byte) []byte { return raw[:len(raw)-3] },
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"truncated header",
+			func(s Store) *IntegrityStore { return Checksum(s, XXHash) },
+			func(raw []byte) []byte { return raw[:len(integrityMagic)+3] },
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"modified value",
+			hmacStore,
+			func(raw []byte) []byte { return bytes.Replace(raw, []byte("cachin"), []byte("hacked"), 1) },
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"unknown algorithm",
+			func(s Store) *IntegrityStore { return Checksum(s, CRC32C) },
+			func(raw []byte) []byte {
+				raw[len(integrityMagic)] = 100
+				return raw
+			},
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"legacy value with checksum",
+			func(s Store) *IntegrityStore { return Checksum(s, XXHash) },
+			func([]byte) []byte { return value },
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"only the magic",
+			func(s Store) *IntegrityStore { return Checksum(s, CRC32C) },
+			func([]byte) []byte { return integrityMagic },
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"legacy values allowed",
+			func(s Store) *IntegrityStore { return Checksum(s, XXHash, WithLegacyValues()) },
+			func([]byte) []byte { return value },
+			value,
+			nil,
+		},
+		{
+			"modified metadata",
+			hmacStore,
+			func(raw []byte) []byte {
+				// the TTL of the authenticated metadata follows the header, the algorithm and the HMAC
+				raw[len(integrityMagic)+1+sha256.Size+4+22]++
+				return raw
+			},
+			nil,
+			ErrCorrupt,
+		},
+		{
+			"legacy value with hmac",
+			hmacStore,
+			func([]byte) []byte { return value },
+			nil,
+			ErrCorrupt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			underlying := NewMemoryStore(Forever, 0)
+			s := tt.store(underlying)
+			if err := s.Set(ctx, "test", value); err != nil {
+				t.Fatalf("IntegrityStore.Set() error = %v", err)
+			}
+			if tt.modify != nil {
+				raw, _, _ := underlying.Get(ctx, "test")
+				_ = underlying.Set(ctx, "test", tt.modify(raw))
+			}
+
+			got, _, err := s.Get(ctx, "test")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("IntegrityStore.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("IntegrityStore.Get() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegrityStore_hmac(t *testing.T) {
+	ctx := context.Background()
+	underlying := NewMemoryStore(Forever, 0)
+	_ = Authenticate(underlying, []byte("secret")).Set(ctx, "a", []byte("a"))
+
+	// a value written with another key, or moved from another store key, must not verify
+	_, _, err := Authenticate(underlying, []byte("other")).Get(ctx, "a")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("IntegrityStore.Get() with the wrong key error = %v, want %v", err, ErrCorrupt)
+	}
+
+	raw, _, _ := underlying.Get(ctx, "a")
+	_ = underlying.Set(ctx, "b", raw)
+	_, _, err = Authenticate(underlying, []byte("secret")).Get(ctx, "b")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("IntegrityStore.Get() moved value error = %v, want %v", err, ErrCorrupt)
+	}
+
+	// a checksum can be recomputed by anyone, so it must not be accepted in place of an HMAC
+	_ = Checksum(underlying, CRC32C).Set(ctx, "c", []byte("c"))
+	_, _, err = Authenticate(underlying, []byte("secret")).Get(ctx, "c")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("IntegrityStore.Get() checksummed value error = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestIntegrityStore_hmacMetadata(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	underlying := NewMemoryStore(Forever, 0, WithClock(clock))
+	s := Authenticate(underlying, []byte("secret"), WithClock(clock))
+	written := clock.Now()
+	if err := s.SetEnvelope(ctx, "test", &Envelope{Value: []byte("value"), TTL: time.Minute, Schema: "v1"}); err != nil {
+		t.Fatal("IntegrityStore.SetEnvelope() error", err)
+	}
+
+	// the metadata kept by the underlying store is not trusted, so changing it has no effect. The underlying store
+	// expires the value after its TTL, so it's changed before then
+	clock.Advance(time.Second * 30)
+	raw, _ := underlying.GetEnvelope(ctx, "test")
+	raw.TTL, raw.Schema = Forever, "v2"
+	if err := underlying.SetEnvelope(ctx, "test", raw); err != nil {
+		t.Fatal("MemoryStore.SetEnvelope() error", err)
+	}
+
+	env, err := s.GetEnvelope(ctx, "test")
+	if err != nil {
+		t.Fatal("IntegrityStore.GetEnvelope() error", err)
+	}
+	if !env.Updated.Equal(written) || env.TTL != time.Minute || env.Schema != "v1" || string(env.Value) != "value" {
+		t.Errorf("IntegrityStore.GetEnvelope() = %+v, want the authenticated metadata", env)
+	}
+
+	// touching the value authenticates its new update time
+	if err := s.Touch(ctx, "test"); err != nil {
+		t.Fatal("IntegrityStore.Touch() error", err)
+	}
+	env, err = s.GetEnvelope(ctx, "test")
+	if err != nil || !env.Updated.Equal(clock.Now()) || !env.Created.Equal(written) {
+		t.Errorf("IntegrityStore.GetEnvelope() after Touch() = %+v, %v, want updated at %v", env, err, clock.Now())
+	}
+}
+
+func TestData_Load_corrupt(t *testing.T) {
+	ctx := context.Background()
+	underlying := NewMemoryStore(Forever, 0)
+	store := Checksum(underlying, CRC32C)
+	cached := NewData[string](store, "test")
+	_ = cached.Set(ctx, "cached")
+
+	raw, _, _ := underlying.Get(ctx, "test")
+	_ = underlying.Set(ctx, "test", raw[:len(raw)-1])
+
+	d := NewData[string](store, "test")
+	err := d.Load(ctx)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Data.Load() error = %v, want %v", err, ErrCorrupt)
+	}
+	if errors.Is(err, ErrExternalCache) {
+		t.Errorf("Data.Load() error = %v, should not be %v", err, ErrExternalCache)
+	}
+	if !d.IsUnset() || d.Get() != "" {
+		t.Errorf("Data.Load() = %s, want the corrupt value to be treated as a miss", d.Get())
+	}
+}
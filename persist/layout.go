@@ -0,0 +1,161 @@
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxShardLevels is the most levels of shard directories a layout uses
+const maxShardLevels = 8
+
+// hashedPrefix starts the name of every file that holds a key too long to be used as a file name
+const hashedPrefix = ".hash-"
+
+// maxNameLen is the longest file name used for a key, most filesystems limit names to 255 bytes. The temporary file a
+// value is written to is shortened to fit, see tempName
+const maxNameLen = 255
+
+// WithShardedLayout makes an FsStore, or an FSReadOnlyStore reading a copy of one, spread its files across nested
+// directories named after the hash of each key, levels deep. Each level is named with two hex characters so it has
+// at most 256 subdirectories, 2 levels is enough to keep directories small for millions of keys. At most 8 levels
+// are used. Changing the layout of an existing store orphans the values already in it
+func WithShardedLayout(levels int) LayoutOption {
+	return LayoutOption{levels: levels}
+}
+
+// LayoutOption sets how many levels of shard directories an FsStore or FSReadOnlyStore uses, it implements both
+// FsOption and ReadOnlyOption
+type LayoutOption struct {
+	levels int
+}
+
+func (o LayoutOption) applyFs(opts *fsOptions) {
+	opts.shardLevels = o.levels
+}
+
+func (o LayoutOption) applyReadOnly(opts *readOnlyOptions) {
+	opts.shardLevels = o.levels
+}
+
+// layout maps keys to the paths of the files that hold them. Keys whose file name would be longer than maxNameLen
+// are stored in a file named after the key's hash, so the key has to be kept in the file's Envelope
+type layout struct {
+	useSafeKey  bool
+	shardLevels int
+}
+
+// newLayout creates a layout with the shard levels clamped to the supported range
+func newLayout(useSafeKey bool, shardLevels int) layout {
+	if shardLevels < 0 {
+		shardLevels = 0
+	}
+	if shardLevels > maxShardLevels {
+		shardLevels = maxShardLevels
+	}
+
+	return layout{
+		useSafeKey:  useSafeKey,
+		shardLevels: shardLevels,
+	}
+}
+
+// path returns the slash separated path of the file that holds key, relative to the store's root directory
+func (l layout) path(key string) string {
+	name := key
+	if l.useSafeKey {
+		name = SafeKey(key)
+	}
+	if l.isHashed(name) {
+		name = hashedPrefix + keyHash(key)
+	}
+	if l.shardLevels == 0 {
+		return path.Clean(name)
+	}
+
+	hash := keyHash(key)
+	parts := make([]string, 0, l.shardLevels+1)
+	for i := 0; i < l.shardLevels; i++ {
+		parts = append(parts, hash[i*2:i*2+2])
+	}
+
+	return path.Join(append(parts, name)...)
+}
+
+// key reverses path, returning the key held by the file at rel. Files named after a hash report hashed, their key
+// has to be read from the file's Envelope and checked with path. If the file could not have been written with this
+// layout false is returned
+func (l layout) key(rel string) (key string, hashed bool, ok bool) {
+	name := rel
+	if l.shardLevels > 0 {
+		parts := strings.SplitN(rel, "/", l.shardLevels+1)
+		if len(parts) <= l.shardLevels {
+			return "", false, false
+		}
+		name = parts[l.shardLevels]
+	}
+	if strings.HasPrefix(path.Base(name), hashedPrefix) {
+		return "", true, true
+	}
+
+	key = name
+	if l.useSafeKey {
+		var err error
+		key, err = unsafeKey(name)
+		if err != nil {
+			return "", false, false
+		}
+	}
+
+	// files in the wrong shard, or left behind by a different layout, are not part of the store
+	if l.path(key) != rel {
+		return "", false, false
+	}
+
+	return key, false, true
+}
+
+// isHashed reports whether name is too long to be used as a file name
+func (l layout) isHashed(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if len(part) > maxNameLen {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tempName returns the name of the temporary file a value is written to before it's renamed to name. Only the suffix
+// has to be unique, so name is shortened to keep the temporary file's name within maxNameLen
+func tempName(name, suffix string) string {
+	n := maxNameLen - len(tempPrefix) - 1 - len(suffix)
+	if len(name) > n {
+		// don't split a multibyte character, some filesystems require names to be valid UTF-8
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n]
+	}
+
+	return tempPrefix + name + "-" + suffix
+}
+
+// lockName returns the name of the lock file for key. Lock files always use safe keys, so keys containing path
+// separators don't need nested directories
+func lockName(key string) string {
+	name := SafeKey(key)
+	if len(name)+len(writeLockSuffix) > maxNameLen {
+		return hashedPrefix + keyHash(key)
+	}
+
+	return name
+}
+
+// keyHash returns the hex encoded sha256 hash of key
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
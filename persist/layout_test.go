@@ -0,0 +1,265 @@
+package persist
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+)
+
+func TestLayout_path(t *testing.T) {
+	long := strings.Repeat("k", maxNameLen+1)
+	tests := []struct {
+		name       string
+		useSafeKey bool
+		levels     int
+		key        string
+		want       string
+		wantHashed bool
+	}{
+		{
+			"flat",
+			false,
+			0,
+			"a/one",
+			"a/one",
+			false,
+		},
+		{
+			"safe key",
+			true,
+			0,
+			"a/one",
+			SafeKey("a/one"),
+			false,
+		},
+		{
+			"sharded",
+			true,
+			2,
+			"a/one",
+			shardDirs(keyHash("a/one"), 2) + SafeKey("a/one"),
+			false,
+		},
+		{
+			"long key",
+			false,
+			0,
+			long,
+			hashedPrefix + keyHash(long),
+			true,
+		},
+		{
+			"long safe key",
+			true,
+			1,
+			strings.Repeat("k", maxNameLen),
+			shardDirs(keyHash(strings.Repeat("k", maxNameLen)), 1) + hashedPrefix + keyHash(strings.Repeat("k", maxNameLen)),
+			true,
+		},
+		{
+			"long nested key",
+			false,
+			0,
+			"a/" + long,
+			hashedPrefix + keyHash("a/"+long),
+			true,
+		},
+		{
+			"too many levels",
+			false,
+			maxShardLevels + 1,
+			"one",
+			shardDirs(keyHash("one"), maxShardLevels) + "one",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLayout(tt.useSafeKey, tt.levels)
+			got := l.path(tt.key)
+			if got != tt.want {
+				t.Errorf("layout.path() = %s, want %s", got, tt.want)
+			}
+
+			key, hashed, ok := l.key(got)
+			if !ok || hashed != tt.wantHashed || (!hashed && key != tt.key) {
+				t.Errorf("layout.key() = %s, %v, %v, want %s, %v, true", key, hashed, ok, tt.key, tt.wantHashed)
+			}
+		})
+	}
+}
+
+func TestLayout_key(t *testing.T) {
+	tests := []struct {
+		name       string
+		useSafeKey bool
+		levels     int
+		rel        string
+		wantOK     bool
+	}{
+		{
+			"not a safe key",
+			true,
+			0,
+			"not a safe key",
+			false,
+		},
+		{
+			"wrong shard",
+			false,
+			1,
+			"zz/one",
+			false,
+		},
+		{
+			"not sharded",
+			false,
+			1,
+			"one",
+			false,
+		},
+		{
+			"flat file read with sharding",
+			true,
+			2,
+			SafeKey("one"),
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, ok := newLayout(tt.useSafeKey, tt.levels).key(tt.rel)
+			if ok != tt.wantOK {
+				t.Errorf("layout.key() ok = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFsStore_WithShardedLayout(t *testing.T) {
+	long := strings.Repeat("long/key/", 60)
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := fsys.tempDir(t)
+			c := NewFsStoreFS(fsys.fs, dir, true, WithShardedLayout(2), WithFileLocking())
+
+			keys := []string{"a/one", "a/two", "b/one", long}
+			for _, key := range keys {
+				if err := c.Set(ctx, key, []byte(key)); err != nil {
+					t.Fatalf("FsStore.Set() %q error = %v", key, err)
+				}
+			}
+
+			for _, key := range keys {
+				got, _, err := c.Get(ctx, key)
+				if err != nil || string(got) != key {
+					t.Errorf("FsStore.Get() %q = %s, %v", key, got, err)
+				}
+			}
+
+			got, err := c.List(ctx, "")
+			sort.Strings(got)
+			if err != nil || !reflect.DeepEqual(got, keys) {
+				t.Errorf("FsStore.List() = %v, %v, want %v", got, err, keys)
+			}
+
+			// the same files can be read from a snapshot of the directory
+			snapshot := NewFSReadOnlyStore(afero.NewIOFS(afero.NewBasePathFs(fsys.fs, dir)), true, WithShardedLayout(2))
+			got, err = snapshot.List(ctx, "long/")
+			if err != nil || !reflect.DeepEqual(got, []string{long}) {
+				t.Errorf("FSReadOnlyStore.List() = %v, %v, want [%s]", got, err, long)
+			}
+			val, _, err := snapshot.Get(ctx, long)
+			if err != nil || string(val) != long {
+				t.Errorf("FSReadOnlyStore.Get() = %s, %v", val, err)
+			}
+
+			// a flat store sees none of the sharded files
+			got, err = NewFsStoreFS(fsys.fs, dir, true).List(ctx, "")
+			if err != nil || len(got) != 0 {
+				t.Errorf("FsStore.List() flat = %v, %v, want none", got, err)
+			}
+
+			if err := c.Delete(ctx, long); err != nil {
+				t.Errorf("FsStore.Delete() error = %v", err)
+			}
+			if got, _, _ := c.Get(ctx, long); got != nil {
+				t.Errorf("FsStore.Get() after Delete() = %s, want nil", got)
+			}
+		})
+	}
+}
+
+func TestFsStore_longName(t *testing.T) {
+	// names up to 255 bytes have always been written as is, so existing files must still be found under them
+	key := strings.Repeat("k", 230)
+	for _, fsys := range testFilesystems() {
+		t.Run(fsys.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := fsys.tempDir(t)
+			raw, _ := (&Envelope{Updated: time.Now(), Value: []byte("existing")}).MarshalBinary()
+			if err := afero.WriteFile(fsys.fs, filepath.Join(dir, key), raw, 0666); err != nil {
+				t.Fatal("failed to write cache file", err)
+			}
+
+			c := NewFsStoreFS(fsys.fs, dir, false)
+			got, _, err := c.Get(ctx, key)
+			if err != nil || string(got) != "existing" {
+				t.Errorf("FsStore.Get() = %s, %v, want existing", got, err)
+			}
+
+			// the file is rewritten in place even though the temporary file's name has to be shortened
+			if err := c.Set(ctx, key, []byte("updated")); err != nil {
+				t.Fatalf("FsStore.Set() error = %v", err)
+			}
+			entries, err := afero.ReadDir(fsys.fs, dir)
+			if err != nil || len(entries) != 1 || entries[0].Name() != key {
+				t.Errorf("FsStore.Set() files = %v, %v, want only %s", entries, err, key)
+			}
+			got, _, err = c.Get(ctx, key)
+			if err != nil || string(got) != "updated" {
+				t.Errorf("FsStore.Get() after Set() = %s, %v, want updated", got, err)
+			}
+		})
+	}
+}
+
+func TestTempName(t *testing.T) {
+	suffix := strings.Repeat("s", 32)
+	for _, name := range []string{"short", strings.Repeat("k", maxNameLen), strings.Repeat("é", maxNameLen/2)} {
+		got := tempName(name, suffix)
+		if len(got) > maxNameLen || !strings.HasPrefix(got, tempPrefix) || !strings.HasSuffix(got, "-"+suffix) || !utf8.ValidString(got) {
+			t.Errorf("tempName(%s) = %s", name, got)
+		}
+	}
+}
+
+func TestFsStore_TryLock_longKey(t *testing.T) {
+	ctx := context.Background()
+	c := NewFsStore(t.TempDir(), false)
+	unlock, err := c.TryLock(ctx, strings.Repeat("k", 500), time.Second)
+	if err != nil {
+		t.Fatalf("FsStore.TryLock() error = %v", err)
+	}
+	if err := unlock(ctx); err != nil {
+		t.Errorf("FsStore.TryLock() unlock error = %v", err)
+	}
+}
+
+// shardDirs returns the shard directories, with a trailing slash, for a key with the provided hash
+func shardDirs(hash string, levels int) string {
+	var b strings.Builder
+	for i := 0; i < levels; i++ {
+		b.WriteString(hash[i*2:i*2+2] + "/")
+	}
+
+	return b.String()
+}
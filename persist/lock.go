@@ -0,0 +1,45 @@
+package persist
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrLockHeld indicates a lock could not be acquired because it is already held by another caller
+var ErrLockHeld = errors.New("lock is held by another caller")
+
+// Unlock releases a lock acquired with a Locker
+type Unlock func(context.Context) error
+
+// Locker is an optional interface a Store can implement to let multiple processes coordinate who recomputes an
+// expired key. TryLock must not block, if the lock is already held ErrLockHeld should be returned. The ttl bounds
+// how long the lock may be held in case the holder never releases it, stores that release locks automatically when
+// the holder exits may ignore it.
+type Locker interface {
+	TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error)
+}
+
+// TryLock acquires a lock from the store if the store implements Locker, otherwise ErrNotSupported is returned
+func TryLock(ctx context.Context, store Store, key string, ttl time.Duration) (Unlock, error) {
+	l, ok := store.(Locker)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return l.TryLock(ctx, key, ttl)
+}
+
+// lockToken creates a random token that identifies the holder of a lock, so a lock can only be released by the
+// caller that acquired it
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
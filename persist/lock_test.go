@@ -0,0 +1,83 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLocker_TryLock(t *testing.T) {
+	tests := []struct {
+		name   string
+		locker Locker
+	}{
+		{
+			"filesystem",
+			NewFsStore(t.TempDir(), false),
+		},
+		{
+			"redis",
+			newTestRedisStore(t),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			unlock, err := tt.locker.TryLock(ctx, "nested/key", time.Second)
+			if err != nil {
+				t.Fatalf("TryLock() error = %v", err)
+			}
+
+			// the lock is held so a second caller can't acquire it
+			if _, err := tt.locker.TryLock(ctx, "nested/key", time.Second); !errors.Is(err, ErrLockHeld) {
+				t.Errorf("TryLock() error = %v, want %v", err, ErrLockHeld)
+			}
+
+			// other keys are not affected
+			otherUnlock, err := tt.locker.TryLock(ctx, "other", time.Second)
+			if err != nil {
+				t.Errorf("TryLock() other key error = %v", err)
+			} else {
+				_ = otherUnlock(ctx)
+			}
+
+			if err := unlock(ctx); err != nil {
+				t.Errorf("Unlock() error = %v", err)
+			}
+
+			unlock, err = tt.locker.TryLock(ctx, "nested/key", time.Second)
+			if err != nil {
+				t.Errorf("TryLock() after unlock error = %v", err)
+			} else {
+				_ = unlock(ctx)
+			}
+		})
+	}
+}
+
+func TestRedisStore_TryLock_expired(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	s := NewRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	unlock, err := s.TryLock(ctx, "test", time.Millisecond*10)
+	if err != nil {
+		t.Fatal("RedisStore.TryLock() error", err)
+	}
+
+	// once the lock expires it can be acquired by someone else, the original holder must not release it
+	server.FastForward(time.Millisecond * 20)
+	otherUnlock, err := s.TryLock(ctx, "test", time.Second)
+	if err != nil {
+		t.Fatal("RedisStore.TryLock() after expiration error", err)
+	}
+	_ = unlock(ctx)
+
+	if _, err := s.TryLock(ctx, "test", time.Second); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("RedisStore.TryLock() error = %v, want %v", err, ErrLockHeld)
+	}
+	_ = otherUnlock(ctx)
+}
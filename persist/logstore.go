@@ -0,0 +1,874 @@
+package persist
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed indicates a store was used after it was closed
+var ErrClosed = errors.New("store is closed")
+
+// DefaultSegmentSize is the size, in bytes, a LogStore segment can reach before a new one is started if
+// WithSegmentSize is not provided
+const DefaultSegmentSize = 64 << 20
+
+const (
+	// segmentExt ends the name of every LogStore segment file
+	segmentExt = ".seg"
+
+	// compactExt ends the name of the file a segment is compacted into before it's renamed into place
+	compactExt = ".compact"
+
+	// logLockFile is the file a LogStore locks so only one process can open its directory
+	logLockFile = "LOCK"
+
+	// segmentVersion is the version of the segment format
+	segmentVersion = 1
+
+	// segmentHeaderLen is the length of the header at the start of every segment, the magic, version and base id
+	segmentHeaderLen = 3 + 1 + 8
+
+	// recordHeaderLen is the length of the header at the start of every record, the checksum, op, key length and
+	// value length
+	recordHeaderLen = 4 + 1 + 2 + 4
+
+	// maxRecordKeyLen is the longest key that fits in a record
+	maxRecordKeyLen = 1<<16 - 1
+)
+
+// segmentMagic starts every LogStore segment file
+var segmentMagic = []byte{0xff, 'l', 'g'}
+
+const (
+	// opPut records a key being set
+	opPut byte = iota + 1
+
+	// opDelete records a key being deleted
+	opDelete
+)
+
+// WithSegmentSize sets the size, in bytes, a LogStore segment can reach before a new one is started. It also sets
+// how much space overwritten, deleted and expired records must waste before the LogStore compacts itself in the
+// background. If it's not provided DefaultSegmentSize is used
+func WithSegmentSize(bytes int64) LogOption {
+	return logOptionFunc(func(opts *logOptions) {
+		opts.segmentSize = bytes
+	})
+}
+
+// LogOption configures a LogStore. WithClock and WithSegmentSize return one
+type LogOption interface {
+	applyLog(*logOptions)
+}
+
+// logOptionFunc is a LogOption that sets a field of logOptions
+type logOptionFunc func(*logOptions)
+
+func (f logOptionFunc) applyLog(opts *logOptions) {
+	f(opts)
+}
+
+func (o ClockOption) applyLog(opts *logOptions) {
+	opts.clock = o.clock
+}
+
+// logOptions holds the configuration set by each LogOption
+type logOptions struct {
+	clock       Clock
+	segmentSize int64
+}
+
+// LogStore is a Store that appends values to segment files in a single directory, which is much faster than one file
+// per key when there are many small values. An index of every key is kept in memory and rebuilt from the segments
+// when the store is opened. Overwritten, deleted and expired records are dropped by compacting the segments, which
+// happens in the background once enough space is wasted or on demand with Compact. Values whose Envelope TTL has
+// passed are treated as missing.
+//
+// Writes are not synced to disk until a segment is full or the store is closed, so a crash can lose the most recent
+// writes, and can leave a partially written record at the end of the last segment. Every record has a checksum, so
+// when the store is opened a torn tail is detected and truncated. Only one process can open a directory at a time.
+// LogStore is safe for concurrent use.
+type LogStore struct {
+	dir         string
+	clock       Clock
+	segmentSize int64
+
+	mu         sync.RWMutex
+	index      map[string]logEntry
+	segments   map[uint64]*segment
+	active     *segment
+	totalBytes int64
+	liveBytes  int64
+	closed     bool
+
+	compactMu sync.Mutex
+	compactCh chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	lock      *os.File
+}
+
+// logEntry is where the latest record of a key is stored
+type logEntry struct {
+	segment    uint64
+	offset     int64
+	size       int
+	recordSize int64
+	updated    time.Time
+	ttl        time.Duration
+}
+
+// segment is an open segment file
+type segment struct {
+	id   uint64
+	base uint64
+	f    *os.File
+	size int64
+}
+
+// OpenLogStore opens the LogStore in dir, creating it if it does not exist, and rebuilds its index. If another
+// process has the store open ErrLockHeld is returned. The store must be closed with Close
+func OpenLogStore(dir string, opts ...LogOption) (*LogStore, error) {
+	o := logOptions{clock: SystemClock{}, segmentSize: DefaultSegmentSize}
+	for _, opt := range opts {
+		opt.applyLog(&o)
+	}
+
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, logLockFile), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = tryLockFile(lock)
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		_ = lock.Close()
+		return nil, fmt.Errorf("%w | %s is open in another process", err, dir)
+	}
+
+	s := &LogStore{
+		dir:         dir,
+		clock:       o.clock,
+		segmentSize: o.segmentSize,
+		index:       map[string]logEntry{},
+		segments:    map[uint64]*segment{},
+		compactCh:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		lock:        lock,
+	}
+	err = s.load()
+	if err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.compactLoop()
+
+	return s, nil
+}
+
+// Get returns the value of the key. If the key is missing or expired no error will be returned
+func (s *LogStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope returns the envelope of the key. If the key is missing or expired no error will be returned
+func (s *LogStore) GetEnvelope(_ context.Context, key string) (*Envelope, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	return s.read(key)
+}
+
+// Set appends the value to the active segment
+func (s *LogStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and appends it to the active segment
+func (s *LogStore) SetEnvelope(_ context.Context, key string, env *Envelope) error {
+	env = env.clone()
+	env.stamp(s.clock.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	return s.put(key, env)
+}
+
+// Delete appends a record that deletes the key. If the key is missing no error will be returned
+func (s *LogStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+
+	_, err := s.append(opDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	s.apply(opDelete, key, logEntry{})
+	err = s.rotateIfFull()
+	s.maybeCompact()
+	return err
+}
+
+// Touch appends a copy of the key's record with its last update time set to now. If the key is missing or expired
+// no error will be returned
+func (s *LogStore) Touch(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	env, err := s.read(key)
+	if err != nil || env == nil {
+		return err
+	}
+
+	env.Updated = s.clock.Now()
+	return s.put(key, env)
+}
+
+// List returns every key that starts with the provided prefix and has not expired
+func (s *LogStore) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	now := s.clock.Now()
+	var keys []string
+	for key, e := range s.index {
+		if strings.HasPrefix(key, prefix) && !e.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Compact rewrites every segment except the active one, keeping only the latest record of each key that has not
+// been deleted or expired. The store can be read and written while it's compacted
+func (s *LogStore) Compact(ctx context.Context) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// seal the active segment so every record being compacted is immutable
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	if s.active.size > segmentHeaderLen {
+		err := s.rotate()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+
+	var sealed []uint64
+	base := s.active.id
+	files := map[uint64]*os.File{}
+	for id, seg := range s.segments {
+		if id != s.active.id {
+			sealed = append(sealed, id)
+			files[id] = seg.f
+			if seg.base < base {
+				base = seg.base
+			}
+		}
+	}
+	now := s.clock.Now()
+	live := map[string]logEntry{}
+	for key, e := range s.index {
+		if _, ok := files[e.segment]; ok && !e.expired(now) {
+			live[key] = e
+		}
+	}
+	s.mu.Unlock()
+
+	if len(sealed) == 0 {
+		return nil
+	}
+	sort.Slice(sealed, func(i, j int) bool {
+		return sealed[i] < sealed[j]
+	})
+
+	// the compacted segment replaces the newest sealed segment, its header records the oldest segment it replaces,
+	// including segments replaced by earlier compactions, so if the store crashes before the rest are removed they
+	// are removed when it's opened
+	target := sealed[len(sealed)-1]
+	tmpPath := s.segmentPath(target) + compactExt
+	f, moved, err := s.writeCompacted(ctx, tmpPath, target, base, live, files)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return ErrClosed
+	}
+
+	err = os.Rename(tmpPath, s.segmentPath(target))
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	syncDir(s.dir)
+
+	for _, id := range sealed {
+		_ = s.segments[id].f.Close()
+		delete(s.segments, id)
+		if id != target {
+			_ = os.Remove(s.segmentPath(id))
+		}
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.segments[target] = &segment{id: target, base: base, f: f, size: stat.Size()}
+
+	// keys written since the store was unlocked already point to the active segment and are left alone, keys that
+	// were not moved have expired
+	for key, e := range s.index {
+		if _, ok := files[e.segment]; !ok {
+			continue
+		}
+		if m, ok := moved[key]; ok {
+			s.index[key] = m
+		} else {
+			delete(s.index, key)
+		}
+	}
+
+	s.totalBytes, s.liveBytes = 0, 0
+	for _, seg := range s.segments {
+		s.totalBytes += seg.size - segmentHeaderLen
+	}
+	for _, e := range s.index {
+		s.liveBytes += e.recordSize
+	}
+
+	return nil
+}
+
+// Close stops background compaction, syncs the active segment and closes every segment file
+func (s *LogStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.active.f.Sync()
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	// wait for a compaction started with Compact to notice the store is closed
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.closeFiles()
+	return err
+}
+
+// load opens every segment in the stores directory and rebuilds the index from their records. Segments replaced by
+// a compaction that did not finish are removed, and a torn record at the end of the last segment is truncated
+func (s *LogStore) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	bases := map[uint64]uint64{}
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, compactExt) {
+			// a compaction that did not finish
+			_ = os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, base: id, f: f}
+		s.segments[id] = seg
+
+		header := make([]byte, segmentHeaderLen)
+		if _, err := f.ReadAt(header, 0); err == nil && bytesHasSegmentMagic(header) {
+			seg.base = binary.BigEndian.Uint64(header[4:])
+			bases[id] = seg.base
+		}
+	}
+
+	// remove segments that were compacted into a newer segment
+	for id, base := range bases {
+		for _, old := range ids {
+			if old >= base && old < id && s.segments[old] != nil {
+				_ = s.segments[old].f.Close()
+				delete(s.segments, old)
+				_ = os.Remove(s.segmentPath(old))
+			}
+		}
+	}
+
+	var last *segment
+	for _, id := range ids {
+		seg, ok := s.segments[id]
+		if !ok {
+			continue
+		}
+
+		err := s.loadSegment(seg, id == ids[len(ids)-1])
+		if err != nil {
+			return err
+		}
+		last = seg
+	}
+
+	if last == nil {
+		seg, err := s.createSegment(1, 1)
+		if err != nil {
+			return err
+		}
+		last = seg
+	}
+	s.active = last
+
+	return nil
+}
+
+// loadSegment applies every record in the segment to the index. If the segment is the last one a torn or corrupt
+// record at its end is truncated, otherwise the rest of the segment is ignored
+func (s *LogStore) loadSegment(seg *segment, last bool) error {
+	stat, err := seg.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, stat.Size())
+	_, err = seg.f.ReadAt(data, 0)
+	if err != nil && stat.Size() > 0 {
+		return err
+	}
+
+	if len(data) < segmentHeaderLen || !bytesHasSegmentMagic(data) || data[len(segmentMagic)] != segmentVersion {
+		if !last {
+			return fmt.Errorf("%w | segment %s has an invalid header", ErrCorrupt, seg.f.Name())
+		}
+
+		// the store crashed while creating the segment
+		return s.resetSegment(seg)
+	}
+
+	offset := int64(segmentHeaderLen)
+	for offset < int64(len(data)) {
+		op, key, val, n, ok := decodeRecord(data[offset:])
+		if !ok {
+			break
+		}
+
+		e := logEntry{
+			segment:    seg.id,
+			offset:     offset + recordHeaderLen + int64(len(key)),
+			size:       len(val),
+			recordSize: int64(n),
+		}
+		if op == opPut {
+			if env, _, err := unmarshalEnvelopeHeader(val); err == nil {
+				e.updated, e.ttl = env.Updated, env.TTL
+			}
+		}
+		s.apply(op, key, e)
+		s.totalBytes += int64(n)
+		offset += int64(n)
+	}
+
+	if last && offset < int64(len(data)) {
+		err := seg.f.Truncate(offset)
+		if err != nil {
+			return err
+		}
+	}
+	seg.size = offset
+
+	return nil
+}
+
+// resetSegment truncates the segment and rewrites its header
+func (s *LogStore) resetSegment(seg *segment) error {
+	err := seg.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = seg.f.WriteAt(segmentHeader(seg.id), 0)
+	if err != nil {
+		return err
+	}
+
+	seg.size = segmentHeaderLen
+	return seg.f.Sync()
+}
+
+// read reads the key's envelope from its segment, the caller must hold the lock
+func (s *LogStore) read(key string) (*Envelope, error) {
+	e, ok := s.index[key]
+	if !ok || e.expired(s.clock.Now()) {
+		return nil, nil
+	}
+
+	raw := make([]byte, e.size)
+	_, err := s.segments[e.segment].f.ReadAt(raw, e.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{}
+	err = env.UnmarshalBinary(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// put appends the envelope to the active segment and updates the index, the caller must hold the lock
+func (s *LogStore) put(key string, env *Envelope) error {
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	e, err := s.append(opPut, key, raw)
+	if err != nil {
+		return err
+	}
+	e.updated, e.ttl = env.Updated, env.TTL
+
+	s.apply(opPut, key, e)
+	err = s.rotateIfFull()
+	s.maybeCompact()
+	return err
+}
+
+// append writes a record to the end of the active segment and returns where its value was written. The caller must
+// apply the record to the index and then call rotateIfFull, and must hold the lock
+func (s *LogStore) append(op byte, key string, val []byte) (logEntry, error) {
+	if len(key) > maxRecordKeyLen {
+		return logEntry{}, fmt.Errorf("key is longer than %d bytes", maxRecordKeyLen)
+	}
+
+	rec := encodeRecord(op, key, val)
+	seg := s.active
+	_, err := seg.f.WriteAt(rec, seg.size)
+	if err != nil {
+		// don't leave part of the record behind
+		_ = seg.f.Truncate(seg.size)
+		return logEntry{}, err
+	}
+
+	e := logEntry{
+		segment:    seg.id,
+		offset:     seg.size + recordHeaderLen + int64(len(key)),
+		size:       len(val),
+		recordSize: int64(len(rec)),
+	}
+	seg.size += int64(len(rec))
+	s.totalBytes += int64(len(rec))
+
+	return e, nil
+}
+
+// apply updates the index with a record, the caller must hold the lock
+func (s *LogStore) apply(op byte, key string, e logEntry) {
+	if old, ok := s.index[key]; ok {
+		s.liveBytes -= old.recordSize
+		delete(s.index, key)
+	}
+	if op == opPut {
+		s.index[key] = e
+		s.liveBytes += e.recordSize
+	}
+}
+
+// rotateIfFull starts a new segment once the active segment is full. The record that filled it has already been
+// written and indexed, so if a new segment can't be started the write still took effect and the next write tries
+// again. The caller must hold the lock
+func (s *LogStore) rotateIfFull() error {
+	if s.active.size < s.segmentSize {
+		return nil
+	}
+
+	err := s.rotate()
+	if err != nil {
+		return fmt.Errorf("%w | the record was written but a new segment could not be started", err)
+	}
+
+	return nil
+}
+
+// rotate syncs the active segment and starts a new one, the caller must hold the lock
+func (s *LogStore) rotate() error {
+	err := s.active.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	id := s.active.id + 1
+	seg, err := s.createSegment(id, id)
+	if err != nil {
+		return err
+	}
+
+	s.active = seg
+	return nil
+}
+
+// createSegment creates a new segment file with a header that records the oldest segment it replaces
+func (s *LogStore) createSegment(id, base uint64) (*segment, error) {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.WriteAt(segmentHeader(base), 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(s.segmentPath(id))
+		return nil, err
+	}
+	syncDir(s.dir)
+
+	seg := &segment{id: id, base: base, f: f, size: segmentHeaderLen}
+	s.segments[id] = seg
+	return seg, nil
+}
+
+// writeCompacted writes the live records to a new segment file at path and returns the open file along with where
+// each record was written
+func (s *LogStore) writeCompacted(ctx context.Context, path string, id, base uint64, live map[string]logEntry, files map[uint64]*os.File) (*os.File, map[string]logEntry, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, 0, len(live))
+	for key := range live {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := segmentHeader(base)
+	moved := map[string]logEntry{}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			_ = f.Close()
+			return nil, nil, ctx.Err()
+		}
+
+		e := live[key]
+		val := make([]byte, e.size)
+		_, err := files[e.segment].ReadAt(val, e.offset)
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+
+		rec := encodeRecord(opPut, key, val)
+		moved[key] = logEntry{
+			segment:    id,
+			offset:     int64(len(buf)) + recordHeaderLen + int64(len(key)),
+			size:       e.size,
+			recordSize: int64(len(rec)),
+			updated:    e.updated,
+			ttl:        e.ttl,
+		}
+		buf = append(buf, rec...)
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	return f, moved, nil
+}
+
+// maybeCompact starts a background compaction once overwritten, deleted and expired records waste more than a
+// segment and more than the live records take up. The caller must hold the lock
+func (s *LogStore) maybeCompact() {
+	dead := s.totalBytes - s.liveBytes
+	if dead < s.segmentSize || dead <= s.liveBytes {
+		return
+	}
+
+	select {
+	case s.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// compactLoop compacts the store each time maybeCompact asks it to until the store is closed. Errors are ignored,
+// since the next write that wastes space will try again
+func (s *LogStore) compactLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.compactCh:
+			_ = s.Compact(context.Background())
+		}
+	}
+}
+
+// closeFiles closes every segment and releases the directory lock
+func (s *LogStore) closeFiles() {
+	for _, seg := range s.segments {
+		_ = seg.f.Close()
+	}
+	_ = unlockFile(s.lock)
+	_ = s.lock.Close()
+}
+
+// segmentPath returns the path of the segment file with the provided id
+func (s *LogStore) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", id, segmentExt))
+}
+
+// expired reports whether the entry's TTL has passed
+func (e logEntry) expired(now time.Time) bool {
+	return e.ttl != Forever && now.Sub(e.updated) > e.ttl
+}
+
+// segmentHeader returns the header of a segment that replaces every segment from base onwards
+func segmentHeader(base uint64) []byte {
+	header := append(append([]byte{}, segmentMagic...), segmentVersion)
+	return binary.BigEndian.AppendUint64(header, base)
+}
+
+// bytesHasSegmentMagic reports whether b starts with the segment magic
+func bytesHasSegmentMagic(b []byte) bool {
+	return len(b) >= len(segmentMagic) && string(b[:len(segmentMagic)]) == string(segmentMagic)
+}
+
+// encodeRecord encodes a record. Every integer is big endian and the checksum is the CRC-32C of everything after it.
+// The layout is:
+//
+//	checksum (4) | op (1) | key length (2) | value length (4) | key | value
+func encodeRecord(op byte, key string, val []byte) []byte {
+	rec := make([]byte, 4, recordHeaderLen+len(key)+len(val))
+	rec = append(rec, op)
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(key)))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(val)))
+	rec = append(rec, key...)
+	rec = append(rec, val...)
+	binary.BigEndian.PutUint32(rec, crc32.Checksum(rec[4:], crc32cTable))
+
+	return rec
+}
+
+// decodeRecord decodes the record at the start of data and returns its length. If the record is truncated or fails
+// its checksum false is returned
+func decodeRecord(data []byte) (op byte, key string, val []byte, n int, ok bool) {
+	if len(data) < recordHeaderLen {
+		return 0, "", nil, 0, false
+	}
+
+	op = data[4]
+	keyLen := int(binary.BigEndian.Uint16(data[5:]))
+	valLen := int(binary.BigEndian.Uint32(data[7:]))
+	n = recordHeaderLen + keyLen + valLen
+	if (op != opPut && op != opDelete) || valLen < 0 || n > len(data) {
+		return 0, "", nil, 0, false
+	}
+	if crc32.Checksum(data[4:n], crc32cTable) != binary.BigEndian.Uint32(data) {
+		return 0, "", nil, 0, false
+	}
+
+	key = string(data[recordHeaderLen : recordHeaderLen+keyLen])
+	return op, key, data[recordHeaderLen+keyLen : n], n, true
+}
+
+// syncDir syncs the directory so files created or renamed in it survive a crash, not every platform supports this so
+// errors are ignored
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
@@ -0,0 +1,395 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogStore_reopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := openLogStore(t, dir, WithSegmentSize(128))
+
+	for i := 0; i < 10; i++ {
+		for _, key := range []string{"a/one", "a/two", "b/one"} {
+			if err := s.Set(ctx, key, []byte(fmt.Sprintf("%s %d", key, i))); err != nil {
+				t.Fatal("LogStore.Set() error", err)
+			}
+		}
+	}
+	if err := s.Delete(ctx, "a/two"); err != nil {
+		t.Fatal("LogStore.Delete() error", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+
+	s = openLogStore(t, dir, WithSegmentSize(128))
+	for key, want := range map[string][]byte{"a/one": []byte(`a/one 9`), "a/two": nil, "b/one": []byte(`b/one 9`)} {
+		got, _, err := s.Get(ctx, key)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("LogStore.Get() %q = %s, %v, want %s", key, got, err, want)
+		}
+	}
+
+	got, err := s.List(ctx, "a/")
+	if err != nil || !reflect.DeepEqual(got, []string{"a/one"}) {
+		t.Errorf("LogStore.List() = %v, %v, want [a/one]", got, err)
+	}
+}
+
+func TestLogStore_tornTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		tear     func(data []byte) []byte
+		wantLost bool
+	}{
+		{
+			"truncated record",
+			func(data []byte) []byte {
+				return data[:len(data)-3]
+			},
+			true,
+		},
+		{
+			"corrupted record",
+			func(data []byte) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			true,
+		},
+		{
+			"partial header",
+			func(data []byte) []byte {
+				return append(data, 0x01, 0x02)
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			s := openLogStore(t, dir)
+			for _, key := range []string{"one", "two"} {
+				if err := s.Set(ctx, key, []byte(key)); err != nil {
+					t.Fatal("LogStore.Set() error", err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal("LogStore.Close() error", err)
+			}
+
+			path := filepath.Join(dir, fmt.Sprintf("%016x%s", 1, segmentExt))
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal("failed to read segment", err)
+			}
+			if err := os.WriteFile(path, tt.tear(data), 0666); err != nil {
+				t.Fatal("failed to write segment", err)
+			}
+
+			s = openLogStore(t, dir)
+			if got, _, err := s.Get(ctx, "one"); err != nil || string(got) != "one" {
+				t.Errorf("LogStore.Get() before the torn record = %s, %v, want one", got, err)
+			}
+			got, _, err := s.Get(ctx, "two")
+			if err != nil || (got == nil) != tt.wantLost {
+				t.Errorf("LogStore.Get() last record = %s, %v, want lost %v", got, err, tt.wantLost)
+			}
+
+			// new records are written after the last valid record
+			if err := s.Set(ctx, "three", []byte(`three`)); err != nil {
+				t.Fatal("LogStore.Set() error", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal("LogStore.Close() error", err)
+			}
+			s = openLogStore(t, dir)
+			if got, _, err := s.Get(ctx, "three"); err != nil || string(got) != "three" {
+				t.Errorf("LogStore.Get() after recovery = %s, %v, want three", got, err)
+			}
+		})
+	}
+}
+
+func TestLogStore_Compact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := openLogStore(t, dir, WithClock(clock), WithSegmentSize(1<<20))
+
+	val := bytes.Repeat([]byte{'a'}, 100)
+	for i := 0; i < 20; i++ {
+		if err := s.Set(ctx, "overwritten", val); err != nil {
+			t.Fatal("LogStore.Set() error", err)
+		}
+	}
+	for _, key := range []string{"deleted", "kept"} {
+		if err := s.Set(ctx, key, val); err != nil {
+			t.Fatal("LogStore.Set() error", err)
+		}
+	}
+	if err := s.Delete(ctx, "deleted"); err != nil {
+		t.Fatal("LogStore.Delete() error", err)
+	}
+	if err := s.SetEnvelope(ctx, "expired", &Envelope{Value: val, TTL: time.Minute}); err != nil {
+		t.Fatal("LogStore.SetEnvelope() error", err)
+	}
+	clock.Advance(time.Hour)
+	before := dirSize(t, dir)
+
+	if err := s.Compact(ctx); err != nil {
+		t.Fatal("LogStore.Compact() error", err)
+	}
+
+	// the compacted segment holds the two live records, the new active segment is empty
+	if after := dirSize(t, dir); after >= before/5 {
+		t.Errorf("LogStore.Compact() size = %d, before = %d", after, before)
+	}
+	got, err := s.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(got, []string{"kept", "overwritten"}) {
+		t.Errorf("LogStore.List() = %v, %v, want [kept overwritten]", got, err)
+	}
+
+	// writes after compaction are kept along with the compacted records
+	if err := s.Set(ctx, "kept", []byte(`new`)); err != nil {
+		t.Fatal("LogStore.Set() error", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+
+	s = openLogStore(t, dir, WithClock(clock))
+	for key, want := range map[string][]byte{"overwritten": val, "kept": []byte(`new`), "deleted": nil, "expired": nil} {
+		got, _, err := s.Get(ctx, key)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("LogStore.Get() %q = %s, %v, want %s", key, got, err, want)
+		}
+	}
+}
+
+func TestLogStore_interruptedCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := openLogStore(t, dir, WithSegmentSize(64))
+	for i := 0; i < 10; i++ {
+		if err := s.Set(ctx, "test_key", []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal("LogStore.Set() error", err)
+		}
+	}
+
+	// keep copies of the segments compaction replaces
+	old := map[string][]byte{}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	for _, path := range segments {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal("failed to read segment", err)
+		}
+		old[path] = data
+	}
+
+	if err := s.Compact(ctx); err != nil {
+		t.Fatal("LogStore.Compact() error", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+
+	// put the replaced segments back as if the store crashed before removing them
+	for path, data := range old {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := os.WriteFile(path, data, 0666); err != nil {
+				t.Fatal("failed to restore segment", err)
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0000000000000001"+segmentExt+compactExt), []byte(`partial`), 0666); err != nil {
+		t.Fatal("failed to write partial compaction", err)
+	}
+
+	s = openLogStore(t, dir)
+	if got, _, err := s.Get(ctx, "test_key"); err != nil || string(got) != "value 9" {
+		t.Errorf("LogStore.Get() = %s, %v, want value 9", got, err)
+	}
+
+	// only the compacted segment and the active segment are left
+	if got, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(got) != 2 {
+		t.Errorf("OpenLogStore() segments = %v, want 2", got)
+	}
+	if got, _ := filepath.Glob(filepath.Join(dir, "*"+compactExt)); len(got) != 0 {
+		t.Errorf("OpenLogStore() did not remove partial compaction %v", got)
+	}
+}
+
+func TestLogStore_backgroundCompaction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := openLogStore(t, dir, WithSegmentSize(256))
+
+	for i := 0; i < 100; i++ {
+		if err := s.Set(ctx, "test_key", []byte(fmt.Sprintf("value %d", i))); err != nil {
+			t.Fatal("LogStore.Set() error", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+		if len(segments) <= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("LogStore never compacted, %d segments", len(segments))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if got, _, err := s.Get(ctx, "test_key"); err != nil || string(got) != "value 99" {
+		t.Errorf("LogStore.Get() = %s, %v, want value 99", got, err)
+	}
+}
+
+func TestLogStore_expired(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := openLogStore(t, t.TempDir(), WithClock(clock))
+	if err := s.SetEnvelope(ctx, "test_key", &Envelope{Value: []byte(`test`), TTL: time.Minute}); err != nil {
+		t.Fatal("LogStore.SetEnvelope() error", err)
+	}
+
+	clock.Advance(time.Second * 30)
+	if err := s.Touch(ctx, "test_key"); err != nil {
+		t.Fatal("LogStore.Touch() error", err)
+	}
+	clock.Advance(time.Second * 45)
+	if got, ts, err := s.Get(ctx, "test_key"); err != nil || string(got) != "test" || !ts.Equal(clock.Now().Add(-time.Second*45)) {
+		t.Errorf("LogStore.Get() after Touch() = %s, %v, %v", got, ts, err)
+	}
+
+	clock.Advance(time.Minute)
+	if got, _, err := s.Get(ctx, "test_key"); err != nil || got != nil {
+		t.Errorf("LogStore.Get() expired = %s, %v, want nil", got, err)
+	}
+	if got, err := s.List(ctx, ""); err != nil || len(got) != 0 {
+		t.Errorf("LogStore.List() expired = %v, %v, want none", got, err)
+	}
+}
+
+func TestLogStore_singleProcess(t *testing.T) {
+	dir := t.TempDir()
+	s := openLogStore(t, dir)
+
+	_, err := OpenLogStore(dir)
+	if !errors.Is(err, ErrLockHeld) {
+		t.Errorf("OpenLogStore() second open error = %v, want %v", err, ErrLockHeld)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+	openLogStore(t, dir)
+}
+
+func TestLogStore_rotateFailed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := openLogStore(t, dir, WithSegmentSize(128))
+
+	// a file in the way of the next segment makes rotating fail after the record is written
+	next := s.segmentPath(s.active.id + 1)
+	if err := os.WriteFile(next, nil, 0600); err != nil {
+		t.Fatal("failed to block the next segment", err)
+	}
+	if err := s.Set(ctx, "test_key", bytes.Repeat([]byte("a"), 128)); err == nil {
+		t.Fatal("LogStore.Set() expected the rotation to fail")
+	}
+
+	// the record is on disk, so the index must include it
+	got, _, err := s.Get(ctx, "test_key")
+	if err != nil || len(got) != 128 {
+		t.Errorf("LogStore.Get() after failed rotation = %d bytes, %v, want 128", len(got), err)
+	}
+	if s.liveBytes != s.totalBytes {
+		t.Errorf("LogStore live bytes = %d, total bytes = %d, want them equal", s.liveBytes, s.totalBytes)
+	}
+
+	// the next write starts the new segment once it can be created
+	if err := os.Remove(next); err != nil {
+		t.Fatal("failed to unblock the next segment", err)
+	}
+	if err := s.Set(ctx, "other_key", []byte(`other`)); err != nil {
+		t.Fatal("LogStore.Set() error", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+
+	s = openLogStore(t, dir, WithSegmentSize(128))
+	keys, err := s.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"other_key", "test_key"}) {
+		t.Errorf("LogStore.List() after reopen = %v, %v, want [other_key test_key]", keys, err)
+	}
+}
+
+func TestLogStore_closed(t *testing.T) {
+	ctx := context.Background()
+	s := openLogStore(t, t.TempDir())
+	if err := s.Close(); err != nil {
+		t.Fatal("LogStore.Close() error", err)
+	}
+
+	if _, _, err := s.Get(ctx, "test_key"); !errors.Is(err, ErrClosed) {
+		t.Errorf("LogStore.Get() error = %v, want %v", err, ErrClosed)
+	}
+	if err := s.Set(ctx, "test_key", []byte(`test`)); !errors.Is(err, ErrClosed) {
+		t.Errorf("LogStore.Set() error = %v, want %v", err, ErrClosed)
+	}
+	if err := s.Compact(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("LogStore.Compact() error = %v, want %v", err, ErrClosed)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("LogStore.Close() twice error = %v", err)
+	}
+}
+
+// openLogStore opens a LogStore that is closed when the test finishes
+func openLogStore(t *testing.T, dir string, opts ...LogOption) *LogStore {
+	t.Helper()
+	s, err := OpenLogStore(dir, opts...)
+	if err != nil {
+		t.Fatal("OpenLogStore() error", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
+
+// dirSize returns the total size of the files in dir
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal("failed to read dir", err)
+	}
+
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal("failed to stat file", err)
+		}
+		size += info.Size()
+	}
+
+	return size
+}
@@ -0,0 +1,214 @@
+package persist
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTooLarge indicates a value could not be stored because it's larger than the store allows
+var ErrTooLarge = errors.New("value is too large for the store")
+
+// MemoryStore is a Store that keeps cache data in memory. It can be shared by multiple cached functions in one
+// process, used as a fast tier in a MultiStore, or used to back cached functions in tests. Entries expire after their
+// envelope's TTL or the store's ttl, and if the store has a max size the least recently used entries are evicted to make room for new ones.
+// MemoryStore is safe for concurrent use.
+type MemoryStore struct {
+	ttl      time.Duration
+	maxBytes int
+	clock    Clock
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+}
+
+// memoryEntry is a single value held by a MemoryStore
+type memoryEntry struct {
+	key string
+	env *Envelope
+}
+
+// size returns how many bytes the entry counts against a MemoryStore's max size
+func (e *memoryEntry) size() int {
+	return len(e.key) + len(e.env.Value)
+}
+
+// NewMemoryStore creates a new MemoryStore. Entries expire once they are older than ttl, if ttl is Forever entries
+// never expire. Entries written with SetEnvelope whose envelope has a TTL expire after it instead. If maxBytes is greater than 0, the total size of all keys and values is kept under maxBytes by
+// evicting the least recently used entries.
+func NewMemoryStore(ttl time.Duration, maxBytes int, opts ...StoreOption) *MemoryStore {
+	o := storeOptionsFrom(opts)
+	return &MemoryStore{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		clock:    o.clock,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Get returns the value of the key if it exists and has not expired. If the key is missing no error will be returned
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope returns a copy of the key's envelope if it exists and has not expired. If the key is missing no error
+// will be returned
+func (s *MemoryStore) GetEnvelope(_ context.Context, key string) (*Envelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	e := elem.Value.(*memoryEntry)
+	if s.isExpired(e) {
+		s.remove(elem)
+		return nil, nil
+	}
+
+	s.lru.MoveToFront(elem)
+	return e.env.clone(), nil
+}
+
+// Set stores a copy of the value. If the store has a max size, least recently used entries are evicted until the
+// value fits. If the value can never fit ErrTooLarge is returned
+func (s *MemoryStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps a copy of the envelope with the stores clock and stores it. Like Set, least recently used
+// entries are evicted to make room for it
+func (s *MemoryStore) SetEnvelope(_ context.Context, key string, env *Envelope) error {
+	e := &memoryEntry{
+		key: key,
+		env: env.clone(),
+	}
+	e.env.stamp(s.clock.Now())
+	if s.maxBytes > 0 && e.size() > s.maxBytes {
+		return ErrTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+
+	s.entries[key] = s.lru.PushFront(e)
+	s.size += e.size()
+
+	for s.maxBytes > 0 && s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+
+	return nil
+}
+
+// Delete removes the key from the store. If the key is missing no error will be returned
+func (s *MemoryStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+
+	return nil
+}
+
+// Touch resets the last set time of the key, keeping it from expiring. If the key is missing no error will be returned
+func (s *MemoryStore) Touch(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e := elem.Value.(*memoryEntry)
+	if s.isExpired(e) {
+		s.remove(elem)
+		return nil
+	}
+
+	e.env.Updated = s.clock.Now()
+	s.lru.MoveToFront(elem)
+	return nil
+}
+
+// List returns the sorted keys of every non-expired entry that starts with the provided prefix
+func (s *MemoryStore) List(_ context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key, elem := range s.entries {
+		if strings.HasPrefix(key, prefix) && !s.isExpired(elem.Value.(*memoryEntry)) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Sweep removes every expired entry from the store and returns how many were removed. Expired entries are never
+// returned by the store, but they still take up memory until they are read or swept
+func (s *MemoryStore) Sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, elem := range s.entries {
+		if s.isExpired(elem.Value.(*memoryEntry)) {
+			s.remove(elem)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Size returns the total size, in bytes, of every key and value in the store
+func (s *MemoryStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// isExpired reports whether the entry is older than its envelope's TTL, or the store's ttl if the envelope has none
+func (s *MemoryStore) isExpired(e *memoryEntry) bool {
+	ttl := s.ttl
+	if e.env.TTL != Forever {
+		ttl = e.env.TTL
+	}
+	if ttl == Forever {
+		return false
+	}
+
+	return s.clock.Now().Sub(e.env.Updated) > ttl
+}
+
+// remove deletes an entry from the store, the caller must hold the lock
+func (s *MemoryStore) remove(elem *list.Element) {
+	e := s.lru.Remove(elem).(*memoryEntry)
+	delete(s.entries, e.key)
+	s.size -= e.size()
+}
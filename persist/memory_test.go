@@ -0,0 +1,134 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_ttl(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore(time.Minute, 0, WithClock(clock))
+	_ = s.Set(ctx, "old", []byte("old"))
+	clock.Advance(time.Second * 45)
+	_ = s.Set(ctx, "new", []byte("new"))
+	_ = s.Set(ctx, "touched", []byte("touched"))
+	clock.Advance(time.Second * 30)
+	_ = s.Touch(ctx, "touched")
+
+	got, _, err := s.Get(ctx, "old")
+	if err != nil || got != nil {
+		t.Errorf("MemoryStore.Get() expired = %s, %v, want a miss", got, err)
+	}
+
+	keys, _ := s.List(ctx, "")
+	if !reflect.DeepEqual(keys, []string{"new", "touched"}) {
+		t.Errorf("MemoryStore.List() = %v, want [new touched]", keys)
+	}
+
+	clock.Advance(time.Second * 45)
+	if removed := s.Sweep(); removed != 1 {
+		t.Errorf("MemoryStore.Sweep() = %d, want 1", removed)
+	}
+	got, lastUpdate, _ := s.Get(ctx, "touched")
+	if string(got) != "touched" || !lastUpdate.Equal(clock.Now().Add(-time.Second*45)) {
+		t.Errorf("MemoryStore.Get() touched = %s, %v", got, lastUpdate)
+	}
+	if s.Size() != len("touched")*2 {
+		t.Errorf("MemoryStore.Size() = %d, want %d", s.Size(), len("touched")*2)
+	}
+}
+
+func TestMemoryStore_envelopeTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore(time.Minute, 0, WithClock(clock))
+	_ = s.Set(ctx, "default", []byte("default"))
+	_ = s.SetEnvelope(ctx, "short", &Envelope{TTL: time.Second * 10, Value: []byte("short")})
+	_ = s.SetEnvelope(ctx, "long", &Envelope{TTL: time.Hour, Value: []byte("long")})
+
+	clock.Advance(time.Second * 30)
+	keys, _ := s.List(ctx, "")
+	if !reflect.DeepEqual(keys, []string{"default", "long"}) {
+		t.Errorf("MemoryStore.List() = %v, want [default long]", keys)
+	}
+
+	clock.Advance(time.Minute)
+	keys, _ = s.List(ctx, "")
+	if !reflect.DeepEqual(keys, []string{"long"}) {
+		t.Errorf("MemoryStore.List() = %v, want [long]", keys)
+	}
+}
+
+func TestMemoryStore_maxBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		sets     []string
+		gets     []string
+		wantKeys []string
+		wantErr  error
+	}{
+		{
+			"unbounded",
+			0,
+			[]string{"a", "b", "c"},
+			nil,
+			[]string{"a", "b", "c"},
+			nil,
+		},
+		{
+			"evicts oldest",
+			4,
+			[]string{"a", "b", "c"},
+			nil,
+			[]string{"b", "c"},
+			nil,
+		},
+		{
+			"evicts least recently used",
+			4,
+			[]string{"a", "b"},
+			[]string{"a"},
+			[]string{"a", "c"},
+			nil,
+		},
+		{
+			"too large",
+			1,
+			nil,
+			nil,
+			nil,
+			ErrTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewMemoryStore(Forever, tt.maxBytes)
+			for _, key := range tt.sets {
+				_ = s.Set(ctx, key, []byte(key))
+			}
+			for _, key := range tt.gets {
+				_, _, _ = s.Get(ctx, key)
+			}
+
+			// every key and value is 1 byte, so a final set of "c" always needs 2 bytes
+			err := s.Set(ctx, "c", []byte("c"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("MemoryStore.Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			keys, _ := s.List(ctx, "")
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("MemoryStore.List() = %v, want %v", keys, tt.wantKeys)
+			}
+			if tt.maxBytes > 0 && s.Size() > tt.maxBytes {
+				t.Errorf("MemoryStore.Size() = %d, larger than max %d", s.Size(), tt.maxBytes)
+			}
+		})
+	}
+}
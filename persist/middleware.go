@@ -0,0 +1,587 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen indicates a store wrapped with WithCircuitBreaker has failed too many times in a row and is
+	// rejecting calls until its cooldown has elapsed. Returning early lets callers fall back on an in-memory cache
+	// without waiting on a store that is known to be unhealthy.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	// ErrTimeout indicates a store wrapped with WithTimeout did not finish an operation before its deadline
+	ErrTimeout = errors.New("store operation timed out")
+)
+
+// RetryPolicy configures how WithRetry retries failed store operations
+type RetryPolicy struct {
+	// Attempts is the total number of times an operation will be tried, values less than 1 are treated as 1
+	Attempts int
+
+	// Backoff is the delay before the first retry, the delay is doubled after each subsequent failure
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between retries, if it is zero the delay is not capped
+	MaxBackoff time.Duration
+
+	// Jitter randomizes each delay by up to the given fraction of itself (0.0 - 1.0) so that many callers retrying
+	// at once don't all hit the store at the same time
+	Jitter float64
+}
+
+// delay returns how long to wait before the provided retry, retry is zero indexed
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+			break
+		}
+	}
+
+	if p.Jitter > 0 && d > 0 {
+		d += time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// retryStore is a Store that retries failed calls to the underlying store
+type retryStore struct {
+	store  Store
+	policy RetryPolicy
+}
+
+// WithRetry wraps a store so that failed calls are retried according to the provided policy. Waiting
+// between retries is canceled if the context is done
+func WithRetry(store Store, policy RetryPolicy) Store {
+	return &retryStore{
+		store:  store,
+		policy: policy,
+	}
+}
+
+// Get calls Get on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	var (
+		raw        []byte
+		lastUpdate time.Time
+	)
+	err := s.retry(ctx, func() error {
+		var err error
+		raw, lastUpdate, err = s.store.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return raw, lastUpdate, nil
+}
+
+// Set calls Set on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.retry(ctx, func() error {
+		return s.store.Set(ctx, key, val)
+	})
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	var env *Envelope
+	err := s.retry(ctx, func() error {
+		var err error
+		env, err = GetEnvelope(ctx, s.store, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	return s.retry(ctx, func() error {
+		return SetEnvelope(ctx, s.store, key, env)
+	})
+}
+
+// Delete calls Delete on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) Delete(ctx context.Context, key string) error {
+	return s.retry(ctx, func() error {
+		return DeleteKey(ctx, s.store, key)
+	})
+}
+
+// List calls List on the underlying store until it succeeds or runs out of attempts
+func (s *retryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.retry(ctx, func() error {
+		var err error
+		keys, err = ListKeys(ctx, s.store, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Touch calls Touch on the underlying store until it succeeds or runs out of attempts. If the underlying store does
+// not implement Toucher ErrNotSupported will be returned
+func (s *retryStore) Touch(ctx context.Context, key string) error {
+	return s.retry(ctx, func() error {
+		return TouchKey(ctx, s.store, key)
+	})
+}
+
+// TryLock calls TryLock on the underlying store until it succeeds or runs out of attempts. A lock held by another
+// caller is not retried. If the underlying store does not implement Locker ErrNotSupported will be returned
+func (s *retryStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	var unlock Unlock
+	err := s.retry(ctx, func() error {
+		var err error
+		unlock, err = TryLock(ctx, s.store, key, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return unlock, nil
+}
+
+// retry runs fn until it succeeds, the policy runs out of attempts, or the context is done
+func (s *retryStore) retry(ctx context.Context, fn func() error) error {
+	attempts := s.policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			timer := time.NewTimer(s.policy.delay(i - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w | %s", ctx.Err(), err)
+			case <-timer.C:
+			}
+		}
+
+		err = fn()
+		if err == nil || errors.Is(err, ErrNotSupported) || errors.Is(err, ErrLockHeld) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// timeoutStore is a Store that bounds how long each call to the underlying store may take
+type timeoutStore struct {
+	store   Store
+	timeout time.Duration
+}
+
+// WithTimeout wraps a store so that each call fails with ErrTimeout if it does not finish within the
+// provided timeout. The deadline is enforced even if the underlying store ignores its context, in that case the
+// underlying call is left to finish in the background and its result is discarded.
+func WithTimeout(store Store, timeout time.Duration) Store {
+	return &timeoutStore{
+		store:   store,
+		timeout: timeout,
+	}
+}
+
+// Get calls Get on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	var (
+		raw        []byte
+		lastUpdate time.Time
+	)
+	err := s.run(ctx, func(ctx context.Context) error {
+		var err error
+		raw, lastUpdate, err = s.store.Get(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return raw, lastUpdate, nil
+}
+
+// Set calls Set on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.run(ctx, func(ctx context.Context) error {
+		return s.store.Set(ctx, key, val)
+	})
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	var env *Envelope
+	err := s.run(ctx, func(ctx context.Context) error {
+		var err error
+		env, err = GetEnvelope(ctx, s.store, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	return s.run(ctx, func(ctx context.Context) error {
+		return SetEnvelope(ctx, s.store, key, env)
+	})
+}
+
+// Delete calls Delete on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) Delete(ctx context.Context, key string) error {
+	return s.run(ctx, func(ctx context.Context) error {
+		return DeleteKey(ctx, s.store, key)
+	})
+}
+
+// List calls List on the underlying store, giving up once the timeout has elapsed
+func (s *timeoutStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.run(ctx, func(ctx context.Context) error {
+		var err error
+		keys, err = ListKeys(ctx, s.store, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Touch calls Touch on the underlying store, giving up once the timeout has elapsed. If the underlying store does not
+// implement Toucher ErrNotSupported will be returned
+func (s *timeoutStore) Touch(ctx context.Context, key string) error {
+	return s.run(ctx, func(ctx context.Context) error {
+		return TouchKey(ctx, s.store, key)
+	})
+}
+
+// TryLock calls TryLock on the underlying store, giving up once the timeout has elapsed. If the lock is acquired after
+// the timeout it's released in the background. If the underlying store does not implement Locker ErrNotSupported
+// will be returned
+func (s *timeoutStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	locked := make(chan Unlock, 1)
+	err := s.run(ctx, func(ctx context.Context) error {
+		defer close(locked)
+		unlock, err := TryLock(ctx, s.store, key, ttl)
+		if err == nil {
+			locked <- unlock
+		}
+		return err
+	})
+	if err != nil {
+		// a lock acquired after giving up would otherwise be held until its ttl expires
+		go func() {
+			if unlock, ok := <-locked; ok {
+				_ = unlock(context.Background())
+			}
+		}()
+		return nil, err
+	}
+
+	return <-locked, nil
+}
+
+// run calls fn in the background and waits for it to finish or for the timeout to elapse. Any values fn sets are
+// only safe to read if run returns nil
+func (s *timeoutStore) run(ctx context.Context, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%w | %s", ErrTimeout, ctx.Err())
+	case err := <-done:
+		return err
+	}
+}
+
+// breakerStore is a Store that stops calling the underlying store after it fails repeatedly
+type breakerStore struct {
+	store     Store
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// WithCircuitBreaker wraps a store so that after threshold consecutive failures every call fails immediately with
+// ErrCircuitOpen. Once the cooldown has elapsed a single trial call is let through, if it succeeds the breaker closes
+// again, otherwise it stays open for another cooldown. The cooldown is measured with the clock set by WithClock.
+func WithCircuitBreaker(store Store, threshold int, cooldown time.Duration, opts ...StoreOption) Store {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	o := storeOptionsFrom(opts)
+	return &breakerStore{
+		store:     store,
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     o.clock,
+	}
+}
+
+// Get calls Get on the underlying store unless the breaker is open
+func (s *breakerStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	if !s.allow() {
+		return nil, time.Time{}, ErrCircuitOpen
+	}
+
+	raw, lastUpdate, err := s.store.Get(ctx, key)
+	s.record(ctx, err)
+	return raw, lastUpdate, err
+}
+
+// Set calls Set on the underlying store unless the breaker is open
+func (s *breakerStore) Set(ctx context.Context, key string, val []byte) error {
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := s.store.Set(ctx, key, val)
+	s.record(ctx, err)
+	return err
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store unless the breaker is open
+func (s *breakerStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	if !s.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	env, err := GetEnvelope(ctx, s.store, key)
+	s.record(ctx, err)
+	return env, err
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store unless the breaker is open
+func (s *breakerStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := SetEnvelope(ctx, s.store, key, env)
+	s.record(ctx, err)
+	return err
+}
+
+// Delete calls Delete on the underlying store unless the breaker is open
+func (s *breakerStore) Delete(ctx context.Context, key string) error {
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := DeleteKey(ctx, s.store, key)
+	s.record(ctx, err)
+	return err
+}
+
+// List calls List on the underlying store unless the breaker is open
+func (s *breakerStore) List(ctx context.Context, prefix string) ([]string, error) {
+	if !s.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	keys, err := ListKeys(ctx, s.store, prefix)
+	s.record(ctx, err)
+	return keys, err
+}
+
+// Touch calls Touch on the underlying store unless the breaker is open. If the underlying store does not implement
+// Toucher ErrNotSupported will be returned
+func (s *breakerStore) Touch(ctx context.Context, key string) error {
+	if !s.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := TouchKey(ctx, s.store, key)
+	s.record(ctx, err)
+	return err
+}
+
+// TryLock calls TryLock on the underlying store unless the breaker is open. If the underlying store does not
+// implement Locker ErrNotSupported will be returned
+func (s *breakerStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	if !s.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	unlock, err := TryLock(ctx, s.store, key, ttl)
+	s.record(ctx, err)
+	return unlock, err
+}
+
+// allow reports whether a call should be passed on to the underlying store
+func (s *breakerStore) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures < s.threshold {
+		return true
+	}
+
+	// only let a single trial call through once the cooldown has passed
+	if s.trial || s.clock.Now().Sub(s.openedAt) < s.cooldown {
+		return false
+	}
+
+	s.trial = true
+	return true
+}
+
+// record updates the breaker state with the result of a call to the underlying store. Calls that failed because the
+// caller gave up, either because ctx is done or the error is context.Canceled, say nothing about the health of the
+// store so they don't count as a failure or a success. A context.DeadlineExceeded from a store's own timeout while
+// ctx is still live does count as a failure
+func (s *breakerStore) record(ctx context.Context, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trial = false
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+		return
+	}
+	// a lock held by another caller means the store answered, so it counts as a success
+	if err == nil || errors.Is(err, ErrNotSupported) || errors.Is(err, ErrLockHeld) {
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.failures >= s.threshold {
+		s.openedAt = s.clock.Now()
+	}
+}
+
+// logStore is a Store that logs any errors returned by the underlying store
+type logStore struct {
+	store Store
+	log   func(context.Context, error)
+}
+
+// WithLogging wraps a store so that any error returned by the underlying store is passed to log before being returned.
+// The logged error includes the operation and key that failed.
+func WithLogging(store Store, log func(context.Context, error)) Store {
+	return &logStore{
+		store: store,
+		log:   log,
+	}
+}
+
+// Get calls Get on the underlying store and logs any error
+func (s *logStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	raw, lastUpdate, err := s.store.Get(ctx, key)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("get %q: %w", key, err))
+	}
+
+	return raw, lastUpdate, err
+}
+
+// Set calls Set on the underlying store and logs any error
+func (s *logStore) Set(ctx context.Context, key string, val []byte) error {
+	err := s.store.Set(ctx, key, val)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("set %q: %w", key, err))
+	}
+
+	return err
+}
+
+// GetEnvelope calls GetEnvelope on the underlying store and logs any error
+func (s *logStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	env, err := GetEnvelope(ctx, s.store, key)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("get %q: %w", key, err))
+	}
+
+	return env, err
+}
+
+// SetEnvelope calls SetEnvelope on the underlying store and logs any error
+func (s *logStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	err := SetEnvelope(ctx, s.store, key, env)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("set %q: %w", key, err))
+	}
+
+	return err
+}
+
+// Delete calls Delete on the underlying store and logs any error
+func (s *logStore) Delete(ctx context.Context, key string) error {
+	err := DeleteKey(ctx, s.store, key)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("delete %q: %w", key, err))
+	}
+
+	return err
+}
+
+// List calls List on the underlying store and logs any error
+func (s *logStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := ListKeys(ctx, s.store, prefix)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("list %q: %w", prefix, err))
+	}
+
+	return keys, err
+}
+
+// Touch calls Touch on the underlying store and logs any error. If the underlying store does not implement Toucher
+// ErrNotSupported will be returned
+func (s *logStore) Touch(ctx context.Context, key string) error {
+	err := TouchKey(ctx, s.store, key)
+	if err != nil {
+		s.log(ctx, fmt.Errorf("touch %q: %w", key, err))
+	}
+
+	return err
+}
+
+// TryLock calls TryLock on the underlying store and logs any error other than ErrLockHeld, which is expected when
+// another caller holds the lock. If the underlying store does not implement Locker ErrNotSupported will be returned
+func (s *logStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	unlock, err := TryLock(ctx, s.store, key, ttl)
+	if err != nil && !errors.Is(err, ErrLockHeld) {
+		s.log(ctx, fmt.Errorf("lock %q: %w", key, err))
+	}
+
+	return unlock, err
+}
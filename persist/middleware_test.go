@@ -0,0 +1,330 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faultStore is a Store that fails the first n calls and can delay every call, it's used to test store wrappers
+type faultStore struct {
+	mu    sync.Mutex
+	data  map[string][]byte
+	fails int
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (f *faultStore) call() error {
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.fails > 0 {
+		f.fails--
+		if f.err != nil {
+			return f.err
+		}
+		return errors.New("injected fault")
+	}
+
+	return nil
+}
+
+func (f *faultStore) Get(_ context.Context, key string) ([]byte, time.Time, error) {
+	if err := f.call(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data[key], time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC), nil
+}
+
+func (f *faultStore) Set(_ context.Context, key string, val []byte) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[key] = val
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		store     *faultStore
+		policy    RetryPolicy
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			"succeeds after retries",
+			&faultStore{data: map[string][]byte{"test": []byte("value")}, fails: 2},
+			RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5},
+			3,
+			false,
+		},
+		{
+			"runs out of attempts",
+			&faultStore{data: map[string][]byte{}, fails: 5},
+			RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			3,
+			true,
+		},
+		{
+			"zero attempts still calls once",
+			&faultStore{data: map[string][]byte{}},
+			RetryPolicy{},
+			1,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := WithRetry(tt.store, tt.policy)
+			_, _, err := s.Get(context.Background(), "test")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("WithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.store.calls != tt.wantCalls {
+				t.Errorf("WithRetry() calls = %d, want %d", tt.store.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetry_canceled(t *testing.T) {
+	store := &faultStore{data: map[string][]byte{}, fails: 5}
+	s := WithRetry(store, RetryPolicy{Attempts: 5, Backoff: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := s.Set(ctx, "test", []byte("value"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WithRetry() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if store.calls != 1 {
+		t.Errorf("WithRetry() calls = %d, want 1", store.calls)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   *faultStore
+		timeout time.Duration
+		want    []byte
+		wantErr error
+	}{
+		{
+			"fast store",
+			&faultStore{data: map[string][]byte{"test": []byte("value")}},
+			time.Second,
+			[]byte("value"),
+			nil,
+		},
+		{
+			"slow store",
+			&faultStore{data: map[string][]byte{"test": []byte("value")}, delay: time.Second},
+			time.Millisecond * 10,
+			nil,
+			ErrTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got, _, err := WithTimeout(tt.store, tt.timeout).Get(context.Background(), "test")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WithTimeout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WithTimeout() got = %s, want %s", got, tt.want)
+			}
+			if time.Since(start) > tt.timeout+time.Millisecond*100 {
+				t.Errorf("WithTimeout() took %v, longer than timeout %v", time.Since(start), tt.timeout)
+			}
+		})
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	store := &faultStore{data: map[string][]byte{}, fails: 2}
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := WithCircuitBreaker(store, 2, time.Minute, WithClock(clock))
+	ctx := context.Background()
+
+	// trip the breaker
+	for i := 0; i < 2; i++ {
+		if err := s.Set(ctx, "test", []byte("value")); err == nil {
+			t.Fatal("WithCircuitBreaker() expected injected fault")
+		}
+	}
+
+	// the breaker is open so the store should not be called
+	if err := s.Set(ctx, "test", []byte("value")); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("WithCircuitBreaker() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if store.calls != 2 {
+		t.Errorf("WithCircuitBreaker() calls = %d, want 2", store.calls)
+	}
+
+	// after the cooldown a trial call is let through and closes the breaker
+	clock.Advance(time.Second * 59)
+	if err := s.Set(ctx, "test", []byte("value")); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("WithCircuitBreaker() during cooldown error = %v, want %v", err, ErrCircuitOpen)
+	}
+	clock.Advance(time.Second * 2)
+	if err := s.Set(ctx, "test", []byte("value")); err != nil {
+		t.Errorf("WithCircuitBreaker() error = %v, want nil", err)
+	}
+	if _, _, err := s.Get(ctx, "test"); err != nil {
+		t.Errorf("WithCircuitBreaker() error = %v, want nil", err)
+	}
+	if store.calls != 4 {
+		t.Errorf("WithCircuitBreaker() calls = %d, want 4", store.calls)
+	}
+}
+
+func TestWithCircuitBreaker_canceled(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		err       error
+		wantCalls int
+	}{
+		{
+			"caller canceled",
+			canceled,
+			nil,
+			3,
+		},
+		{
+			"canceled error",
+			context.Background(),
+			context.Canceled,
+			3,
+		},
+		{
+			"store timeout",
+			context.Background(),
+			context.DeadlineExceeded,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &faultStore{data: map[string][]byte{}, fails: 2, err: tt.err}
+			s := WithCircuitBreaker(store, 2, time.Hour)
+
+			// calls the caller gave up on must not trip the breaker
+			for i := 0; i < 2; i++ {
+				_ = s.Set(tt.ctx, "test", []byte("value"))
+			}
+			_ = s.Set(context.Background(), "test", []byte("value"))
+			if store.calls != tt.wantCalls {
+				t.Errorf("WithCircuitBreaker() calls = %d, want %d", store.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMiddleware_passThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap func(Store) Store
+	}{
+		{
+			"retry",
+			func(s Store) Store { return WithRetry(s, RetryPolicy{Attempts: 2}) },
+		},
+		{
+			"timeout",
+			func(s Store) Store { return WithTimeout(s, time.Second) },
+		},
+		{
+			"circuit breaker",
+			func(s Store) Store { return WithCircuitBreaker(s, 2, time.Second) },
+		},
+		{
+			"logging",
+			func(s Store) Store { return WithLogging(s, func(context.Context, error) {}) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backing := NewFsStore(t.TempDir(), false)
+			s := tt.wrap(backing)
+
+			unlock, err := s.(Locker).TryLock(ctx, "test", time.Second)
+			if errors.Is(err, ErrNotSupported) {
+				t.Skip("file locking is not supported on this platform")
+			}
+			if err != nil {
+				t.Fatal("TryLock() error", err)
+			}
+			if _, err := s.(Locker).TryLock(ctx, "test", time.Second); !errors.Is(err, ErrLockHeld) {
+				t.Errorf("TryLock() held lock error = %v, want %v", err, ErrLockHeld)
+			}
+			if err := unlock(ctx); err != nil {
+				t.Errorf("Unlock() error = %v", err)
+			}
+
+			_ = backing.Set(ctx, "test", []byte("value"))
+			_, before, _ := backing.Get(ctx, "test")
+			time.Sleep(time.Millisecond * 10)
+			if err := s.(Toucher).Touch(ctx, "test"); err != nil {
+				t.Fatal("Touch() error", err)
+			}
+			if _, after, _ := backing.Get(ctx, "test"); !after.After(before) {
+				t.Errorf("Touch() lastUpdate = %v, want after %v", after, before)
+			}
+		})
+	}
+}
+
+func TestWithLogging(t *testing.T) {
+	tests := []struct {
+		name    string
+		store   *faultStore
+		wantLog string
+	}{
+		{
+			"no error",
+			&faultStore{data: map[string][]byte{}},
+			"",
+		},
+		{
+			"logs error",
+			&faultStore{data: map[string][]byte{}, fails: 1},
+			`set "test": injected fault`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotLog string
+			s := WithLogging(tt.store, func(_ context.Context, err error) {
+				gotLog = err.Error()
+			})
+
+			_ = s.Set(context.Background(), "test", []byte("value"))
+			if gotLog != tt.wantLog {
+				t.Errorf("WithLogging() log = %s, want %s", gotLog, tt.wantLog)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Package msgpackcodec provides a persist.Codec that uses MessagePack. MessagePack is a binary format that is
+// usually smaller and faster to encode than JSON, while still supporting the same struct tags.
+package msgpackcodec
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// New returns a codec that stores values as MessagePack. Struct fields are encoded using their json tags if they
+// don't have msgpack tags, so types that are already JSON cached can switch codecs without changing their tags
+func New[T any]() persist.Codec[T] {
+	return codec[T]{}
+}
+
+// codec is the persist.Codec returned by New
+type codec[T any] struct{}
+
+// CodecID identifies the MessagePack codec
+func (codec[T]) CodecID() string {
+	return "msgpack"
+}
+
+// Encode marshals v as MessagePack
+func (codec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode unmarshals data into a new value and stores it in v
+func (codec[T]) Decode(data []byte, v *T) error {
+	var tmp T
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	err := dec.Decode(&tmp)
+	if err != nil {
+		return err
+	}
+
+	*v = tmp
+	return nil
+}
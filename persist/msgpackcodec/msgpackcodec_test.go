@@ -0,0 +1,116 @@
+package msgpackcodec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+type team struct {
+	ID      int               `json:"id"`
+	Name    string            `json:"name"`
+	Members []string          `json:"members"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+var testTeam = team{
+	ID:      42,
+	Name:    "cachin",
+	Members: []string{"alice", "bob", "carol"},
+	Labels:  map[string]string{"tier": "1"},
+	Created: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC),
+}
+
+func TestCodec(t *testing.T) {
+	tests := []struct {
+		name string
+		v    team
+	}{
+		{
+			"full",
+			testTeam,
+		},
+		{
+			"zero",
+			team{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New[team]()
+			raw, err := c.Encode(tt.v)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			var got team
+			if err := c.Decode(raw, &got); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !got.Created.Equal(tt.v.Created) {
+				t.Errorf("Decode() created = %v, want %v", got.Created, tt.v.Created)
+			}
+			got.Created, tt.v.Created = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(got, tt.v) {
+				t.Errorf("Decode() = %v, want %v", got, tt.v)
+			}
+		})
+	}
+}
+
+func TestCodec_smallerThanJSON(t *testing.T) {
+	raw, _ := New[team]().Encode(testTeam)
+	jsonRaw, _ := persist.JSONCodec[team]{}.Encode(testTeam)
+	if len(raw) >= len(jsonRaw) {
+		t.Errorf("Encode() = %d bytes, want fewer than JSON's %d bytes", len(raw), len(jsonRaw))
+	}
+}
+
+func TestCodec_decodeError(t *testing.T) {
+	got := team{Name: "unchanged"}
+	if err := New[team]().Decode([]byte{0xc1}, &got); err == nil {
+		t.Error("Decode() expected an error")
+	}
+	if got.Name != "unchanged" {
+		t.Errorf("Decode() modified the value on error, got %v", got)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		codec persist.Codec[team]
+	}{
+		{"msgpack", New[team]()},
+		{"json", persist.DefaultCodec[team]()},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = bm.codec.Encode(testTeam)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		codec persist.Codec[team]
+	}{
+		{"msgpack", New[team]()},
+		{"json", persist.DefaultCodec[team]()},
+	}
+	for _, bm := range benchmarks {
+		raw, _ := bm.codec.Encode(testTeam)
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var v team
+				_ = bm.codec.Decode(raw, &v)
+			}
+		})
+	}
+}
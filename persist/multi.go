@@ -2,46 +2,147 @@ package persist
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
+// MultiStore is a Store that reads from and writes to multiple stores. Stores are read in order, so faster stores
+// should be listed first. The first store is the primary store, List, Touch and TryLock only use it.
 type MultiStore struct {
 	stores []Store
 	expire time.Duration
+	clock  Clock
 }
 
+// NewMultiStore creates a new MultiStore. Get returns the value from the first store whose value is younger than
+// expire, if expire is Forever the first store that has a value is used. The age of each value is measured with the
+// clock set by WithClock, which should match the clock of the stores
+func NewMultiStore(expire time.Duration, stores []Store, opts ...StoreOption) *MultiStore {
+	o := storeOptionsFrom(opts)
+	return &MultiStore{
+		stores: stores,
+		expire: expire,
+		clock:  o.clock,
+	}
+}
+
+// Get looks for the key in each store and returns the first non-expired value
 func (s *MultiStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope looks for the key in each store and returns the first non-expired envelope
+func (s *MultiStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
 	// look in each store and return the first non-expired source
 	var errs []string
 	for _, store := range s.stores {
-		got, lastUpdate, err := store.Get(ctx, key)
+		env, err := GetEnvelope(ctx, store, key)
 		if err != nil {
 			errs = append(errs, err.Error())
+			continue
+		}
+		if env == nil || env.Updated.IsZero() {
+			continue
 		}
 
-		if time.Since(lastUpdate) < s.expire {
-			return got, lastUpdate, nil
+		if s.expire == Forever || s.clock.Now().Sub(env.Updated) < s.expire {
+			return env, nil
 		}
 	}
 
 	if len(errs) > 0 {
-		return nil, time.Time{}, fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+		return nil, fmt.Errorf("errs: %s", strings.Join(errs, "|"))
 	}
 
-	return nil, time.Time{}, nil
+	return nil, nil
 }
 
+// Set writes the value to every store, a failure in one store does not stop the value from being written to the rest.
+// Read-only stores are skipped
 func (s *MultiStore) Set(ctx context.Context, key string, val []byte) error {
 	var errs []string
 	for _, store := range s.stores {
 		err := store.Set(ctx, key, val)
-		if err != nil {
+		if err != nil && !errors.Is(err, ErrReadOnly) {
 			errs = append(errs, err.Error())
+		}
+	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return nil
+}
+
+// SetEnvelope writes the envelope to every store, a failure in one store does not stop the envelope from being
+// written to the rest. Read-only stores are skipped
+func (s *MultiStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	var errs []string
+	for _, store := range s.stores {
+		err := SetEnvelope(ctx, store, key, env)
+		if err != nil && !errors.Is(err, ErrReadOnly) {
+			errs = append(errs, err.Error())
 		}
 	}
 
-	return fmt.Errorf("errs: %v", strings.Join(errs, "|"))
+	if len(errs) > 0 {
+		return fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return nil
+}
+
+// Delete removes the key from every store, read-only stores are skipped
+func (s *MultiStore) Delete(ctx context.Context, key string) error {
+	var errs []string
+	for _, store := range s.stores {
+		err := DeleteKey(ctx, store, key)
+		if err != nil && !errors.Is(err, ErrReadOnly) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return nil
+}
+
+// List returns the keys in the primary store that start with the provided prefix. If the primary store does not
+// implement Lister ErrNotSupported will be returned
+func (s *MultiStore) List(ctx context.Context, prefix string) ([]string, error) {
+	if len(s.stores) == 0 {
+		return nil, ErrNotSupported
+	}
+
+	return ListKeys(ctx, s.stores[0], prefix)
+}
+
+// Touch touches the key in the primary store. If the primary store does not implement Toucher ErrNotSupported will
+// be returned
+func (s *MultiStore) Touch(ctx context.Context, key string) error {
+	if len(s.stores) == 0 {
+		return ErrNotSupported
+	}
+
+	return TouchKey(ctx, s.stores[0], key)
+}
+
+// TryLock acquires the lock for the key from the primary store, so every process sharing the primary store shares
+// the lock. If the primary store does not implement Locker ErrNotSupported will be returned
+func (s *MultiStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	if len(s.stores) == 0 {
+		return nil, ErrNotSupported
+	}
+
+	return TryLock(ctx, s.stores[0], key, ttl)
 }
@@ -0,0 +1,88 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiStore_Get_clock(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	fast := NewMemoryStore(Forever, 0, WithClock(clock))
+	slow := NewMemoryStore(Forever, 0, WithClock(clock))
+	s := NewMultiStore(time.Minute, []Store{fast, slow}, WithClock(clock))
+
+	_ = fast.Set(ctx, "test_key", []byte(`fast`))
+	clock.Advance(time.Minute * 2)
+	_ = slow.Set(ctx, "test_key", []byte(`slow`))
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    string
+	}{
+		{
+			"first store expired",
+			0,
+			"slow",
+		},
+		{
+			"every store expired",
+			time.Minute * 2,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			got, _, err := s.Get(ctx, "test_key")
+			if err != nil || string(got) != tt.want {
+				t.Errorf("MultiStore.Get() = %s, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiStore_primary(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	primary := NewMemoryStore(Forever, 0, WithClock(clock))
+	secondary := NewMemoryStore(Forever, 0, WithClock(clock))
+	s := NewMultiStore(Forever, []Store{primary, secondary}, WithClock(clock))
+
+	_ = s.Set(ctx, "a/one", []byte(`one`))
+	_ = secondary.Set(ctx, "a/two", []byte(`two`))
+	if got, err := s.List(ctx, "a/"); err != nil || !reflect.DeepEqual(got, []string{"a/one"}) {
+		t.Errorf("MultiStore.List() = %v, %v, want [a/one]", got, err)
+	}
+
+	clock.Advance(time.Minute)
+	if err := s.Touch(ctx, "a/one"); err != nil {
+		t.Fatalf("MultiStore.Touch() error = %v", err)
+	}
+	if _, lastUpdate, _ := primary.Get(ctx, "a/one"); !lastUpdate.Equal(clock.Now()) {
+		t.Errorf("MultiStore.Touch() primary last update = %v, want %v", lastUpdate, clock.Now())
+	}
+
+	// MemoryStore can't lock, so locking needs a primary store that can
+	if _, err := s.TryLock(ctx, "a/one", time.Minute); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("MultiStore.TryLock() error = %v, want %v", err, ErrNotSupported)
+	}
+	locker := NewFsStore(t.TempDir(), true)
+	unlock, err := NewMultiStore(Forever, []Store{locker, secondary}).TryLock(ctx, "a/one", time.Minute)
+	if err != nil {
+		t.Fatalf("MultiStore.TryLock() error = %v", err)
+	}
+	if _, err := locker.TryLock(ctx, "a/one", time.Minute); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("MultiStore.TryLock() primary lock error = %v, want %v", err, ErrLockHeld)
+	}
+	_ = unlock(ctx)
+
+	empty := NewMultiStore(Forever, nil)
+	if _, err := empty.List(ctx, ""); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("MultiStore.List() no stores error = %v, want %v", err, ErrNotSupported)
+	}
+}
@@ -0,0 +1,105 @@
+package persist
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NamespaceSeparator separates a namespace from the keys stored under it
+const NamespaceSeparator = "/"
+
+// NamespaceStore is a Store that scopes every key under a prefix. It can be used to share a single backing store
+// between multiple applications without their keys colliding. Namespaces can be nested by wrapping a NamespaceStore
+// in another NamespaceStore.
+type NamespaceStore struct {
+	store  Store
+	prefix string
+}
+
+// Namespace creates a new NamespaceStore, all keys read from or written to store will be prefixed with the provided
+// name followed by the NamespaceSeparator
+func Namespace(store Store, name string) *NamespaceStore {
+	return &NamespaceStore{
+		store:  store,
+		prefix: name + NamespaceSeparator,
+	}
+}
+
+// Get gets the namespaced key from the underlying store
+func (s *NamespaceStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	return s.store.Get(ctx, s.prefix+key)
+}
+
+// Set sets the namespaced key in the underlying store
+func (s *NamespaceStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.store.Set(ctx, s.prefix+key, val)
+}
+
+// GetEnvelope gets the envelope of the namespaced key from the underlying store
+func (s *NamespaceStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	return GetEnvelope(ctx, s.store, s.prefix+key)
+}
+
+// SetEnvelope sets the envelope of the namespaced key in the underlying store
+func (s *NamespaceStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	return SetEnvelope(ctx, s.store, s.prefix+key, env)
+}
+
+// Delete removes the namespaced key from the underlying store. If the underlying store does not implement Deleter
+// ErrNotSupported will be returned
+func (s *NamespaceStore) Delete(ctx context.Context, key string) error {
+	return DeleteKey(ctx, s.store, s.prefix+key)
+}
+
+// Touch touches the namespaced key in the underlying store. If the underlying store does not implement Toucher
+// ErrNotSupported will be returned
+func (s *NamespaceStore) Touch(ctx context.Context, key string) error {
+	return TouchKey(ctx, s.store, s.prefix+key)
+}
+
+// List returns every key in the namespace that starts with the provided prefix. The returned keys do not include the
+// namespace. If the underlying store does not implement Lister ErrNotSupported will be returned
+func (s *NamespaceStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := ListKeys(ctx, s.store, s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], s.prefix)
+	}
+
+	return keys, nil
+}
+
+// TryLock acquires the lock for the namespaced key from the underlying store. If the underlying store does not
+// implement Locker ErrNotSupported will be returned
+func (s *NamespaceStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	return TryLock(ctx, s.store, s.prefix+key, ttl)
+}
+
+// Clear removes every key in the namespace from the underlying store. The underlying store must implement both
+// Lister and Deleter, otherwise ErrNotSupported will be returned. Clear attempts to delete every key even if some
+// deletes fail
+func (s *NamespaceStore) Clear(ctx context.Context) error {
+	keys, err := s.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, key := range keys {
+		err := s.Delete(ctx, key)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errs: %s", strings.Join(errs, "|"))
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		store Store
+	}{
+		{
+			"filesystem",
+			NewFsStore(t.TempDir(), false),
+		},
+		{
+			"filesystem safe key",
+			NewFsStore(t.TempDir(), true),
+		},
+		{
+			"redis",
+			newTestRedisStore(t),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svcA := Namespace(tt.store, "svc-a")
+			svcB := Namespace(tt.store, "svc-b")
+			nested := Namespace(svcA, "nested")
+
+			for _, s := range []Store{svcA, svcB, nested} {
+				for _, key := range []string{"key1", "key2"} {
+					if err := s.Set(ctx, key, []byte(key)); err != nil {
+						t.Fatalf("Namespace() failed to set key %s: %v", key, err)
+					}
+				}
+			}
+
+			got, _, err := svcB.Get(ctx, "key1")
+			if err != nil || string(got) != "key1" {
+				t.Errorf("Namespace() Get() = %s, %v, want key1", got, err)
+			}
+
+			keys, err := svcA.List(ctx, "")
+			if err != nil {
+				t.Fatalf("Namespace() List() error = %v", err)
+			}
+			sort.Strings(keys)
+			wantKeys := []string{"key1", "key2", "nested/key1", "nested/key2"}
+			if !reflect.DeepEqual(keys, wantKeys) {
+				t.Errorf("Namespace() List() = %v, want %v", keys, wantKeys)
+			}
+
+			// clearing the nested namespace should leave its parent untouched
+			if err := nested.Clear(ctx); err != nil {
+				t.Fatalf("Namespace() Clear() error = %v", err)
+			}
+			keys, _ = svcA.List(ctx, "")
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, []string{"key1", "key2"}) {
+				t.Errorf("Namespace() List() after nested Clear() = %v", keys)
+			}
+
+			if err := svcA.Clear(ctx); err != nil {
+				t.Fatalf("Namespace() Clear() error = %v", err)
+			}
+			keys, _ = svcA.List(ctx, "")
+			if len(keys) != 0 {
+				t.Errorf("Namespace() List() after Clear() = %v, want none", keys)
+			}
+
+			// other namespaces should not be affected by a clear
+			keys, _ = svcB.List(ctx, "")
+			if len(keys) != 2 {
+				t.Errorf("Namespace() List() other namespace = %v, want 2 keys", keys)
+			}
+		})
+	}
+}
+
+func TestNamespaceStore_Clear_notSupported(t *testing.T) {
+	s := Namespace(&testStore{data: map[string]rawData{}}, "svc-a")
+	if err := s.Clear(context.Background()); err != ErrNotSupported {
+		t.Errorf("NamespaceStore.Clear() error = %v, want %v", err, ErrNotSupported)
+	}
+}
+
+func TestNamespaceStore_TryLock(t *testing.T) {
+	ctx := context.Background()
+	backing := NewFsStore(t.TempDir(), false)
+	unlock, err := Namespace(backing, "svc-a").TryLock(ctx, "test", time.Second)
+	if err != nil {
+		t.Fatal("NamespaceStore.TryLock() error", err)
+	}
+	defer func() {
+		_ = unlock(ctx)
+	}()
+
+	if _, err := backing.TryLock(ctx, "svc-a/test", time.Second); !errors.Is(err, ErrLockHeld) {
+		t.Errorf("NamespaceStore.TryLock() error = %v, want %v", err, ErrLockHeld)
+	}
+	if _, err := Namespace(&testStore{}, "svc-a").TryLock(ctx, "test", time.Second); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("NamespaceStore.TryLock() error = %v, want %v", err, ErrNotSupported)
+	}
+}
@@ -2,7 +2,6 @@ package persist
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
@@ -26,6 +25,13 @@ var (
 	// this error may mean the external cache has become out of date. However, even if this error is returned
 	// the cache will be safe to use as it will fall back on an in-memory cache.
 	ErrFailedKey = errors.New("failed to convert input into valid key")
+
+	// ErrCorrupt indicates a stored value failed an integrity check, such as a checksum or HMAC. Data treats corrupt
+	// values as a cache miss, so the value will be recalculated and overwritten rather than returned.
+	ErrCorrupt = errors.New("stored data is corrupt")
+
+	// ErrNotSupported indicates a store does not support an optional operation such as Delete or List
+	ErrNotSupported = errors.New("operation not supported by store")
 )
 
 // Store is an interface that can be used by a Data struct to back up it's internal value to any
@@ -35,8 +41,57 @@ type Store interface {
 	Set(context.Context, string, []byte) error
 }
 
+// Deleter is an optional interface a Store can implement to allow keys to be removed. Deleting a key that does not
+// exist should not return an error
+type Deleter interface {
+	Delete(context.Context, string) error
+}
+
+// Lister is an optional interface a Store can implement to allow its keys to be listed. List returns every key that
+// starts with the provided prefix, an empty prefix lists every key in the store
+type Lister interface {
+	List(context.Context, string) ([]string, error)
+}
+
+// Toucher is an optional interface a Store can implement to refresh when a key was last set without rewriting its
+// value. Touching a key that does not exist should be a no-op
+type Toucher interface {
+	Touch(context.Context, string) error
+}
+
+// DeleteKey removes a key from the store if the store implements Deleter, otherwise ErrNotSupported is returned
+func DeleteKey(ctx context.Context, store Store, key string) error {
+	d, ok := store.(Deleter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	return d.Delete(ctx, key)
+}
+
+// ListKeys lists the keys in the store if the store implements Lister, otherwise ErrNotSupported is returned
+func ListKeys(ctx context.Context, store Store, prefix string) ([]string, error) {
+	l, ok := store.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return l.List(ctx, prefix)
+}
+
+// TouchKey touches a key in the store if the store implements Toucher, otherwise ErrNotSupported is returned
+func TouchKey(ctx context.Context, store Store, key string) error {
+	t, ok := store.(Toucher)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	return t.Touch(ctx, key)
+}
+
 // Serializable is an optional interface that can be used to customize the way a Data struct serializes its data
-// if this interface is not provided, jsonMarshall and jsonUnmarshal will be used instead.
+// if this interface is not provided, jsonMarshall and jsonUnmarshal will be used instead. Serializable is used by the
+// DefaultCodec, a different Codec can be provided with WithCodec.
 type Serializable interface {
 	Bytes() ([]byte, error)
 	FromBytes([]byte) error
@@ -51,42 +106,121 @@ type Data[T any] struct {
 	lastSet time.Time
 	store   Store
 	key     string
+	clock   Clock
+	codec   Codec[T]
+	ttl     time.Duration
+	schema  string
+	migrate func(string, []byte) (T, error)
 }
 
 // NewData wraps the initial in a Data type. If the provided store is non-nil, Data will sync it's internal value
 // to the external store
-func NewData[T any](store Store, key string) Data[T] {
+func NewData[T any](store Store, key string, opts ...Option) Data[T] {
+	o := optionsFrom(opts)
+
+	codec := DefaultCodec[T]()
+	if o.codec != nil {
+		c, ok := o.codec.(Codec[T])
+		if !ok {
+			panic(fmt.Sprintf("persist: codec %T can not be used with Data[%T]", o.codec, *new(T)))
+		}
+		codec = c
+	}
+
+	schema := o.schema
+	if schema == "" {
+		schema = Fingerprint[T]()
+	}
+
+	var migrate func(string, []byte) (T, error)
+	if o.migration != nil {
+		m, ok := o.migration.(func(string, []byte) (T, error))
+		if !ok {
+			panic(fmt.Sprintf("persist: migration %T can not be used with Data[%T]", o.migration, *new(T)))
+		}
+		migrate = m
+	}
+
 	return Data[T]{
-		store: store,
-		key:   key,
+		store:   store,
+		key:     key,
+		clock:   o.clock,
+		codec:   codec,
+		ttl:     o.ttl,
+		schema:  schema,
+		migrate: migrate,
 	}
 }
 
 // Load will load the initial data from the external store. If the store is nil or the Data has already been set
 // Load is a no-op. Load can safely be called multiple times.
 func (d *Data[T]) Load(ctx context.Context) error {
-	if d.IsUnset() && d.store != nil {
-		// try to populate the initial value from the cache
-		raw, lastUpdate, err := d.store.Get(ctx, d.key)
+	if d.IsUnset() {
+		return d.Reload(ctx)
+	}
 
-		// if lastUpdate is missing that's considered a cache failure since we can't then know how old the data is
-		if err != nil {
-			return fmt.Errorf("%w | %s", ErrExternalCache, err)
-		}
-		if lastUpdate.IsZero() {
-			return fmt.Errorf("%w | last update was not set", ErrExternalCache)
-		}
+	return nil
+}
 
-		tmp := Data[T]{}
-		err = tmp.FromBytes(raw)
-		if err != nil {
-			return fmt.Errorf("%w | %s", ErrNotSerializable, err)
-		}
+// Reload loads the data from the external store even if the Data has already been set. This can be used to pick up
+// a value written to the store by another process. If the store is nil Reload is a no-op. If the store can not be
+// read the current value is left unchanged.
+func (d *Data[T]) Reload(ctx context.Context) error {
+	if d.store == nil {
+		return nil
+	}
+
+	// try to populate the value from the cache
+	env, err := GetEnvelope(ctx, d.store, d.key)
+	if errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w | %s", ErrExternalCache, err)
+	}
+
+	// if lastUpdate is missing that's considered a cache failure since we can't then know how old the data is
+	if env == nil || env.Updated.IsZero() {
+		return fmt.Errorf("%w | last update was not set", ErrExternalCache)
+	}
+
+	// values written with another codec can't be decoded safely, even if decoding happens to succeed
+	id := codecID(d.getCodec())
+	if env.Codec != "" && id != "" && env.Codec != id {
+		return fmt.Errorf("%w | value was written with codec %q, not %q", ErrNotSerializable, env.Codec, id)
+	}
 
-		d.value = tmp.value
-		d.lastSet = lastUpdate
+	// values without a schema were stored before schemas were recorded, or by a store that doesn't keep envelopes, so
+	// there's nothing to compare. A Data created without NewData doesn't have a schema either
+	if env.Schema != "" && d.schema != "" && env.Schema != d.schema {
+		return d.migrateFrom(env)
 	}
 
+	tmp := Data[T]{codec: d.codec}
+	err = tmp.FromBytes(env.Value)
+	if err != nil {
+		return fmt.Errorf("%w | %s", ErrNotSerializable, err)
+	}
+
+	d.value = tmp.value
+	d.lastSet = env.Updated
+	return nil
+}
+
+// migrateFrom converts a value stored with a different schema using the Data's migration. If there is no migration,
+// or it fails, ErrSchemaMismatch is returned and the current value is left unchanged
+func (d *Data[T]) migrateFrom(env *Envelope) error {
+	if d.migrate == nil {
+		return fmt.Errorf("%w | stored schema %q, want %q", ErrSchemaMismatch, env.Schema, d.schema)
+	}
+
+	value, err := d.migrate(env.Schema, env.Value)
+	if err != nil {
+		return fmt.Errorf("%w | migrating from schema %q: %s", ErrSchemaMismatch, env.Schema, err)
+	}
+
+	d.value = value
+	d.lastSet = env.Updated
 	return nil
 }
 
@@ -97,7 +231,7 @@ func (d *Data[T]) Get() T {
 
 // Age returns how long it has been since the Data was last Set
 func (d *Data[T]) Age() time.Duration {
-	return time.Since(d.lastSet)
+	return d.now().Sub(d.lastSet)
 }
 
 // Set will set the Data's internal value, it will always succeed at setting the in memory value. However, setting the
@@ -105,7 +239,7 @@ func (d *Data[T]) Age() time.Duration {
 // however, the data in the external store will not be updated and may be out of date the next time the backed value is created.
 func (d *Data[T]) Set(ctx context.Context, a T) error {
 	d.value = a
-	d.lastSet = time.Now()
+	d.lastSet = d.now()
 
 	if d.store != nil {
 		raw, err := d.Bytes()
@@ -113,7 +247,13 @@ func (d *Data[T]) Set(ctx context.Context, a T) error {
 			return fmt.Errorf("%w | %s", ErrNotSerializable, err)
 		}
 
-		err = d.store.Set(ctx, d.key, raw)
+		env := &Envelope{
+			TTL:    d.ttl,
+			Codec:  codecID(d.getCodec()),
+			Schema: d.schema,
+			Value:  raw,
+		}
+		err = SetEnvelope(ctx, d.store, d.key, env)
 		if err != nil {
 			return fmt.Errorf("%w | %s", ErrExternalCache, err)
 		}
@@ -127,35 +267,39 @@ func (d *Data[T]) IsUnset() bool {
 	return d.lastSet.IsZero()
 }
 
+// ResetTTL marks the data as if it was just set, without changing the value
 func (d *Data[T]) ResetTTL() {
-	d.lastSet = time.Now()
+	d.lastSet = d.now()
 }
 
-// Bytes converts the value int a slice of bytes, so it can be stored. If the underlying type implements the
-// Serializable interface that will be used. Otherwise, the type is JSON marshalled
-func (d *Data[T]) Bytes() ([]byte, error) {
-	if s, ok := any(d.value).(Serializable); ok {
-		return s.Bytes()
+// now returns the current time according to the Data's clock. A Data created without NewData uses the SystemClock
+func (d *Data[T]) now() time.Time {
+	if d.clock == nil {
+		return time.Now()
 	}
 
-	return json.Marshal(d.value)
+	return d.clock.Now()
 }
 
-// FromBytes takes a slice of bytes and hydrates Data. It can fail if the by format is incorrect. If the underlying
-// type implements the Serializable interface that will be used. Otherwise, the type is JSON marshalled
+// Bytes converts the value int a slice of bytes, so it can be stored. The value is encoded using the Data's codec,
+// which unless otherwise specified is the DefaultCodec
+func (d *Data[T]) Bytes() ([]byte, error) {
+	return d.getCodec().Encode(d.value)
+}
+
+// FromBytes takes a slice of bytes and hydrates Data. It can fail if the by format is incorrect. The bytes are decoded
+// using the Data's codec, which unless otherwise specified is the DefaultCodec
 func (d *Data[T]) FromBytes(bytes []byte) error {
-	if s, ok := any(d.value).(Serializable); ok {
-		return s.FromBytes(bytes)
-	}
+	return d.getCodec().Decode(bytes, &d.value)
+}
 
-	tmp := *new(T)
-	err := json.Unmarshal(bytes, &tmp)
-	if err != nil {
-		return err
+// getCodec returns the Data's codec. A Data created without NewData uses the DefaultCodec
+func (d *Data[T]) getCodec() Codec[T] {
+	if d.codec == nil {
+		return DefaultCodec[T]()
 	}
 
-	d.value = tmp
-	return nil
+	return d.codec
 }
 
 // IsExpired can be used to determine if a Data value is expired in relation to the provided expiration
@@ -325,3 +325,42 @@ func TestData_FromBytes(t *testing.T) {
 		})
 	}
 }
+
+// testClock is a Clock that only moves when it's advanced
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestData_WithClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	d := NewData[string](nil, "test", WithClock(clock))
+	if err := d.Set(context.Background(), "test value"); err != nil {
+		t.Fatal("Set() error", err)
+	}
+
+	clock.Advance(time.Minute)
+	if got := d.Age(); got != time.Minute {
+		t.Errorf("Age() = %v, want %v", got, time.Minute)
+	}
+	if d.IsExpired(time.Minute * 2) {
+		t.Error("IsExpired() = true, want false")
+	}
+
+	clock.Advance(time.Minute * 2)
+	if !d.IsExpired(time.Minute * 2) {
+		t.Error("IsExpired() = false, want true")
+	}
+
+	d.ResetTTL()
+	if got := d.Age(); got != 0 {
+		t.Errorf("Age() after ResetTTL() = %v, want 0", got)
+	}
+}
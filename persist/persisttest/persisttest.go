@@ -0,0 +1,375 @@
+// Package persisttest provides a conformance test suite for persist.Store implementations. It can be used to validate
+// the stores in the persist package as well as custom stores.
+package persisttest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// timestampSlack is how far a store's timestamps may drift from the test's clock. Some filesystems only store
+// modification times with coarse precision, so timestamps can't be expected to match exactly
+const timestampSlack = time.Second * 2
+
+// RunStoreTests runs the persist.Store conformance tests against stores created by factory. The factory is called
+// once per test and must return a new, empty store each time. Optional capabilities, such as persist.Deleter,
+// persist.Lister, persist.Toucher and persist.EnvelopeStore, are only tested if the store implements them.
+func RunStoreTests(t *testing.T, factory func(t *testing.T) persist.Store) {
+	t.Run("missing key", func(t *testing.T) {
+		testMissingKey(t, factory(t))
+	})
+	t.Run("round trip", func(t *testing.T) {
+		testRoundTrip(t, factory(t))
+	})
+	t.Run("timestamps", func(t *testing.T) {
+		testTimestamps(t, factory(t))
+	})
+	t.Run("concurrent access", func(t *testing.T) {
+		testConcurrentAccess(t, factory(t))
+	})
+	t.Run("delete", func(t *testing.T) {
+		store := factory(t)
+		deleter, ok := store.(persist.Deleter)
+		if !ok {
+			t.Skip("store does not implement persist.Deleter")
+		}
+		testDelete(t, store, deleter)
+	})
+	t.Run("touch", func(t *testing.T) {
+		store := factory(t)
+		toucher, ok := store.(persist.Toucher)
+		if !ok {
+			t.Skip("store does not implement persist.Toucher")
+		}
+		testTouch(t, store, toucher)
+	})
+	t.Run("list", func(t *testing.T) {
+		store := factory(t)
+		lister, ok := store.(persist.Lister)
+		if !ok {
+			t.Skip("store does not implement persist.Lister")
+		}
+		testList(t, store, lister)
+	})
+	t.Run("envelope", func(t *testing.T) {
+		store := factory(t)
+		envStore, ok := store.(persist.EnvelopeStore)
+		if !ok {
+			t.Skip("store does not implement persist.EnvelopeStore")
+		}
+		testEnvelope(t, store, envStore)
+	})
+}
+
+// testMissingKey makes sure reading a key that was never set is a miss and not an error
+func testMissingKey(t *testing.T, store persist.Store) {
+	got, lastUpdate, err := store.Get(context.Background(), "missing")
+	if err != nil {
+		t.Errorf("Get() error = %v, want nil", err)
+	}
+	if got != nil {
+		t.Errorf("Get() = %v, want nil", got)
+	}
+	if !lastUpdate.IsZero() {
+		t.Errorf("Get() lastUpdate = %v, want zero", lastUpdate)
+	}
+}
+
+// testRoundTrip makes sure values are returned exactly as they were set
+func testRoundTrip(t *testing.T, store persist.Store) {
+	allBytes := make([]byte, 256)
+	for i := range allBytes {
+		allBytes[i] = byte(i)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		val  []byte
+	}{
+		{
+			"json",
+			"json",
+			[]byte(`{"name":"test"}`),
+		},
+		{
+			"binary",
+			"binary",
+			allBytes,
+		},
+		{
+			"large",
+			"large",
+			bytes.Repeat([]byte("cachin"), 1<<16),
+		},
+		{
+			"key with special characters",
+			"nested/key with spaces+symbols=",
+			[]byte("special"),
+		},
+		{
+			"overwrite",
+			"json",
+			[]byte(`{"name":"updated"}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := store.Set(ctx, tt.key, tt.val); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+
+			got, _, err := store.Get(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.val) {
+				t.Errorf("Get() = %d bytes, want %d bytes matching what was set", len(got), len(tt.val))
+			}
+		})
+	}
+}
+
+// testTimestamps makes sure the timestamp returned by Get reflects when the key was set, and never goes backwards
+func testTimestamps(t *testing.T, store persist.Store) {
+	ctx := context.Background()
+	before := time.Now()
+	if err := store.Set(ctx, "test", []byte("first")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	_, first, err := store.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if first.Before(before.Add(-timestampSlack)) || first.After(time.Now().Add(timestampSlack)) {
+		t.Errorf("Get() lastUpdate = %v, want close to %v", first, before)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	if err := store.Set(ctx, "test", []byte("second")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	_, second, err := store.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if second.Before(first) {
+		t.Errorf("Get() lastUpdate went backwards, first = %v, second = %v", first, second)
+	}
+}
+
+// testConcurrentAccess makes sure the store can be used from multiple goroutines at once
+func testConcurrentAccess(t *testing.T, store persist.Store) {
+	ctx := context.Background()
+	const workers = 8
+	const iterations = 20
+
+	// every value has the same length so a store that isn't safe for concurrent writes can't hide behind a
+	// shorter value overwriting the start of a longer one
+	values := map[string]bool{}
+	for i := 0; i < workers; i++ {
+		values[fmt.Sprintf("value-%02d", i)] = true
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations*3)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val := []byte(fmt.Sprintf("value-%02d", i))
+			own := fmt.Sprintf("own-%d", i)
+			for j := 0; j < iterations; j++ {
+				if err := store.Set(ctx, "shared", val); err != nil {
+					errs <- fmt.Errorf("Set() shared: %w", err)
+				}
+				if err := store.Set(ctx, own, val); err != nil {
+					errs <- fmt.Errorf("Set() %s: %w", own, err)
+				}
+
+				got, _, err := store.Get(ctx, own)
+				switch {
+				case err != nil:
+					errs <- fmt.Errorf("Get() %s: %w", own, err)
+				case !bytes.Equal(got, val):
+					errs <- fmt.Errorf("Get() %s = %s, want %s", own, got, val)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	got, _, err := store.Get(ctx, "shared")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !values[string(got)] {
+		t.Errorf("Get() shared = %s, want one of the written values", got)
+	}
+}
+
+// testDelete makes sure deleted keys are misses and deleting a missing key is not an error
+func testDelete(t *testing.T, store persist.Store, deleter persist.Deleter) {
+	ctx := context.Background()
+	if err := store.Set(ctx, "test", []byte("value")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if err := deleter.Delete(ctx, "test"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if err := deleter.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete() missing key error = %v", err)
+	}
+
+	got, lastUpdate, err := store.Get(ctx, "test")
+	if err != nil || got != nil || !lastUpdate.IsZero() {
+		t.Errorf("Get() after Delete() = %v, %v, %v, want a miss", got, lastUpdate, err)
+	}
+}
+
+// testTouch makes sure touching a key moves its timestamp forward without changing its value
+func testTouch(t *testing.T, store persist.Store, toucher persist.Toucher) {
+	ctx := context.Background()
+	if err := store.Set(ctx, "test", []byte("value")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	_, before, err := store.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+	if err := toucher.Touch(ctx, "test"); err != nil {
+		t.Errorf("Touch() error = %v", err)
+	}
+	if err := toucher.Touch(ctx, "missing"); err != nil {
+		t.Errorf("Touch() missing key error = %v", err)
+	}
+
+	got, after, err := store.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(got) != "value" {
+		t.Errorf("Get() after Touch() = %s, want value", got)
+	}
+	if !after.After(before) {
+		t.Errorf("Get() after Touch() lastUpdate = %v, want after %v", after, before)
+	}
+
+	// touching a missing key must not create it
+	got, _, err = store.Get(ctx, "missing")
+	if err != nil || got != nil {
+		t.Errorf("Get() missing key after Touch() = %v, %v, want a miss", got, err)
+	}
+}
+
+// testList makes sure List returns exactly the keys matching a prefix
+func testList(t *testing.T, store persist.Store, lister persist.Lister) {
+	ctx := context.Background()
+	for _, key := range []string{"a/1", "a/2", "ab", "b/1"} {
+		if err := store.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{
+			"all keys",
+			"",
+			[]string{"a/1", "a/2", "ab", "b/1"},
+		},
+		{
+			"prefix",
+			"a",
+			[]string{"a/1", "a/2", "ab"},
+		},
+		{
+			"nested prefix",
+			"a/",
+			[]string{"a/1", "a/2"},
+		},
+		{
+			"no matches",
+			"c",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lister.List(ctx, tt.prefix)
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			sort.Strings(got)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testEnvelope makes sure envelope metadata survives a round trip and agrees with Get
+func testEnvelope(t *testing.T, store persist.Store, envStore persist.EnvelopeStore) {
+	ctx := context.Background()
+	want := &persist.Envelope{
+		TTL:    time.Hour,
+		Codec:  "json",
+		Schema: "v2",
+		Value:  []byte(`{"name":"test"}`),
+	}
+	if err := envStore.SetEnvelope(ctx, "test", want); err != nil {
+		t.Fatalf("SetEnvelope() error = %v", err)
+	}
+
+	got, err := envStore.GetEnvelope(ctx, "test")
+	if err != nil {
+		t.Fatalf("GetEnvelope() error = %v", err)
+	}
+	if got == nil {
+		t.Fatal("GetEnvelope() = nil, want the envelope that was set")
+	}
+	if got.TTL != want.TTL || got.Codec != want.Codec || got.Schema != want.Schema || !bytes.Equal(got.Value, want.Value) {
+		t.Errorf("GetEnvelope() = %+v, want %+v", got, want)
+	}
+	if got.Created.IsZero() || got.Updated.Before(got.Created) {
+		t.Errorf("GetEnvelope() created = %v, updated = %v, want both to be set", got.Created, got.Updated)
+	}
+
+	raw, lastUpdate, err := store.Get(ctx, "test")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(raw, want.Value) || !lastUpdate.Equal(got.Updated) {
+		t.Errorf("Get() = %s, %v, want %s, %v", raw, lastUpdate, want.Value, got.Updated)
+	}
+
+	missing, err := envStore.GetEnvelope(ctx, "missing")
+	if err != nil || missing != nil {
+		t.Errorf("GetEnvelope() missing key = %+v, %v, want nil", missing, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package protocodec provides persist.Codecs for protobuf messages. encoding/json does not handle protobuf messages
+// correctly (oneofs, enums and well known types are all mangled), so messages should always be stored with one of
+// these codecs.
+//
+// Importing this package registers the binary codec with persist.RegisterCodec, so the persist.DefaultCodec uses it
+// for any type that implements proto.Message:
+//
+//	import _ "github.com/weave-lab/cachin/persist/protocodec"
+package protocodec
+
+import (
+	"fmt"
+	"reflect"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+// messageType is the reflected type of the proto.Message interface
+var messageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+func init() {
+	persist.RegisterCodec(func(t reflect.Type) bool {
+		return t.Kind() == reflect.Pointer && t.Implements(messageType)
+	}, typeCodec{})
+}
+
+// Binary returns a codec that uses the protobuf binary wire format. T must be a pointer to a generated message type
+func Binary[T proto.Message]() persist.Codec[T] {
+	return codec[T]{
+		id:        "proto",
+		marshal:   proto.Marshal,
+		unmarshal: proto.Unmarshal,
+	}
+}
+
+// JSON returns a codec that uses the canonical protobuf JSON format. It's larger and slower than Binary, but the
+// stored values are human-readable. T must be a pointer to a generated message type
+func JSON[T proto.Message]() persist.Codec[T] {
+	return codec[T]{
+		id:        "protojson",
+		marshal:   protojson.Marshal,
+		unmarshal: protojson.Unmarshal,
+	}
+}
+
+// codec is a persist.Codec for a single message type
+type codec[T proto.Message] struct {
+	id        string
+	marshal   func(proto.Message) ([]byte, error)
+	unmarshal func([]byte, proto.Message) error
+}
+
+// CodecID identifies the format the codec writes
+func (c codec[T]) CodecID() string {
+	return c.id
+}
+
+// Encode marshals the message
+func (c codec[T]) Encode(v T) ([]byte, error) {
+	return c.marshal(v)
+}
+
+// Decode unmarshals data into a new message and stores it in v
+func (c codec[T]) Decode(data []byte, v *T) error {
+	msg, err := decode(data, reflect.TypeOf(v).Elem(), c.unmarshal)
+	if err != nil {
+		return err
+	}
+
+	*v = msg.(T)
+	return nil
+}
+
+// typeCodec is the persist.TypeCodec registered for every proto.Message type
+type typeCodec struct{}
+
+// CodecID identifies the binary wire format, the persist.DefaultCodec includes it in its own ID
+func (typeCodec) CodecID() string {
+	return "proto"
+}
+
+// Encode marshals the message using the binary wire format
+func (typeCodec) Encode(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+
+	return proto.Marshal(msg)
+}
+
+// Decode unmarshals data into a new message using the binary wire format. v must be a pointer to a message pointer
+func (typeCodec) Decode(data []byte, v any) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Pointer || !ptr.Elem().Type().Implements(messageType) {
+		return fmt.Errorf("%T is not a pointer to a proto.Message", v)
+	}
+
+	msg, err := decode(data, ptr.Elem().Type(), proto.Unmarshal)
+	if err != nil {
+		return err
+	}
+
+	ptr.Elem().Set(reflect.ValueOf(msg))
+	return nil
+}
+
+// decode allocates a new message of type t, which must be a pointer to a message, and unmarshals data into it
+func decode(data []byte, t reflect.Type, unmarshal func([]byte, proto.Message) error) (proto.Message, error) {
+	msg := reflect.New(t.Elem()).Interface().(proto.Message)
+	err := unmarshal(data, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,157 @@
+package protocodec
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/weave-lab/cachin/persist"
+)
+
+func testMessage(t testing.TB) *structpb.Struct {
+	msg, err := structpb.NewStruct(map[string]any{
+		"id":      42,
+		"name":    "cachin",
+		"active":  true,
+		"members": []any{"alice", "bob", "carol"},
+		"labels":  map[string]any{"tier": "1"},
+		"deleted": nil,
+	})
+	if err != nil {
+		t.Fatal("failed to create test message", err)
+	}
+
+	return msg
+}
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec persist.Codec[*structpb.Struct]
+	}{
+		{"binary", Binary[*structpb.Struct]()},
+		{"json", JSON[*structpb.Struct]()},
+		{"default", persist.DefaultCodec[*structpb.Struct]()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := testMessage(t)
+			raw, err := tt.codec.Encode(want)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			var got *structpb.Struct
+			if err := tt.codec.Decode(raw, &got); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("Decode() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecs_decodeError(t *testing.T) {
+	got := timestamppb.New(time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC))
+	want := proto.Clone(got)
+	if err := Binary[*timestamppb.Timestamp]().Decode([]byte{0xff, 0xff}, &got); err == nil {
+		t.Error("Decode() expected an error")
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("Decode() modified the value on error, got %v", got)
+	}
+}
+
+func TestDefaultCodec_registered(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore(persist.Forever, 0)
+	want := timestamppb.New(time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC))
+
+	d := persist.NewData[*timestamppb.Timestamp](store, "test")
+	if err := d.Set(ctx, want); err != nil {
+		t.Fatal("Set() error", err)
+	}
+
+	// the stored value should be the binary wire format, not JSON
+	raw, _, _ := store.Get(ctx, "test")
+	wantRaw, _ := proto.Marshal(want)
+	if string(raw) != string(wantRaw) {
+		t.Errorf("Set() stored %v, want %v", raw, wantRaw)
+	}
+
+	loaded := persist.NewData[*timestamppb.Timestamp](store, "test")
+	if err := loaded.Load(ctx); err != nil {
+		t.Fatal("Load() error", err)
+	}
+	if !proto.Equal(loaded.Get(), want) {
+		t.Errorf("Load() = %v, want %v", loaded.Get(), want)
+	}
+}
+
+func TestDefaultCodec_registeredID(t *testing.T) {
+	ctx := context.Background()
+	store := persist.NewMemoryStore(persist.Forever, 0)
+	want := timestamppb.New(time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC))
+
+	if got := persist.DefaultCodec[*timestamppb.Timestamp]().(persist.IdentifiedCodec).CodecID(); got != "default+proto" {
+		t.Errorf("DefaultCodec().CodecID() = %q, want %q", got, "default+proto")
+	}
+
+	// a value written by the default codec before protocodec was registered is JSON, so it must not be decoded
+	raw, _ := persist.JSONCodec[*timestamppb.Timestamp]{}.Encode(want)
+	err := store.SetEnvelope(ctx, "test", &persist.Envelope{Codec: "default", Value: raw})
+	if err != nil {
+		t.Fatal("SetEnvelope() error", err)
+	}
+
+	loaded := persist.NewData[*timestamppb.Timestamp](store, "test")
+	if err := loaded.Load(ctx); err == nil {
+		t.Errorf("Load() = %v, want a miss for a value written by another codec", loaded.Get())
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	msg := testMessage(b)
+	benchmarks := []struct {
+		name  string
+		codec persist.Codec[*structpb.Struct]
+	}{
+		{"binary", Binary[*structpb.Struct]()},
+		{"protojson", JSON[*structpb.Struct]()},
+		{"encoding/json", persist.JSONCodec[*structpb.Struct]{}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = bm.codec.Encode(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	msg := testMessage(b)
+
+	// encoding/json can't decode oneofs, so it's left out since it would only measure how fast it fails
+	benchmarks := []struct {
+		name  string
+		codec persist.Codec[*structpb.Struct]
+	}{
+		{"binary", Binary[*structpb.Struct]()},
+		{"protojson", JSON[*structpb.Struct]()},
+	}
+	for _, bm := range benchmarks {
+		raw, _ := bm.codec.Encode(msg)
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var v *structpb.Struct
+				_ = bm.codec.Decode(raw, &v)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly indicates a write was attempted on a store that can only be read. MultiStore ignores it, so read-only
+// stores can be combined with writable ones
+var ErrReadOnly = errors.New("store is read only")
+
+// ManifestFile is the name of the file in the root of an FSReadOnlyStore's filesystem that holds its Manifest
+const ManifestFile = "manifest.json"
+
+// Manifest maps keys to the time their values were last set. It's stored as JSON in ManifestFile and provides the
+// timestamps of raw values in an FSReadOnlyStore, since filesystems like embed.FS don't record modification times
+type Manifest map[string]time.Time
+
+// FSReadOnlyStore is a Store that reads cache data from an fs.FS, such as an embed.FS holding a snapshot of a cache
+// that is shipped inside the binary. Files use the same layout as an FsStore, so a snapshot can be created by
+// copying an FsStore's root directory. Values written by an FsStore keep their own timestamps, files holding only
+// a raw value use the timestamp from the Manifest and are treated as never having been set if it's missing.
+// Combine it with a writable store in a MultiStore, listed after the writable store, to start with the snapshot and
+// overlay fresher data.
+type FSReadOnlyStore struct {
+	fsys   fs.FS
+	layout layout
+
+	manifestOnce sync.Once
+	manifest     Manifest
+	manifestErr  error
+}
+
+// ReadOnlyOption configures an FSReadOnlyStore. WithShardedLayout returns one
+type ReadOnlyOption interface {
+	applyReadOnly(*readOnlyOptions)
+}
+
+// readOnlyOptions holds the configuration set by each ReadOnlyOption
+type readOnlyOptions struct {
+	shardLevels int
+}
+
+// NewFSReadOnlyStore creates a new FSReadOnlyStore that reads files from the root of fsys. fs.Sub can be used to
+// read from a subdirectory. If the files were written by an FsStore created WithShardedLayout the same option must
+// be provided
+func NewFSReadOnlyStore(fsys fs.FS, useSafeKey bool, opts ...ReadOnlyOption) *FSReadOnlyStore {
+	var o readOnlyOptions
+	for _, opt := range opts {
+		opt.applyReadOnly(&o)
+	}
+
+	return &FSReadOnlyStore{
+		fsys:   fsys,
+		layout: newLayout(useSafeKey, o.shardLevels),
+	}
+}
+
+// Get reads the file that matches the provided key. If the file is missing no error will be returned
+func (s *FSReadOnlyStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope reads the envelope from the file that matches the provided key. Files that hold only the raw value
+// use the key's timestamp from the Manifest. If the file is missing no error will be returned
+func (s *FSReadOnlyStore) GetEnvelope(_ context.Context, key string) (*Envelope, error) {
+	name := s.layout.path(key)
+	if !fs.ValidPath(name) || name == ManifestFile {
+		return nil, nil
+	}
+
+	raw, err := fs.ReadFile(s.fsys, name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	env := &Envelope{}
+	err = env.UnmarshalBinary(raw)
+	if errors.Is(err, ErrNotEnvelope) {
+		manifest, err := s.loadManifest()
+		if err != nil {
+			return nil, err
+		}
+
+		ts := manifest[key]
+		return &Envelope{Created: ts, Updated: ts, Value: raw}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if env.Key != "" && env.Key != key {
+		return nil, nil
+	}
+
+	return env, nil
+}
+
+// Set always returns ErrReadOnly
+func (s *FSReadOnlyStore) Set(context.Context, string, []byte) error {
+	return ErrReadOnly
+}
+
+// SetEnvelope always returns ErrReadOnly
+func (s *FSReadOnlyStore) SetEnvelope(context.Context, string, *Envelope) error {
+	return ErrReadOnly
+}
+
+// Delete always returns ErrReadOnly
+func (s *FSReadOnlyStore) Delete(context.Context, string) error {
+	return ErrReadOnly
+}
+
+// Touch always returns ErrReadOnly
+func (s *FSReadOnlyStore) Touch(context.Context, string) error {
+	return ErrReadOnly
+}
+
+// List walks the filesystem and returns the keys of all files that start with the provided prefix. The manifest
+// and files an FsStore uses for locking and temporary writes are skipped. Files named after a hashed key are read to
+// find their key
+func (s *FSReadOnlyStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != "." && d.Name() == lockDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if name == ManifestFile || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+
+		key, hashed, ok := s.layout.key(name)
+		if !ok {
+			// this file is not a cache entry
+			return nil
+		}
+		if hashed {
+			raw, err := fs.ReadFile(s.fsys, name)
+			if err != nil {
+				return err
+			}
+
+			env := &Envelope{}
+			if env.UnmarshalBinary(raw) != nil || env.Key == "" || s.layout.path(env.Key) != name {
+				return nil
+			}
+			key = env.Key
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// loadManifest reads the manifest the first time it's needed. A missing manifest is treated as an empty one
+func (s *FSReadOnlyStore) loadManifest() (Manifest, error) {
+	s.manifestOnce.Do(func() {
+		raw, err := fs.ReadFile(s.fsys, ManifestFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			s.manifest = Manifest{}
+		case err != nil:
+			s.manifestErr = err
+		default:
+			err = json.Unmarshal(raw, &s.manifest)
+			if err != nil {
+				s.manifestErr = fmt.Errorf("%w | invalid manifest: %s", ErrNotSerializable, err)
+			}
+		}
+	})
+
+	return s.manifest, s.manifestErr
+}
@@ -0,0 +1,233 @@
+package persist
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFSReadOnlyStore_Get(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	updated := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	env, err := (&Envelope{Created: created, Updated: updated, Value: []byte(`envelope`)}).MarshalBinary()
+	if err != nil {
+		t.Fatal("failed to marshal envelope", err)
+	}
+
+	tests := []struct {
+		name       string
+		fsys       fstest.MapFS
+		useSafeKey bool
+		key        string
+		want       []byte
+		wantTS     time.Time
+		wantErr    error
+	}{
+		{
+			"envelope",
+			fstest.MapFS{
+				"test_key": {Data: env},
+			},
+			false,
+			"test_key",
+			[]byte(`envelope`),
+			updated,
+			nil,
+		},
+		{
+			"raw value with manifest",
+			fstest.MapFS{
+				"a/test_key": {Data: []byte(`raw`)},
+				ManifestFile: {Data: []byte(`{"a/test_key": "2023-01-02T00:00:00Z"}`)},
+			},
+			false,
+			"a/test_key",
+			[]byte(`raw`),
+			updated,
+			nil,
+		},
+		{
+			"raw value without manifest",
+			fstest.MapFS{
+				"test_key": {Data: []byte(`raw`)},
+			},
+			false,
+			"test_key",
+			[]byte(`raw`),
+			time.Time{},
+			nil,
+		},
+		{
+			"use safe key",
+			fstest.MapFS{
+				SafeKey("a/test_key"): {Data: env},
+			},
+			true,
+			"a/test_key",
+			[]byte(`envelope`),
+			updated,
+			nil,
+		},
+		{
+			"missing",
+			fstest.MapFS{},
+			false,
+			"test_key",
+			nil,
+			time.Time{},
+			nil,
+		},
+		{
+			"invalid path",
+			fstest.MapFS{},
+			false,
+			"../test_key",
+			nil,
+			time.Time{},
+			nil,
+		},
+		{
+			"manifest is not a key",
+			fstest.MapFS{
+				ManifestFile: {Data: []byte(`{}`)},
+			},
+			false,
+			ManifestFile,
+			nil,
+			time.Time{},
+			nil,
+		},
+		{
+			"invalid manifest",
+			fstest.MapFS{
+				"test_key":   {Data: []byte(`raw`)},
+				ManifestFile: {Data: []byte(`not json`)},
+			},
+			false,
+			"test_key",
+			nil,
+			time.Time{},
+			ErrNotSerializable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFSReadOnlyStore(tt.fsys, tt.useSafeKey)
+			got, gotTS, err := s.Get(context.Background(), tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("FSReadOnlyStore.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FSReadOnlyStore.Get() got = %s, want %s", got, tt.want)
+			}
+			if !gotTS.Equal(tt.wantTS) {
+				t.Errorf("FSReadOnlyStore.Get() gotTS = %v, want %v", gotTS, tt.wantTS)
+			}
+		})
+	}
+}
+
+func TestFSReadOnlyStore_List(t *testing.T) {
+	tests := []struct {
+		name       string
+		fsys       fstest.MapFS
+		useSafeKey bool
+		prefix     string
+		want       []string
+	}{
+		{
+			"nested keys",
+			fstest.MapFS{
+				"a/one":      {},
+				"a/two":      {},
+				"b/one":      {},
+				ManifestFile: {},
+			},
+			false,
+			"a/",
+			[]string{"a/one", "a/two"},
+		},
+		{
+			"use safe key",
+			fstest.MapFS{
+				SafeKey("a/one"): {},
+				SafeKey("b/one"): {},
+				ManifestFile:     {},
+			},
+			true,
+			"",
+			[]string{"a/one", "b/one"},
+		},
+		{
+			"skips fs store files",
+			fstest.MapFS{
+				"one":                          {},
+				lockDir + "/" + SafeKey("one"): {},
+				tempPrefix + "one-1234":        {},
+			},
+			false,
+			"",
+			[]string{"one"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewFSReadOnlyStore(tt.fsys, tt.useSafeKey).List(context.Background(), tt.prefix)
+			if err != nil {
+				t.Errorf("FSReadOnlyStore.List() error = %v", err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FSReadOnlyStore.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFSReadOnlyStore_writes(t *testing.T) {
+	ctx := context.Background()
+	s := NewFSReadOnlyStore(fstest.MapFS{}, false)
+	if err := s.Set(ctx, "test_key", []byte(`test`)); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("FSReadOnlyStore.Set() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := s.SetEnvelope(ctx, "test_key", &Envelope{}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("FSReadOnlyStore.SetEnvelope() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := s.Delete(ctx, "test_key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("FSReadOnlyStore.Delete() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := s.Touch(ctx, "test_key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("FSReadOnlyStore.Touch() error = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestFSReadOnlyStore_overlay(t *testing.T) {
+	ctx := context.Background()
+	snapshot := NewFSReadOnlyStore(fstest.MapFS{
+		"test_key":   {Data: []byte(`snapshot`)},
+		ManifestFile: {Data: []byte(`{"test_key": "2023-01-02T00:00:00Z"}`)},
+	}, false)
+	s := NewMultiStore(Forever, []Store{NewMemoryStore(time.Hour, 1<<20), snapshot})
+
+	got, _, err := s.Get(ctx, "test_key")
+	if err != nil || string(got) != "snapshot" {
+		t.Errorf("MultiStore.Get() = %s, %v, want snapshot", got, err)
+	}
+
+	// writes skip the snapshot and fresher data is read from the writable store
+	if err := s.Set(ctx, "test_key", []byte(`fresh`)); err != nil {
+		t.Errorf("MultiStore.Set() error = %v", err)
+	}
+	if err := s.Delete(ctx, "other_key"); err != nil {
+		t.Errorf("MultiStore.Delete() error = %v", err)
+	}
+
+	got, _, err = s.Get(ctx, "test_key")
+	if err != nil || string(got) != "fresh" {
+		t.Errorf("MultiStore.Get() = %s, %v, want fresh", got, err)
+	}
+}
@@ -4,52 +4,308 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/redis/go-redis/v9"
 )
 
-// RedisStore is a Store that uses redis to store cache data
+// RedisStore is a Store that uses redis to store cache data. It works with any redis.UniversalClient, so the same
+// store can talk to a single server, a cluster or servers managed by sentinel. Every call passes its context to
+// the client, so cancellation and deadlines are respected. GetEnvelopes and SetEnvelopes read and write many keys
+// in a single round trip. Envelopes written with a TTL expire in redis once it has passed.
 type RedisStore struct {
-	client *redis.Client
+	client redis.UniversalClient
+	prefix string
+	clock  Clock
 }
 
-// NewRedisStore creates a new RedisStore.
-func NewRedisStore(client *redis.Client) *RedisStore {
+// WithKeyPrefix prefixes every key a RedisStore reads or writes, so a single redis database can be shared by
+// multiple applications. Unlike a NamespaceStore the prefix is not encoded, so it's visible to other redis clients
+func WithKeyPrefix(prefix string) RedisOption {
+	return redisOptionFunc(func(opts *redisOptions) {
+		opts.keyPrefix = prefix
+	})
+}
+
+// RedisOption configures a RedisStore. WithClock and WithKeyPrefix return one
+type RedisOption interface {
+	applyRedis(*redisOptions)
+}
+
+// redisOptionFunc is a RedisOption that sets a field of redisOptions
+type redisOptionFunc func(*redisOptions)
+
+func (f redisOptionFunc) applyRedis(opts *redisOptions) {
+	f(opts)
+}
+
+func (o ClockOption) applyRedis(opts *redisOptions) {
+	opts.clock = o.clock
+}
+
+// redisOptions holds the configuration set by each RedisOption
+type redisOptions struct {
+	clock     Clock
+	keyPrefix string
+}
+
+// NewRedisStore creates a new RedisStore. The caller owns client and must close it once the store is no longer used
+func NewRedisStore(client redis.UniversalClient, opts ...RedisOption) *RedisStore {
+	o := redisOptions{clock: SystemClock{}}
+	for _, opt := range opts {
+		opt.applyRedis(&o)
+	}
+
 	return &RedisStore{
 		client: client,
+		prefix: o.keyPrefix,
+		clock:  o.clock,
 	}
 }
 
 // Get searches for a key that matches the provided key in the redis cache. If the key does not exist
 // no error will be returned
-func (s *RedisStore) Get(_ context.Context, key string) ([]byte, time.Time, error) {
-	cmd := s.client.Get(SafeKey(key))
-	raw, err := cmd.Bytes()
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope reads the envelope stored at the provided key. Keys written before envelopes were used hold JSON
+// encoded rawData, which is still read. If the key does not exist no error will be returned
+func (s *RedisStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	raw, err := s.client.Get(ctx, s.redisKey(key)).Bytes()
 	switch {
 	case errors.Is(err, redis.Nil):
-		return nil, time.Time{}, nil
+		return nil, nil
 	case err != nil:
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
-	d := rawData{}
-	err = json.Unmarshal(raw, &d)
-	if err != nil {
-		return nil, time.Time{}, err
+	return decodeRedisValue(raw)
+}
+
+// GetEnvelopes reads the envelopes of every key in a single pipeline. The returned envelopes are in the same order
+// as the keys, with nil for keys that do not exist
+func (s *RedisStore) GetEnvelopes(ctx context.Context, keys []string) ([]*Envelope, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, s.redisKey(key))
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
 	}
 
-	return d.Raw, d.LastSet, nil
+	envs := make([]*Envelope, len(keys))
+	for i, cmd := range cmds {
+		raw, err := cmd.Bytes()
+		switch {
+		case errors.Is(err, redis.Nil):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("%w | key %q", err, keys[i])
+		}
+
+		envs[i], err = decodeRedisValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w | key %q", err, keys[i])
+		}
+	}
+
+	return envs, nil
 }
 
 // Set updates the redis cache, if the key can't be updated or created an error will
 // be returned
-func (s *RedisStore) Set(_ context.Context, key string, val []byte) error {
-	d, err := json.Marshal(rawData{LastSet: time.Now(), Raw: val})
+func (s *RedisStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and writes it to the redis cache
+func (s *RedisStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	env = env.clone()
+	env.stamp(s.clock.Now())
+	return s.write(ctx, s.client, key, env)
+}
+
+// SetEnvelopes stamps every envelope with the stores clock and writes them in a single pipeline. The writes are not
+// atomic, if any of them fail an error is returned but the rest may have been written
+func (s *RedisStore) SetEnvelopes(ctx context.Context, envs map[string]*Envelope) error {
+	if len(envs) == 0 {
+		return nil
+	}
+
+	now := s.clock.Now()
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, env := range envs {
+			env = env.clone()
+			env.stamp(now)
+			err := s.write(ctx, pipe, key, env)
+			if err != nil {
+				return fmt.Errorf("%w | key %q", err, key)
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Delete removes the provided key from the redis cache. If the key does not exist no error will be returned
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.redisKey(key)).Err()
+}
+
+// Touch updates the last set time of the provided key without changing its value. If the key does not exist
+// no error will be returned
+func (s *RedisStore) Touch(ctx context.Context, key string) error {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return err
+	}
+
+	env.Updated = s.clock.Now()
+	return s.write(ctx, s.client, key, env)
+}
+
+// write writes the envelope to the redis cache as is, using either the client or a pipeline. If the envelope has a TTL
+// the key expires in redis once it has passed, an envelope that has already expired is deleted instead
+func (s *RedisStore) write(ctx context.Context, c redis.Cmdable, key string, env *Envelope) error {
+	raw, err := env.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
-	cmd := s.client.Set(SafeKey(key), d, Forever)
-	return cmd.Err()
+	expiration := Forever
+	if env.TTL != Forever {
+		expiration = env.Updated.Add(env.TTL).Sub(s.clock.Now())
+		if expiration <= 0 {
+			return c.Del(ctx, s.redisKey(key)).Err()
+		}
+	}
+
+	// a pipelined command has no result until the pipeline runs, so this only catches errors from the client
+	return c.Set(ctx, s.redisKey(key), raw, expiration).Err()
+}
+
+// List scans the redis cache for keys that start with the provided prefix. Keys that were not created by a
+// RedisStore with the same key prefix are ignored. When the client is connected to a cluster every master is scanned
+func (s *RedisStore) List(ctx context.Context, prefix string) ([]string, error) {
+	match := escapeRedisPattern(s.prefix) + safeKeyPrefix(prefix) + "*"
+
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, match, 0).Iterator()
+		for iter.Next(ctx) {
+			key, err := unsafeKey(strings.TrimPrefix(iter.Val(), s.prefix))
+			if err != nil || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := s.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
+	} else {
+		err = scan(ctx, s.client)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// unlockScript deletes a lock only if it is still held by the caller, checking and deleting in a single script
+// makes sure a lock that expired and was acquired by someone else is never released by mistake
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// TryLock attempts to acquire a lock for the provided key. The lock is stored in redis next to the key and expires
+// after ttl so a crashed holder can not keep it forever. If the lock is already held ErrLockHeld will be returned
+func (s *RedisStore) TryLock(ctx context.Context, key string, ttl time.Duration) (Unlock, error) {
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	lockKey := s.redisKey(key) + ".lock"
+	ok, err := s.client.SetNX(ctx, lockKey, token, ttl).Result()
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok:
+		return nil, ErrLockHeld
+	}
+
+	return func(ctx context.Context) error {
+		return unlockScript.Run(ctx, s.client, []string{lockKey}, token).Err()
+	}, nil
+}
+
+// redisKey returns the redis key a key is stored under
+func (s *RedisStore) redisKey(key string) string {
+	return s.prefix + SafeKey(key)
+}
+
+// decodeRedisValue decodes a value read from redis, which is either an envelope or JSON encoded rawData
+func decodeRedisValue(raw []byte) (*Envelope, error) {
+	env := &Envelope{}
+	err := env.UnmarshalBinary(raw)
+	if !errors.Is(err, ErrNotEnvelope) {
+		if err != nil {
+			return nil, err
+		}
+		return env, nil
+	}
+
+	d := rawData{}
+	err = json.Unmarshal(raw, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{Created: d.LastSet, Updated: d.LastSet, Value: d.Raw}, nil
+}
+
+// escapeRedisPattern escapes the characters redis treats as wildcards in a SCAN match pattern
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
 }
@@ -0,0 +1,260 @@
+package persist
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisStore creates a RedisStore backed by an in process redis server that is shut down when the test ends
+func newTestRedisStore(t *testing.T, opts ...RedisOption) *RedisStore {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return NewRedisStore(client, opts...)
+}
+
+func TestRedisStore_List(t *testing.T) {
+	ctx := context.Background()
+	s := newTestRedisStore(t)
+	for _, key := range []string{"app/a", "app/b", "apple", "other"} {
+		if err := s.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatal("RedisStore.List() failed to set key", err)
+		}
+	}
+
+	// keys written by something other than the store should be ignored
+	s.client.Set(ctx, "not base64!", "value", 0)
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{
+			"all keys",
+			"",
+			[]string{"app/a", "app/b", "apple", "other"},
+		},
+		{
+			"short prefix",
+			"ap",
+			[]string{"app/a", "app/b", "apple"},
+		},
+		{
+			"long prefix",
+			"app/",
+			[]string{"app/a", "app/b"},
+		},
+		{
+			"no matches",
+			"missing",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(ctx, tt.prefix)
+			if err != nil {
+				t.Fatalf("RedisStore.List() error = %v", err)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RedisStore.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisStore_Delete(t *testing.T) {
+	ctx := context.Background()
+	s := newTestRedisStore(t)
+	if err := s.Set(ctx, "test", []byte("value")); err != nil {
+		t.Fatal("RedisStore.Delete() failed to set key", err)
+	}
+
+	if err := s.Delete(ctx, "test"); err != nil {
+		t.Errorf("RedisStore.Delete() error = %v", err)
+	}
+	if err := s.Delete(ctx, "missing"); err != nil {
+		t.Errorf("RedisStore.Delete() missing key error = %v", err)
+	}
+
+	got, lastUpdate, err := s.Get(ctx, "test")
+	if err != nil || got != nil || !lastUpdate.IsZero() {
+		t.Errorf("RedisStore.Delete() key still exists, got = %s, %v, %v", got, lastUpdate, err)
+	}
+}
+
+func TestRedisStore_WithKeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	// the prefixes contain characters redis treats as wildcards
+	one := NewRedisStore(client, WithKeyPrefix("app[1]*:"))
+	two := NewRedisStore(client, WithKeyPrefix("app[2]*:"))
+	for _, s := range []*RedisStore{one, two} {
+		if err := s.Set(ctx, "test_key", []byte(s.prefix)); err != nil {
+			t.Fatal("RedisStore.Set() error", err)
+		}
+	}
+
+	if !server.Exists("app[1]*:" + SafeKey("test_key")) {
+		t.Errorf("RedisStore.Set() did not prefix the key, keys = %v", server.Keys())
+	}
+	got, _, err := one.Get(ctx, "test_key")
+	if err != nil || string(got) != "app[1]*:" {
+		t.Errorf("RedisStore.Get() = %s, %v, want app[1]*:", got, err)
+	}
+	keys, err := one.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"test_key"}) {
+		t.Errorf("RedisStore.List() = %v, %v, want [test_key]", keys, err)
+	}
+
+	// a store without a prefix can't decode the prefixed keys
+	keys, err = NewRedisStore(client).List(ctx, "")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("RedisStore.List() without prefix = %v, %v, want none", keys, err)
+	}
+}
+
+func TestRedisStore_Envelopes(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := newTestRedisStore(t, WithClock(clock))
+
+	envs := map[string]*Envelope{
+		"one": {Value: []byte(`one`), TTL: time.Minute},
+		"two": {Value: []byte(`two`), Codec: "json"},
+	}
+	if err := s.SetEnvelopes(ctx, envs); err != nil {
+		t.Fatal("RedisStore.SetEnvelopes() error", err)
+	}
+	if !envs["one"].Updated.IsZero() {
+		t.Error("RedisStore.SetEnvelopes() modified the provided envelopes")
+	}
+
+	got, err := s.GetEnvelopes(ctx, []string{"two", "missing", "one"})
+	if err != nil {
+		t.Fatalf("RedisStore.GetEnvelopes() error = %v", err)
+	}
+	want := []*Envelope{
+		{Value: []byte(`two`), Codec: "json", Created: clock.Now(), Updated: clock.Now()},
+		nil,
+		{Value: []byte(`one`), TTL: time.Minute, Created: clock.Now(), Updated: clock.Now()},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("RedisStore.GetEnvelopes() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if (got[i] == nil) != (want[i] == nil) {
+			t.Errorf("RedisStore.GetEnvelopes()[%d] = %+v, want %+v", i, got[i], want[i])
+			continue
+		}
+		if want[i] == nil {
+			continue
+		}
+		if !bytes.Equal(got[i].Value, want[i].Value) || got[i].Codec != want[i].Codec || got[i].TTL != want[i].TTL || !got[i].Updated.Equal(want[i].Updated) {
+			t.Errorf("RedisStore.GetEnvelopes()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if got, err := s.GetEnvelopes(ctx, nil); err != nil || got != nil {
+		t.Errorf("RedisStore.GetEnvelopes() no keys = %v, %v, want nil", got, err)
+	}
+}
+
+func TestRedisStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	s := NewRedisStore(client, WithClock(clock))
+
+	pttl := func(key string) time.Duration {
+		t.Helper()
+		got, err := client.PTTL(ctx, s.redisKey(key)).Result()
+		if err != nil {
+			t.Fatalf("PTTL(%s) error = %v", key, err)
+		}
+		return got
+	}
+
+	_ = s.Set(ctx, "forever", []byte(`forever`))
+	if got := pttl("forever"); got != -1 {
+		t.Errorf("RedisStore.Set() PTTL = %v, want no expiry", got)
+	}
+
+	_ = s.SetEnvelope(ctx, "hour", &Envelope{Value: []byte(`hour`), TTL: time.Hour})
+	if got := pttl("hour"); got != time.Hour {
+		t.Errorf("RedisStore.SetEnvelope() PTTL = %v, want %v", got, time.Hour)
+	}
+
+	_ = s.SetEnvelopes(ctx, map[string]*Envelope{"minute": {Value: []byte(`minute`), TTL: time.Minute}})
+	if got := pttl("minute"); got != time.Minute {
+		t.Errorf("RedisStore.SetEnvelopes() PTTL = %v, want %v", got, time.Minute)
+	}
+
+	// touching restarts the expiry from the new update time
+	server.FastForward(10 * time.Minute)
+	clock.Advance(10 * time.Minute)
+	_ = s.Touch(ctx, "hour")
+	if got := pttl("hour"); got != time.Hour {
+		t.Errorf("RedisStore.Touch() PTTL = %v, want %v", got, time.Hour)
+	}
+	if env, _ := s.GetEnvelope(ctx, "minute"); env != nil {
+		t.Errorf("RedisStore.GetEnvelope() after TTL = %+v, want expired", env)
+	}
+}
+
+func TestRedisStore_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := newTestRedisStore(t)
+	if err := s.Set(ctx, "test_key", []byte(`test`)); !errors.Is(err, context.Canceled) {
+		t.Errorf("RedisStore.Set() error = %v, want %v", err, context.Canceled)
+	}
+	if _, _, err := s.Get(ctx, "test_key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RedisStore.Get() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRedisStore_cluster(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{server.Addr()}})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	s := NewRedisStore(client)
+	err := s.SetEnvelopes(ctx, map[string]*Envelope{"a": {Value: []byte(`a`)}, "b": {Value: []byte(`b`)}})
+	if err != nil {
+		t.Fatal("RedisStore.SetEnvelopes() error", err)
+	}
+
+	keys, err := s.List(ctx, "")
+	sort.Strings(keys)
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("RedisStore.List() = %v, %v, want [a b]", keys, err)
+	}
+}
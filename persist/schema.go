@@ -0,0 +1,115 @@
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrSchemaMismatch indicates a stored value was written with a different schema than the one Data expects. Unless
+// a migration is provided with WithMigration, Data treats these values as a cache miss.
+var ErrSchemaMismatch = errors.New("stored data has a different schema")
+
+// WithSchema sets the schema version recorded with each value Data stores, replacing the automatically computed
+// Fingerprint. Values stored with a different schema are treated as a miss, or migrated if WithMigration is provided.
+// Bumping the version invalidates every stored value even if the type has not changed
+func WithSchema(version string) Option {
+	return optionFunc(func(opts *options) {
+		opts.schema = version
+	})
+}
+
+// WithMigration sets a function Data uses to convert values stored with a different schema instead of treating them
+// as a miss. It's passed the stored schema and the raw bytes written by the old version's codec. If it fails, the
+// value is treated as a miss. The migration's type must match the type of the Data it's passed to, otherwise NewData
+// will panic
+func WithMigration[T any](migrate func(schema string, raw []byte) (T, error)) Option {
+	return optionFunc(func(opts *options) {
+		opts.migration = migrate
+	})
+}
+
+// Fingerprint returns a short hash of the structure of T. It's what Data records as the schema of each value unless
+// WithSchema is provided. The fingerprint changes when exported fields are added, removed, renamed, retagged or change
+// type, including in nested types, so values stored by an older version of a type are not decoded into the new one.
+// Unexported fields, methods and type names don't affect it. Types that control their own serialization, such as
+// Serializable types or json.Marshaler types, are fingerprinted by name since their structure says nothing about their
+// encoding
+func Fingerprint[T any]() string {
+	var b strings.Builder
+	describeType(&b, reflect.TypeOf((*T)(nil)).Elem(), map[reflect.Type]bool{})
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+var (
+	jsonMarshalerInterface   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	binaryMarshalerInterface = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	textMarshalerInterface   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// hasCustomEncoding reports whether t, or a pointer to t, controls its own serialization
+func hasCustomEncoding(t reflect.Type) bool {
+	for _, i := range []reflect.Type{serializableInterface, jsonMarshalerInterface, binaryMarshalerInterface, textMarshalerInterface} {
+		if t.Implements(i) || reflect.PointerTo(t).Implements(i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describeType writes a canonical description of t's structure to b. Types being described are tracked in visiting
+// so recursive types terminate
+func describeType(b *strings.Builder, t reflect.Type, visiting map[reflect.Type]bool) {
+	if t.Kind() != reflect.Interface && t.Kind() != reflect.Pointer && hasCustomEncoding(t) {
+		b.WriteString("custom(" + t.PkgPath() + "." + t.Name() + ")")
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		b.WriteString("*")
+		describeType(b, t.Elem(), visiting)
+	case reflect.Slice:
+		b.WriteString("[]")
+		describeType(b, t.Elem(), visiting)
+	case reflect.Array:
+		b.WriteString("[" + strconv.Itoa(t.Len()) + "]")
+		describeType(b, t.Elem(), visiting)
+	case reflect.Map:
+		b.WriteString("map[")
+		describeType(b, t.Key(), visiting)
+		b.WriteString("]")
+		describeType(b, t.Elem(), visiting)
+	case reflect.Struct:
+		if visiting[t] {
+			b.WriteString("cycle(" + t.PkgPath() + "." + t.Name() + ")")
+			return
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		b.WriteString("struct{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() && !f.Anonymous {
+				continue
+			}
+
+			fmt.Fprintf(b, "%s %q ", f.Name, f.Tag)
+			describeType(b, f.Type, visiting)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(t.Kind().String())
+	}
+}
@@ -0,0 +1,209 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type schemaV1 struct {
+	Name string `json:"name"`
+}
+
+type schemaV1Copy struct {
+	Name    string `json:"name"`
+	private int
+}
+
+type schemaAddedField struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type schemaRetagged struct {
+	Name string `json:"full_name"`
+}
+
+type schemaNested struct {
+	Users []schemaV1 `json:"users"`
+}
+
+type schemaNestedChanged struct {
+	Users []schemaRetagged `json:"users"`
+}
+
+type schemaRecursive struct {
+	Name     string             `json:"name"`
+	Children []*schemaRecursive `json:"children"`
+}
+
+type schemaTime struct {
+	At time.Time `json:"at"`
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     string
+		b     string
+		equal bool
+	}{
+		{
+			"same type",
+			Fingerprint[schemaV1](),
+			Fingerprint[schemaV1](),
+			true,
+		},
+		{
+			"renamed type and unexported field",
+			Fingerprint[schemaV1](),
+			Fingerprint[schemaV1Copy](),
+			true,
+		},
+		{
+			"added field",
+			Fingerprint[schemaV1](),
+			Fingerprint[schemaAddedField](),
+			false,
+		},
+		{
+			"retagged field",
+			Fingerprint[schemaV1](),
+			Fingerprint[schemaRetagged](),
+			false,
+		},
+		{
+			"nested change",
+			Fingerprint[schemaNested](),
+			Fingerprint[schemaNestedChanged](),
+			false,
+		},
+		{
+			"pointer",
+			Fingerprint[schemaV1](),
+			Fingerprint[*schemaV1](),
+			false,
+		},
+		{
+			"recursive",
+			Fingerprint[schemaRecursive](),
+			Fingerprint[schemaRecursive](),
+			true,
+		},
+		{
+			"custom encoding",
+			Fingerprint[schemaTime](),
+			Fingerprint[struct {
+				At time.Time `json:"at"`
+			}](),
+			true,
+		},
+		{
+			"basic types",
+			Fingerprint[int](),
+			Fingerprint[string](),
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (tt.a == tt.b) != tt.equal {
+				t.Errorf("Fingerprint() = %s and %s, want equal = %v", tt.a, tt.b, tt.equal)
+			}
+		})
+	}
+}
+
+func TestData_schema(t *testing.T) {
+	migrate := func(schema string, raw []byte) (schemaRetagged, error) {
+		if schema != "v1" {
+			return schemaRetagged{}, fmt.Errorf("can't migrate from %s", schema)
+		}
+
+		old := schemaV1{}
+		err := json.Unmarshal(raw, &old)
+		return schemaRetagged{Name: old.Name}, err
+	}
+
+	tests := []struct {
+		name    string
+		stored  []Option
+		opts    []Option
+		want    schemaRetagged
+		wantErr error
+	}{
+		{
+			"same version",
+			[]Option{WithSchema("v2")},
+			[]Option{WithSchema("v2")},
+			// an explicit version is trusted, so it's up to the caller to bump it when the type changes
+			schemaRetagged{},
+			nil,
+		},
+		{
+			"fingerprint mismatch",
+			nil,
+			nil,
+			schemaRetagged{},
+			ErrSchemaMismatch,
+		},
+		{
+			"version mismatch",
+			[]Option{WithSchema("v1")},
+			[]Option{WithSchema("v2")},
+			schemaRetagged{},
+			ErrSchemaMismatch,
+		},
+		{
+			"migrated",
+			[]Option{WithSchema("v1")},
+			[]Option{WithSchema("v2"), WithMigration(migrate)},
+			schemaRetagged{Name: "cachin"},
+			nil,
+		},
+		{
+			"migration failed",
+			[]Option{WithSchema("v0")},
+			[]Option{WithSchema("v2"), WithMigration(migrate)},
+			schemaRetagged{},
+			ErrSchemaMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryStore(Forever, 0)
+
+			// the stored value is always written by the old version of the type
+			old := NewData[schemaV1](store, "test", tt.stored...)
+			_ = old.Set(ctx, schemaV1{Name: "cachin"})
+
+			d := NewData[schemaRetagged](store, "test", tt.opts...)
+			err := d.Load(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Data.Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if d.Get() != tt.want {
+				t.Errorf("Data.Load() = %v, want %v", d.Get(), tt.want)
+			}
+			if (tt.wantErr != nil) != d.IsUnset() {
+				t.Errorf("Data.IsUnset() = %v, want %v", d.IsUnset(), tt.wantErr != nil)
+			}
+		})
+	}
+}
+
+func TestData_schemaLegacy(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(Forever, 0)
+
+	// values stored before schemas were recorded don't have one, so they are still loaded
+	_ = store.Set(ctx, "test", []byte(`{"full_name":"cachin"}`))
+	d := NewData[schemaRetagged](store, "test")
+	if err := d.Load(ctx); err != nil || d.Get().Name != "cachin" {
+		t.Errorf("Data.Load() = %v, %v, want cachin", d.Get(), err)
+	}
+}
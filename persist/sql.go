@@ -0,0 +1,295 @@
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sqlSweepBatch is the most rows a single statement deletes when an SQLStore is swept
+const sqlSweepBatch = 1000
+
+// SQLDialect is the flavor of SQL an SQLStore uses to talk to its database
+type SQLDialect struct {
+	name     string
+	blobType string
+
+	// numbered is set if the database uses numbered placeholders like $1 instead of ?
+	numbered bool
+}
+
+var (
+	// SQLite is the SQLDialect for SQLite 3.24 or later
+	SQLite = SQLDialect{name: "sqlite", blobType: "BLOB"}
+
+	// Postgres is the SQLDialect for PostgreSQL 9.5 or later
+	Postgres = SQLDialect{name: "postgres", blobType: "BYTEA", numbered: true}
+)
+
+// String returns the name of the dialect
+func (d SQLDialect) String() string {
+	return d.name
+}
+
+// SQLStore is a Store that keeps cache data in a table of an SQL database, using any database/sql driver the dialect
+// supports. The table has four columns, key, value, updated_at and expires_at, where the times are unix nanoseconds
+// and expires_at is NULL if the value never expires. It can be created with Migrate. Values are stored as Envelopes,
+// but rows written by other applications with a raw value are still read, using updated_at as their timestamp. Values
+// whose Envelope TTL has passed are treated as missing until they are removed with Sweep. SQLStore is safe for
+// concurrent use.
+type SQLStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+	table   string
+	index   string
+	clock   Clock
+}
+
+// NewSQLStore creates a new SQLStore that keeps its values in the named table of db. The table name can be qualified
+// with a schema, like cache.entries. The caller owns db and must close it once the store is no longer used
+func NewSQLStore(db *sql.DB, dialect SQLDialect, table string, opts ...StoreOption) *SQLStore {
+	o := storeOptionsFrom(opts)
+
+	parts := strings.Split(table, ".")
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = quoteIdent(part)
+	}
+
+	return &SQLStore{
+		db:      db,
+		dialect: dialect,
+		table:   strings.Join(quoted, "."),
+		index:   quoteIdent(parts[len(parts)-1] + "_expires_at"),
+		clock:   o.clock,
+	}
+}
+
+// Migrate creates the stores table and its index if they do not exist
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	"key" TEXT PRIMARY KEY,
+	"value" %s NOT NULL,
+	"updated_at" BIGINT NOT NULL,
+	"expires_at" BIGINT
+)`, s.table, s.dialect.blobType))
+	if err != nil {
+		return fmt.Errorf("%w | failed to create table %s", err, s.table)
+	}
+
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s ("expires_at")`, s.index, s.table))
+	if err != nil {
+		return fmt.Errorf("%w | failed to create index %s", err, s.index)
+	}
+
+	return nil
+}
+
+// Get returns the value of the key. If the key is missing or expired no error will be returned
+func (s *SQLStore) Get(ctx context.Context, key string) ([]byte, time.Time, error) {
+	env, err := s.GetEnvelope(ctx, key)
+	if err != nil || env == nil {
+		return nil, time.Time{}, err
+	}
+
+	return env.Value, env.Updated, nil
+}
+
+// GetEnvelope returns the envelope of the key. If the key is missing or expired no error will be returned
+func (s *SQLStore) GetEnvelope(ctx context.Context, key string) (*Envelope, error) {
+	return s.read(ctx, s.db, key)
+}
+
+// Set upserts the value
+func (s *SQLStore) Set(ctx context.Context, key string, val []byte) error {
+	return s.SetEnvelope(ctx, key, &Envelope{Value: val})
+}
+
+// SetEnvelope stamps the envelope with the stores clock and upserts it
+func (s *SQLStore) SetEnvelope(ctx context.Context, key string, env *Envelope) error {
+	env = env.clone()
+	env.stamp(s.clock.Now())
+
+	return s.write(ctx, s.db, key, env)
+}
+
+// Delete removes the key from the store. If the key is missing no error will be returned
+func (s *SQLStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query(`DELETE FROM %s WHERE "key" = ?`), key)
+	return err
+}
+
+// Touch sets the last update time of the key to now in a transaction. If the key is missing or expired no error will
+// be returned
+func (s *SQLStore) Touch(ctx context.Context, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	env, err := s.read(ctx, tx, key)
+	if err != nil || env == nil {
+		return err
+	}
+
+	env.Updated = s.clock.Now()
+	err = s.write(ctx, tx, key, env)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// List returns the sorted keys of every value that starts with the provided prefix and has not expired
+func (s *SQLStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// LIKE is case-insensitive in some databases, so the start of each key is compared instead
+	query := `SELECT "key" FROM %s WHERE ("expires_at" IS NULL OR "expires_at" > ?)`
+	args := []any{s.clock.Now().UnixNano()}
+	if prefix != "" {
+		query += ` AND substr("key", 1, ?) = ?`
+		args = append(args, utf8.RuneCountInString(prefix), prefix)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// databases sort with their own collation, so keys are sorted here to match the other stores
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Sweep deletes every expired value and returns how many were deleted. Values are deleted in batches so a large
+// sweep does not hold a lock on the table for long
+func (s *SQLStore) Sweep(ctx context.Context) (int, error) {
+	query := s.query(`DELETE FROM %s WHERE "key" IN (SELECT "key" FROM %s WHERE "expires_at" <= ? LIMIT ?)`)
+	now := s.clock.Now().UnixNano()
+
+	removed := 0
+	for {
+		res, err := s.db.ExecContext(ctx, query, now, sqlSweepBatch)
+		if err != nil {
+			return removed, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+
+		removed += int(n)
+		if n < sqlSweepBatch {
+			return removed, nil
+		}
+	}
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// read reads the key's envelope
+func (s *SQLStore) read(ctx context.Context, q sqlQuerier, key string) (*Envelope, error) {
+	var (
+		raw     []byte
+		updated int64
+	)
+	row := q.QueryRowContext(ctx, s.query(`SELECT "value", "updated_at" FROM %s WHERE "key" = ? AND ("expires_at" IS NULL OR "expires_at" > ?)`), key, s.clock.Now().UnixNano())
+	err := row.Scan(&raw, &updated)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	env := &Envelope{}
+	err = env.UnmarshalBinary(raw)
+	if errors.Is(err, ErrNotEnvelope) {
+		ts := fromUnixNano(updated)
+		return &Envelope{Created: ts, Updated: ts, Value: raw}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w | key %q", err, key)
+	}
+
+	return env, nil
+}
+
+// write upserts the key's envelope
+func (s *SQLStore) write(ctx context.Context, q sqlQuerier, key string, env *Envelope) error {
+	raw, err := env.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var expires sql.NullInt64
+	if env.TTL != Forever {
+		expires = sql.NullInt64{Int64: env.Updated.Add(env.TTL).UnixNano(), Valid: true}
+	}
+
+	_, err = q.ExecContext(ctx, s.query(`INSERT INTO %s ("key", "value", "updated_at", "expires_at") VALUES (?, ?, ?, ?)
+ON CONFLICT ("key") DO UPDATE SET "value" = excluded."value", "updated_at" = excluded."updated_at", "expires_at" = excluded."expires_at"`),
+		key, raw, env.Updated.UnixNano(), expires)
+	return err
+}
+
+// query rewrites the query's placeholders for the stores dialect and fills in every %s with the stores table
+func (s *SQLStore) query(query string) string {
+	return strings.ReplaceAll(s.dialect.rebind(query), "%s", s.table)
+}
+
+// rebind rewrites ? placeholders as $1, $2... if the dialect uses numbered placeholders
+func (d SQLDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// quoteIdent quotes an SQL identifier so it can't be mistaken for a keyword or inject SQL
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
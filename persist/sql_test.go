@@ -0,0 +1,233 @@
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// openTestSQLiteDB opens an SQLite database that is closed when the test ends
+func openTestSQLiteDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal("failed to open sqlite db", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	return db
+}
+
+// newTestSQLStore creates an SQLStore backed by SQLite with its table already migrated
+func newTestSQLStore(t *testing.T, table string, opts ...StoreOption) *SQLStore {
+	t.Helper()
+	s := NewSQLStore(openTestSQLiteDB(t), SQLite, table, opts...)
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal("SQLStore.Migrate() error", err)
+	}
+
+	return s
+}
+
+func TestSQLDialect_rebind(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect SQLDialect
+		query   string
+		want    string
+	}{
+		{
+			"sqlite",
+			SQLite,
+			`SELECT "key" FROM t WHERE "key" = ? AND "expires_at" > ?`,
+			`SELECT "key" FROM t WHERE "key" = ? AND "expires_at" > ?`,
+		},
+		{
+			"postgres",
+			Postgres,
+			`SELECT "key" FROM t WHERE "key" = ? AND "expires_at" > ?`,
+			`SELECT "key" FROM t WHERE "key" = $1 AND "expires_at" > $2`,
+		},
+		{
+			"no placeholders",
+			Postgres,
+			`SELECT "key" FROM t`,
+			`SELECT "key" FROM t`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dialect.rebind(tt.query); got != tt.want {
+				t.Errorf("SQLDialect.rebind() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSQLStore_table(t *testing.T) {
+	tests := []struct {
+		name      string
+		table     string
+		wantTable string
+		wantIndex string
+	}{
+		{
+			"plain",
+			"cache",
+			`"cache"`,
+			`"cache_expires_at"`,
+		},
+		{
+			"schema",
+			"app.cache",
+			`"app"."cache"`,
+			`"cache_expires_at"`,
+		},
+		{
+			"quotes",
+			`my "cache"`,
+			`"my ""cache"""`,
+			`"my ""cache""_expires_at"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSQLStore(nil, Postgres, tt.table)
+			if s.table != tt.wantTable || s.index != tt.wantIndex {
+				t.Errorf("NewSQLStore() table = %s, index = %s, want %s, %s", s.table, s.index, tt.wantTable, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestSQLStore_Migrate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStore(t, `my "cache"`)
+	if err := s.Set(ctx, "test_key", []byte(`test`)); err != nil {
+		t.Fatal("SQLStore.Set() error", err)
+	}
+
+	// migrating again keeps the existing rows
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("SQLStore.Migrate() again error = %v", err)
+	}
+	if got, _, err := s.Get(ctx, "test_key"); err != nil || string(got) != "test" {
+		t.Errorf("SQLStore.Get() after Migrate() = %s, %v, want test", got, err)
+	}
+}
+
+func TestSQLStore_List(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStore(t, "cache")
+	for _, key := range []string{"App/a", "app/b", "apple", "ünïcode/a", "50%/a", "other"} {
+		if err := s.Set(ctx, key, []byte(key)); err != nil {
+			t.Fatal("SQLStore.Set() error", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{
+			"all keys",
+			"",
+			[]string{"50%/a", "App/a", "app/b", "apple", "other", "ünïcode/a"},
+		},
+		{
+			"case sensitive",
+			"app",
+			[]string{"app/b", "apple"},
+		},
+		{
+			"unicode",
+			"ünï",
+			[]string{"ünïcode/a"},
+		},
+		{
+			"like wildcards are literal",
+			"5_%",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(ctx, tt.prefix)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SQLStore.List() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLStore_Sweep(t *testing.T) {
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2020, 05, 15, 10, 0, 0, 0, time.UTC)}
+	s := newTestSQLStore(t, "cache", WithClock(clock))
+
+	// more expired values than fit in a single batch
+	for i := 0; i < sqlSweepBatch+5; i++ {
+		if err := s.SetEnvelope(ctx, "expired/"+time.Duration(i).String(), &Envelope{TTL: time.Minute}); err != nil {
+			t.Fatal("SQLStore.SetEnvelope() error", err)
+		}
+	}
+	if err := s.SetEnvelope(ctx, "long", &Envelope{Value: []byte(`long`), TTL: time.Hour}); err != nil {
+		t.Fatal("SQLStore.SetEnvelope() error", err)
+	}
+	if err := s.Set(ctx, "forever", []byte(`forever`)); err != nil {
+		t.Fatal("SQLStore.Set() error", err)
+	}
+	clock.Advance(time.Minute * 2)
+
+	// expired values are hidden before they are swept
+	if got, _, err := s.Get(ctx, "expired/0s"); err != nil || got != nil {
+		t.Errorf("SQLStore.Get() expired = %s, %v, want nil", got, err)
+	}
+	if err := s.Touch(ctx, "expired/0s"); err != nil {
+		t.Errorf("SQLStore.Touch() expired error = %v", err)
+	}
+
+	removed, err := s.Sweep(ctx)
+	if err != nil || removed != sqlSweepBatch+5 {
+		t.Errorf("SQLStore.Sweep() = %d, %v, want %d", removed, err, sqlSweepBatch+5)
+	}
+
+	// touching a value moves its expiry
+	clock.Advance(time.Minute * 50)
+	if err := s.Touch(ctx, "long"); err != nil {
+		t.Fatal("SQLStore.Touch() error", err)
+	}
+	clock.Advance(time.Minute * 30)
+	if _, err := s.Sweep(ctx); err != nil {
+		t.Fatal("SQLStore.Sweep() error", err)
+	}
+
+	keys, err := s.List(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"forever", "long"}) {
+		t.Errorf("SQLStore.List() after Sweep() = %v, %v, want [forever long]", keys, err)
+	}
+}
+
+func TestSQLStore_rawValue(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStore(t, "cache")
+	updated := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	_, err := s.db.ExecContext(ctx, `INSERT INTO "cache" ("key", "value", "updated_at") VALUES (?, ?, ?)`, "test_key", []byte(`raw`), updated.UnixNano())
+	if err != nil {
+		t.Fatal("failed to insert raw value", err)
+	}
+
+	got, ts, err := s.Get(ctx, "test_key")
+	if err != nil || string(got) != "raw" || !ts.Equal(updated) {
+		t.Errorf("SQLStore.Get() raw value = %s, %v, %v, want raw, %v", got, ts, err, updated)
+	}
+}
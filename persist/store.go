@@ -16,8 +16,27 @@ func SafeKey(key string) string {
 	return encoded
 }
 
-// rawData wraps raw bytes in a struct along with the last update time. This can be used to make storing data in an
-// external data store easier
+// unsafeKey reverses SafeKey, returning the original key. It fails if the provided key was not created by SafeKey
+func unsafeKey(key string) (string, error) {
+	key = strings.ReplaceAll(key, "-", "+")
+	key = strings.ReplaceAll(key, "_", "/")
+	key = strings.ReplaceAll(key, ".", "=")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decoded), nil
+}
+
+// safeKeyPrefix converts a key prefix into a prefix that all SafeKey encoded keys starting with the original prefix
+// share. Because base64 encodes 3 bytes at a time, only the longest multiple of 3 bytes can be encoded
+func safeKeyPrefix(prefix string) string {
+	return SafeKey(prefix[:len(prefix)/3*3])
+}
+
+// rawData wraps raw bytes in a struct along with the last update time. It's the JSON format RedisStore used before
+// values were stored in an Envelope, so it's kept to read values written by older versions
 type rawData struct {
 	LastSet time.Time
 	Raw     []byte